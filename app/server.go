@@ -1,20 +1,61 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"patches/handlers"
+	"patches/health"
 	"patches/kafka"
+	"patches/logging"
 	"patches/models"
+	"patches/tracing"
 	"patches/websockets"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
 )
 
+// healthCheckTimeout is how long each health check may take before it fails.
+const healthCheckTimeout = 2 * time.Second
+
+// shutdownTimeout is how long requests that are still being served may take to
+// finish once the server shuts down.
+const shutdownTimeout = 10 * time.Second
+
+// drainPeriod is how long the server keeps serving while reporting that it
+// isn't ready, so that orchestrators stop routing traffic to it before it
+// shuts down.
+func drainPeriod() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("PATCHES_DRAIN_S"))
+	if err != nil || seconds < 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
 func main() {
+	logger, err := logging.New()
+	if err != nil {
+		log.Fatal(err)
+		return
+	}
+	defer logger.Sync()
+
+	stopTracing, err := tracing.Setup()
+	if err != nil {
+		logger.Fatal("Failed to set up tracing", zap.Error(err))
+		return
+	}
+	defer stopTracing()
+
 	connectionString := fmt.Sprintf(
 		"host=%s port=%s user=%s password=%s sslmode=disable",
 		os.Getenv("PATCHES_DB_HOST"),
@@ -22,23 +63,48 @@ func main() {
 		os.Getenv("PATCHES_DB_USERNAME"),
 		os.Getenv("PATCHES_DB_PASSWORD"),
 	)
-	db, err := models.DBConnect(connectionString)
+	db, err := models.DBConnect(connectionString, logger)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatal("Failed to connect to the database", zap.Error(err))
 		return
 	}
 	httpClient := &http.Client{Timeout: time.Second * 10}
 	kafkaWriter := kafka.NewWriter(
 		os.Getenv("PATCHES_KAFKA_SERVER"),
 		os.Getenv("PATCHES_KAFKA_TOPIC"),
+		logger,
 	)
-	broker := websockets.NewBroker(db, httpClient, kafkaWriter)
-	env := handlers.NewEnv(db, broker)
+	broker := websockets.NewBroker(db, httpClient, kafkaWriter, logger)
+
+	liveness := health.NewChecker(healthCheckTimeout)
+	liveness.Add("conversations", broker.CheckConversations)
+
+	readiness := health.NewChecker(healthCheckTimeout)
+	readiness.Add("database", db.PingContext)
+	readiness.Add("kafka", kafkaWriter.Check)
+	readiness.Add("heimdall", broker.CheckHeimdall)
+	readiness.Add("ether", broker.CheckEther)
+
+	env := handlers.NewEnv(db, broker, liveness, readiness, logger)
 
 	httpMux := mux.NewRouter()
 
 	httpMux.HandleFunc("/patches/v1/patches", env.GetPatchesHandler).Methods("GET")
+	httpMux.HandleFunc("/patches/v1/conversations/{conversation_id:[0-9]+}/activity", env.GetActivityHandler).Methods("GET")
+	httpMux.HandleFunc("/patches/v1/conversations/{conversation_id:[0-9]+}/content", env.GetContentHandler).Methods("GET")
+	httpMux.HandleFunc("/patches/v1/conversations/{conversation_id:[0-9]+}/blame", env.GetBlameHandler).Methods("GET")
+	httpMux.HandleFunc("/patches/v1/conversations/{conversation_id:[0-9]+}/revert", env.RevertHandler).Methods("POST")
+	httpMux.HandleFunc("/patches/v1/conversations/{conversation_id:[0-9]+}/messages", env.GetMessagesHandler).Methods("GET")
+	httpMux.HandleFunc("/patches/v1/conversations/{conversation_id:[0-9]+}/comments", env.GetCommentsHandler).Methods("GET")
+	httpMux.HandleFunc("/patches/v1/conversations/{conversation_id:[0-9]+}/comments", env.CreateCommentHandler).Methods("POST")
+	httpMux.HandleFunc("/patches/v1/conversations/{conversation_id:[0-9]+}/comments/{comment_id:[0-9]+}", env.UpdateCommentHandler).Methods("PATCH")
+	httpMux.HandleFunc("/patches/v1/conversations/{conversation_id:[0-9]+}/comments/{comment_id:[0-9]+}", env.DeleteCommentHandler).Methods("DELETE")
+	httpMux.HandleFunc("/patches/v1/admin/conversations", env.ListConversationsHandler).Methods("GET")
+	httpMux.HandleFunc("/patches/v1/admin/conversations/{conversation_id:[0-9]+}", env.InspectConversationHandler).Methods("GET")
 	httpMux.HandleFunc("/patches/v1/connect/{conversation_id:[0-9]+}", env.ConnectHandler).Methods("GET")
+	httpMux.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	httpMux.HandleFunc("/healthz", env.HealthzHandler).Methods("GET")
+	httpMux.HandleFunc("/readyz", env.ReadyzHandler).Methods("GET")
 
 	httpSrv := &http.Server{
 		Addr:         ":80",
@@ -48,5 +114,32 @@ func main() {
 		Handler:      httpMux,
 	}
 
-	log.Fatal(httpSrv.ListenAndServe())
+	go func() {
+		if err := httpSrv.ListenAndServe(); err != http.ErrServerClosed {
+			logger.Fatal("Server stopped", zap.Error(err))
+		}
+	}()
+
+	// Stop being ready as soon as the server is told to stop, and keep serving
+	// until orchestrators have stopped routing traffic to it
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	<-stop
+	drain := drainPeriod()
+	logger.Info("Draining before shutting down", zap.Duration("drain", drain))
+	readiness.Drain()
+	time.Sleep(drain)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := httpSrv.Shutdown(ctx); err != nil {
+		logger.Error("Failed to shut down server", zap.Error(err))
+	}
+
+	// WebSocket connections aren't closed by the server, so disconnect them by
+	// shutting down every conversation
+	if err := broker.Shutdown(ctx); err != nil {
+		logger.Error("Failed to shut down conversations", zap.Error(err))
+	}
+	logger.Info("Server stopped")
 }
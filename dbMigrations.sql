@@ -0,0 +1,39 @@
+ALTER TABLE patches ADD COLUMN IF NOT EXISTS version INTEGER;
+ALTER TABLE patches ADD COLUMN IF NOT EXISTS inserted INTEGER;
+ALTER TABLE patches ADD COLUMN IF NOT EXISTS deleted INTEGER;
+
+CREATE TABLE IF NOT EXISTS snapshots (
+  time TIMESTAMPTZ NOT NULL,
+  content TEXT NOT NULL,
+  convo_id INTEGER,
+  version INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS snapshots_convo_id_version_idx ON snapshots (convo_id, version);
+
+CREATE TABLE IF NOT EXISTS messages (
+  time TIMESTAMPTZ NOT NULL,
+  convo_id INTEGER,
+  user_id INTEGER,
+  namespace TEXT NOT NULL,
+  payload JSONB
+);
+
+CREATE INDEX IF NOT EXISTS messages_convo_id_time_idx ON messages (convo_id, time);
+
+CREATE TABLE IF NOT EXISTS comments (
+  id SERIAL PRIMARY KEY,
+  convo_id INTEGER NOT NULL,
+  user_id INTEGER NOT NULL,
+  parent_id INTEGER,
+  anchor_start INTEGER NOT NULL,
+  anchor_end INTEGER NOT NULL,
+  version INTEGER NOT NULL,
+  body TEXT NOT NULL,
+  resolved BOOLEAN NOT NULL DEFAULT FALSE,
+  orphaned BOOLEAN NOT NULL DEFAULT FALSE,
+  created_at TIMESTAMPTZ NOT NULL,
+  updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS comments_convo_id_idx ON comments (convo_id);
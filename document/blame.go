@@ -0,0 +1,114 @@
+package document
+
+import (
+	"fmt"
+	"patches/models"
+)
+
+// Span attributes a range of a document to the user and version that last
+// changed it. Start and End are rune offsets into the document.
+type Span struct {
+	Start   int   `json:"start"`
+	End     int   `json:"end"`
+	UserID  int64 `json:"user_id"`
+	Version int   `json:"version"`
+}
+
+// Spans is an ordered list of spans that covers a whole document.
+type Spans []Span
+
+// Replace returns the spans of a document after the range [start, end) is
+// replaced with text of length insertedLength that is attributed to a user
+// and version. Spans that are after the range are shifted and adjacent spans
+// with the same attribution are merged.
+func (spans Spans) Replace(start, end, insertedLength int, userID int64, version int) Spans {
+	shift := insertedLength - (end - start)
+	inserted := Span{
+		Start:   start,
+		End:     start + insertedLength,
+		UserID:  userID,
+		Version: version,
+	}
+
+	newSpans := Spans{}
+	insertedAdded := false
+	for _, span := range spans {
+		// Keep the part of the span that is before the range
+		if span.Start < start {
+			before := span
+			if before.End > start {
+				before.End = start
+			}
+			newSpans = newSpans.add(before)
+		}
+
+		// Keep the part of the span that is after the range
+		if span.End > end {
+			if !insertedAdded {
+				newSpans = newSpans.add(inserted)
+				insertedAdded = true
+			}
+			after := span
+			if after.Start < end {
+				after.Start = end
+			}
+			after.Start += shift
+			after.End += shift
+			newSpans = newSpans.add(after)
+		}
+	}
+	if !insertedAdded {
+		newSpans = newSpans.add(inserted)
+	}
+
+	return newSpans
+}
+
+// add appends a span to the end of the spans, merging it with the last span if
+// they are adjacent and have the same attribution. Empty spans are dropped.
+func (spans Spans) add(span Span) Spans {
+	if span.Start >= span.End {
+		return spans
+	}
+	if len(spans) > 0 {
+		last := &spans[len(spans)-1]
+		if last.End == span.Start && last.UserID == span.UserID && last.Version == span.Version {
+			last.End = span.End
+			return spans
+		}
+	}
+	return append(spans, span)
+}
+
+// Blame replays persisted patches in order on top of a snapshot while tracking
+// the user and version that last changed each range of the document. The
+// content of the snapshot is attributed to no user at the snapshot's version.
+// The spans of the resulting document are returned along with the version
+// that was reached.
+func Blame(snapshot *models.Snapshot, patches []models.Patch) (Spans, int, error) {
+	doc := snapshot.Content
+	version := snapshot.Version
+	spans := Spans{}.add(Span{
+		Start:   0,
+		End:     len([]rune(doc)),
+		Version: version,
+	})
+
+	for _, patch := range patches {
+		if patch.Version <= version {
+			continue
+		}
+
+		newDoc, err := ApplyPatch(doc, patch.Patch)
+		if err != nil {
+			return nil, version, fmt.Errorf("failed to apply patch for version %d: %v", patch.Version, err)
+		}
+
+		start, end, inserted := Change(doc, newDoc)
+		spans = spans.Replace(start, end, len([]rune(inserted)), patch.UserID, patch.Version)
+		doc = newDoc
+		version = patch.Version
+	}
+
+	return spans, version, nil
+}
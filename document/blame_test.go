@@ -0,0 +1,237 @@
+package document
+
+import (
+	"patches/models"
+	"reflect"
+	"testing"
+)
+
+var initialSpans = Spans{
+	{Start: 0, End: 5, UserID: 1, Version: 1},
+	{Start: 5, End: 10, UserID: 2, Version: 2},
+}
+
+func TestSpansReplace(t *testing.T) {
+	tests := []struct {
+		Name           string
+		Spans          Spans
+		Start          int
+		End            int
+		InsertedLength int
+		UserID         int64
+		Version        int
+
+		ExpectedSpans Spans
+	}{
+		{
+			Name:           "Insert::Empty Document",
+			Spans:          Spans{},
+			Start:          0,
+			End:            0,
+			InsertedLength: 3,
+			UserID:         3,
+			Version:        3,
+			ExpectedSpans: Spans{
+				{Start: 0, End: 3, UserID: 3, Version: 3},
+			},
+		},
+		{
+			Name:           "Insert::Start Of Document",
+			Spans:          initialSpans,
+			Start:          0,
+			End:            0,
+			InsertedLength: 2,
+			UserID:         3,
+			Version:        3,
+			ExpectedSpans: Spans{
+				{Start: 0, End: 2, UserID: 3, Version: 3},
+				{Start: 2, End: 7, UserID: 1, Version: 1},
+				{Start: 7, End: 12, UserID: 2, Version: 2},
+			},
+		},
+		{
+			Name:           "Insert::Inside Span",
+			Spans:          initialSpans,
+			Start:          2,
+			End:            2,
+			InsertedLength: 2,
+			UserID:         3,
+			Version:        3,
+			ExpectedSpans: Spans{
+				{Start: 0, End: 2, UserID: 1, Version: 1},
+				{Start: 2, End: 4, UserID: 3, Version: 3},
+				{Start: 4, End: 7, UserID: 1, Version: 1},
+				{Start: 7, End: 12, UserID: 2, Version: 2},
+			},
+		},
+		{
+			Name:           "Insert::Between Spans",
+			Spans:          initialSpans,
+			Start:          5,
+			End:            5,
+			InsertedLength: 1,
+			UserID:         3,
+			Version:        3,
+			ExpectedSpans: Spans{
+				{Start: 0, End: 5, UserID: 1, Version: 1},
+				{Start: 5, End: 6, UserID: 3, Version: 3},
+				{Start: 6, End: 11, UserID: 2, Version: 2},
+			},
+		},
+		{
+			Name:           "Insert::End Of Document",
+			Spans:          initialSpans,
+			Start:          10,
+			End:            10,
+			InsertedLength: 4,
+			UserID:         3,
+			Version:        3,
+			ExpectedSpans: Spans{
+				{Start: 0, End: 5, UserID: 1, Version: 1},
+				{Start: 5, End: 10, UserID: 2, Version: 2},
+				{Start: 10, End: 14, UserID: 3, Version: 3},
+			},
+		},
+		{
+			Name:           "Delete::Inside Span",
+			Spans:          initialSpans,
+			Start:          1,
+			End:            3,
+			InsertedLength: 0,
+			UserID:         3,
+			Version:        3,
+			ExpectedSpans: Spans{
+				{Start: 0, End: 3, UserID: 1, Version: 1},
+				{Start: 3, End: 8, UserID: 2, Version: 2},
+			},
+		},
+		{
+			Name:           "Delete::Across Spans",
+			Spans:          initialSpans,
+			Start:          3,
+			End:            7,
+			InsertedLength: 0,
+			UserID:         3,
+			Version:        3,
+			ExpectedSpans: Spans{
+				{Start: 0, End: 3, UserID: 1, Version: 1},
+				{Start: 3, End: 6, UserID: 2, Version: 2},
+			},
+		},
+		{
+			Name:           "Delete::Whole Span",
+			Spans:          initialSpans,
+			Start:          5,
+			End:            10,
+			InsertedLength: 0,
+			UserID:         3,
+			Version:        3,
+			ExpectedSpans: Spans{
+				{Start: 0, End: 5, UserID: 1, Version: 1},
+			},
+		},
+		{
+			Name:           "Delete::Whole Document",
+			Spans:          initialSpans,
+			Start:          0,
+			End:            10,
+			InsertedLength: 0,
+			UserID:         3,
+			Version:        3,
+			ExpectedSpans:  Spans{},
+		},
+		{
+			Name:           "Replace::Inside Span::Smaller",
+			Spans:          initialSpans,
+			Start:          6,
+			End:            9,
+			InsertedLength: 1,
+			UserID:         3,
+			Version:        3,
+			ExpectedSpans: Spans{
+				{Start: 0, End: 5, UserID: 1, Version: 1},
+				{Start: 5, End: 6, UserID: 2, Version: 2},
+				{Start: 6, End: 7, UserID: 3, Version: 3},
+				{Start: 7, End: 8, UserID: 2, Version: 2},
+			},
+		},
+		{
+			Name:           "Replace::Across Spans::Bigger",
+			Spans:          initialSpans,
+			Start:          4,
+			End:            6,
+			InsertedLength: 5,
+			UserID:         3,
+			Version:        3,
+			ExpectedSpans: Spans{
+				{Start: 0, End: 4, UserID: 1, Version: 1},
+				{Start: 4, End: 9, UserID: 3, Version: 3},
+				{Start: 9, End: 13, UserID: 2, Version: 2},
+			},
+		},
+		{
+			Name:           "Replace::Same Attribution Merges",
+			Spans:          initialSpans,
+			Start:          3,
+			End:            5,
+			InsertedLength: 2,
+			UserID:         1,
+			Version:        1,
+			ExpectedSpans: Spans{
+				{Start: 0, End: 5, UserID: 1, Version: 1},
+				{Start: 5, End: 10, UserID: 2, Version: 2},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			newSpans := test.Spans.Replace(
+				test.Start,
+				test.End,
+				test.InsertedLength,
+				test.UserID,
+				test.Version,
+			)
+
+			if !reflect.DeepEqual(test.ExpectedSpans, newSpans) {
+				t.Errorf(
+					"Updated spans are wrong. Expected: %+v. Actual: %+v.",
+					test.ExpectedSpans,
+					newSpans,
+				)
+			}
+		})
+	}
+}
+
+func TestBlame(t *testing.T) {
+	snapshot := &models.Snapshot{Content: "hello", Version: 4}
+	patches := []models.Patch{
+		{Patch: makePatch("hello", "hello world"), UserID: 1, Version: 5},
+		{Patch: makePatch("hello world", "hello there world"), UserID: 2, Version: 6},
+		{Patch: makePatch("hello there world", "hi there world"), UserID: 1, Version: 7},
+	}
+
+	spans, version, err := Blame(snapshot, patches)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expectedSpans := Spans{
+		{Start: 0, End: 1, UserID: 0, Version: 4},
+		{Start: 1, End: 2, UserID: 1, Version: 7},
+		{Start: 2, End: 3, UserID: 1, Version: 5},
+		{Start: 3, End: 9, UserID: 2, Version: 6},
+		{Start: 9, End: 14, UserID: 1, Version: 5},
+	}
+	if version != 7 || !reflect.DeepEqual(expectedSpans, spans) {
+		t.Errorf(
+			"Blame is wrong. Expected: %+v (v%d). Actual: %+v (v%d).",
+			expectedSpans,
+			7,
+			spans,
+			version,
+		)
+	}
+}
@@ -0,0 +1,169 @@
+package document
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"patches/models"
+	"strings"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+var (
+	// ErrPatchCount is returned when a patch text does not contain exactly one
+	// patch.
+	ErrPatchCount = errors.New("patch text must contain one patch")
+
+	// ErrPatchFailed is returned when a patch could not be applied to a
+	// document.
+	ErrPatchFailed = errors.New("patch could not be applied to the document")
+)
+
+var dmp *diffmatchpatch.DiffMatchPatch = diffmatchpatch.New()
+
+// ApplyPatch applies a single diff-match-patch patch, given in its textual
+// form, to a document and returns the resulting document.
+func ApplyPatch(doc, patchText string) (string, error) {
+	patches, err := dmp.PatchFromText(patchText)
+	if err != nil {
+		return "", err
+	}
+	if len(patches) != 1 {
+		return "", ErrPatchCount
+	}
+
+	newDoc, okList := dmp.PatchApply(patches, doc)
+	if !okList[0] {
+		return "", ErrPatchFailed
+	}
+
+	return newDoc, nil
+}
+
+// Replay applies persisted patches in order on top of a snapshot and returns
+// the resulting document along with the version that was reached.
+func Replay(snapshot *models.Snapshot, patches []models.Patch) (string, int, error) {
+	doc := snapshot.Content
+	version := snapshot.Version
+	for _, patch := range patches {
+		if patch.Version <= version {
+			continue
+		}
+
+		newDoc, err := ApplyPatch(doc, patch.Patch)
+		if err != nil {
+			return "", version, fmt.Errorf("failed to apply patch for version %d: %v", patch.Version, err)
+		}
+		doc = newDoc
+		version = patch.Version
+	}
+
+	return doc, version, nil
+}
+
+// InvertPatch returns the textual form of the patches that undo the given
+// patches by swapping their insertions and deletions.
+func InvertPatch(patchText string) (string, error) {
+	if _, err := dmp.PatchFromText(patchText); err != nil {
+		return "", err
+	}
+
+	lines := strings.Split(patchText, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "@@ ") {
+			// Swap the ranges of the header, e.g. "@@ -1,3 +1,4 @@"
+			fields := strings.Fields(line)
+			if len(fields) != 4 {
+				return "", fmt.Errorf("invalid patch header %q", line)
+			}
+			lines[i] = fmt.Sprintf("@@ -%s +%s @@", fields[2][1:], fields[1][1:])
+		} else if strings.HasPrefix(line, "+") {
+			lines[i] = "-" + line[1:]
+		} else if strings.HasPrefix(line, "-") {
+			lines[i] = "+" + line[1:]
+		}
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+// Revert undoes patches on a document that may have changed since they were
+// applied. The inverse of each patch is applied in reverse order and is
+// rebased onto the document by fuzzy matching its context. The resulting
+// document is returned along with the number of patches that were reverted.
+func Revert(doc string, patchTexts []string) (string, int, error) {
+	reverted := 0
+	for i := len(patchTexts) - 1; i >= 0; i-- {
+		inverseText, err := InvertPatch(patchTexts[i])
+		if err != nil {
+			return "", reverted, err
+		}
+		inverse, err := dmp.PatchFromText(inverseText)
+		if err != nil {
+			return "", reverted, err
+		}
+
+		newDoc, okList := dmp.PatchApply(inverse, doc)
+		applied := len(okList) > 0
+		for _, ok := range okList {
+			applied = applied && ok
+		}
+		if applied {
+			doc = newDoc
+			reverted++
+		}
+	}
+
+	return doc, reverted, nil
+}
+
+// Change finds the smallest contiguous range of before that has to be replaced
+// to turn it into after. start and end are rune offsets into before and
+// inserted is the text that replaces the range.
+func Change(before, after string) (start, end int, inserted string) {
+	b, a := []rune(before), []rune(after)
+	for start < len(b) && start < len(a) && b[start] == a[start] {
+		start++
+	}
+
+	end = len(b)
+	aEnd := len(a)
+	for end > start && aEnd > start && b[end-1] == a[aEnd-1] {
+		end--
+		aEnd--
+	}
+
+	return start, end, string(a[start:aEnd])
+}
+
+// MakePatch creates the textual form of a single patch that turns before into
+// after by replacing the range found by Change.
+func MakePatch(before, after string) string {
+	start, end, inserted := Change(before, after)
+	b := []rune(before)
+
+	diffs := []diffmatchpatch.Diff{}
+	if start > 0 {
+		diffs = append(diffs, diffmatchpatch.Diff{Type: diffmatchpatch.DiffEqual, Text: string(b[:start])})
+	}
+	if end > start {
+		diffs = append(diffs, diffmatchpatch.Diff{Type: diffmatchpatch.DiffDelete, Text: string(b[start:end])})
+	}
+	if inserted != "" {
+		diffs = append(diffs, diffmatchpatch.Diff{Type: diffmatchpatch.DiffInsert, Text: inserted})
+	}
+	if end < len(b) {
+		diffs = append(diffs, diffmatchpatch.Diff{Type: diffmatchpatch.DiffEqual, Text: string(b[end:])})
+	}
+
+	return dmp.PatchToText(dmp.PatchMake(before, diffs))
+}
+
+// Hash returns the hex-encoded SHA-256 hash of a document's UTF-8 content,
+// which identifies the content without sending all of it.
+func Hash(doc string) string {
+	sum := sha256.Sum256([]byte(doc))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,196 @@
+package document
+
+import (
+	"patches/models"
+	"testing"
+)
+
+// makePatch creates the textual form of a patch that turns before into after.
+func makePatch(before, after string) string {
+	return dmp.PatchToText(dmp.PatchMake(before, after))
+}
+
+func TestReplay(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Snapshot models.Snapshot
+		Patches  []models.Patch
+
+		ExpectedContent string
+		ExpectedVersion int
+	}{
+		{
+			Name:            "No Patches",
+			Snapshot:        models.Snapshot{Content: "hello", Version: 3},
+			Patches:         []models.Patch{},
+			ExpectedContent: "hello",
+			ExpectedVersion: 3,
+		},
+		{
+			Name:     "Insert Then Delete",
+			Snapshot: models.Snapshot{Content: "hello", Version: 0},
+			Patches: []models.Patch{
+				{Patch: makePatch("hello", "hello world"), Version: 1},
+				{Patch: makePatch("hello world", "hello wor"), Version: 2},
+			},
+			ExpectedContent: "hello wor",
+			ExpectedVersion: 2,
+		},
+		{
+			Name:     "Replace",
+			Snapshot: models.Snapshot{Content: "<p>the quick fox</p>", Version: 10},
+			Patches: []models.Patch{
+				{Patch: makePatch("<p>the quick fox</p>", "<p>the slow fox</p>"), Version: 11},
+			},
+			ExpectedContent: "<p>the slow fox</p>",
+			ExpectedVersion: 11,
+		},
+		{
+			Name:     "Skips Patches Included In Snapshot",
+			Snapshot: models.Snapshot{Content: "ab", Version: 2},
+			Patches: []models.Patch{
+				{Patch: makePatch("", "a"), Version: 1},
+				{Patch: makePatch("a", "ab"), Version: 2},
+				{Patch: makePatch("ab", "abc"), Version: 3},
+			},
+			ExpectedContent: "abc",
+			ExpectedVersion: 3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			content, version, err := Replay(&test.Snapshot, test.Patches)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if content != test.ExpectedContent || version != test.ExpectedVersion {
+				t.Errorf(
+					"Replayed content is wrong. Expected: %q (v%d). Actual: %q (v%d).",
+					test.ExpectedContent,
+					test.ExpectedVersion,
+					content,
+					version,
+				)
+			}
+		})
+	}
+}
+
+func TestApplyPatchErrors(t *testing.T) {
+	if _, err := ApplyPatch("abc", makePatch("aaaa bbbb cccc dddd eeee", "zzzz bbbb cccc dddd yyyy")); err != ErrPatchCount {
+		t.Errorf("Expected %v for multiple patches. Actual: %v", ErrPatchCount, err)
+	}
+
+	if _, err := ApplyPatch("completely different", makePatch("hello world", "hello there")); err != ErrPatchFailed {
+		t.Errorf("Expected %v for unmatched patch. Actual: %v", ErrPatchFailed, err)
+	}
+}
+
+func TestRevert(t *testing.T) {
+	tests := []struct {
+		Name    string
+		History []string
+		Revert  [2]int
+		Doc     string
+
+		ExpectedDoc      string
+		ExpectedReverted int
+	}{
+		{
+			Name:             "Revert Last Edit",
+			History:          []string{"hello", "hello world"},
+			Revert:           [2]int{0, 1},
+			ExpectedDoc:      "hello",
+			ExpectedReverted: 1,
+		},
+		{
+			Name:             "Revert Deletion",
+			History:          []string{"hello cruel world", "hello world"},
+			Revert:           [2]int{0, 1},
+			ExpectedDoc:      "hello cruel world",
+			ExpectedReverted: 1,
+		},
+		{
+			Name:             "Revert Range In Middle Of History",
+			History:          []string{"<p>intro</p>", "<p>intro</p><p>spam spam</p>", "<p>intro</p><p>spam spam</p><p>outro</p>"},
+			Revert:           [2]int{0, 1},
+			ExpectedDoc:      "<p>intro</p><p>outro</p>",
+			ExpectedReverted: 1,
+		},
+		{
+			Name:             "Revert Multiple Edits",
+			History:          []string{"abc", "abc def", "abc def ghi"},
+			Revert:           [2]int{0, 2},
+			ExpectedDoc:      "abc",
+			ExpectedReverted: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			patchTexts := []string{}
+			for i := test.Revert[0]; i < test.Revert[1]; i++ {
+				patchTexts = append(patchTexts, makePatch(test.History[i], test.History[i+1]))
+			}
+
+			doc, reverted, err := Revert(test.History[len(test.History)-1], patchTexts)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if doc != test.ExpectedDoc || reverted != test.ExpectedReverted {
+				t.Errorf(
+					"Reverted document is wrong. Expected: %q (%d reverted). Actual: %q (%d reverted).",
+					test.ExpectedDoc,
+					test.ExpectedReverted,
+					doc,
+					reverted,
+				)
+			}
+		})
+	}
+}
+
+func TestMakePatch(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Before string
+		After  string
+
+		ExpectedStart    int
+		ExpectedEnd      int
+		ExpectedInserted string
+	}{
+		{"Insert", "hello", "hello world", 5, 5, " world"},
+		{"Delete", "hello world", "hello", 5, 11, ""},
+		{"Replace", "the quick fox", "the slow fox", 4, 9, "slow"},
+		{"Unicode", "héllo wörld", "héllo wérld", 7, 8, "é"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			start, end, inserted := Change(test.Before, test.After)
+			if start != test.ExpectedStart || end != test.ExpectedEnd || inserted != test.ExpectedInserted {
+				t.Errorf(
+					"Change is wrong. Expected: [%d, %d) %q. Actual: [%d, %d) %q.",
+					test.ExpectedStart,
+					test.ExpectedEnd,
+					test.ExpectedInserted,
+					start,
+					end,
+					inserted,
+				)
+			}
+
+			doc, err := ApplyPatch(test.Before, MakePatch(test.Before, test.After))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if doc != test.After {
+				t.Errorf("Patched document is wrong. Expected: %q. Actual: %q.", test.After, doc)
+			}
+		})
+	}
+}
@@ -9,6 +9,12 @@ require (
 	github.com/gorilla/websocket v1.4.1
 	github.com/lib/pq v1.3.0
 	github.com/mattn/go-sqlite3 v2.0.2+incompatible
+	github.com/prometheus/client_golang v1.5.1
 	github.com/segmentio/kafka-go v0.3.5
 	github.com/sergi/go-diff v1.1.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	go.opentelemetry.io/otel v0.6.0
+	go.opentelemetry.io/otel/exporters/otlp v0.6.0
+	go.uber.org/zap v1.15.0
+	google.golang.org/grpc v1.27.1
 )
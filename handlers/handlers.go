@@ -1,92 +1,567 @@
 package handlers
 
 import (
+	"context"
+	"crypto/subtle"
+	"os"
+	"patches/document"
+	"patches/health"
 	"patches/models"
+	"patches/protocol"
 	"patches/websockets"
 	"strconv"
+	"strings"
+	"time"
 
 	"encoding/json"
-	"log"
 	"net/http"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/schema"
 	gorillaws "github.com/gorilla/websocket"
+	"go.uber.org/zap"
 )
 
 // Env represents all application-level items that are needed by handlers.
 type Env struct {
-	DB       models.Datastore
-	WSBroker *websockets.Broker
+	DB        models.Datastore
+	WSBroker  *websockets.Broker
+	Liveness  *health.Checker
+	Readiness *health.Checker
+	Logger    *zap.Logger
 }
 
 // NewEnv creates a new Env struct.
-func NewEnv(db models.Datastore, wsBroker *websockets.Broker) *Env {
+func NewEnv(
+	db models.Datastore,
+	wsBroker *websockets.Broker,
+	liveness *health.Checker,
+	readiness *health.Checker,
+	logger *zap.Logger,
+) *Env {
 	return &Env{
-		DB:       db,
-		WSBroker: wsBroker,
+		DB:        db,
+		WSBroker:  wsBroker,
+		Liveness:  liveness,
+		Readiness: readiness,
+		Logger:    logger,
 	}
 }
 
+// adminToken is the bearer token that admin requests must be authorized with.
+// The admin API is disabled if it isn't set.
+var adminToken = os.Getenv("PATCHES_ADMIN_TOKEN")
+
+// inspectTimeout is how long an active conversation may take to describe its
+// state before an inspection fails.
+const inspectTimeout = 5 * time.Second
+
 var upgrader = gorillaws.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
+	Subprotocols:      protocol.Subprotocols,
+	EnableCompression: true,
+}
+
+// HealthzHandler reports whether the process is alive, with the outcome of each
+// liveness check.
+func (env *Env) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	env.writeReport(w, env.Liveness.Run(r.Context()))
+}
+
+// ReadyzHandler reports whether the service is ready to receive traffic, with
+// the outcome of each readiness check.
+func (env *Env) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	env.writeReport(w, env.Readiness.Run(r.Context()))
+}
+
+// writeReport writes a health report, with a 503 status if any check failed.
+func (env *Env) writeReport(w http.ResponseWriter, report *health.Report) {
+	w.Header().Set("Content-Type", "application/json")
+	if !report.OK() {
+		env.Logger.Warn("Health check failed", zap.Any("checks", report.Checks))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// writeError writes an error response with a message, followed by the error
+// that caused it if there is one, and logs it. Client errors are expected and
+// only logged at the info level.
+func writeError(w http.ResponseWriter, logger *zap.Logger, status int, errMsg string, err error) {
+	if status >= http.StatusInternalServerError {
+		logger.Error(errMsg, zap.Int("status", status), zap.Error(err))
+	} else {
+		logger.Info(errMsg, zap.Int("status", status), zap.Error(err))
+	}
+
+	if err != nil {
+		errMsg += ":" + err.Error()
+	}
+	http.Error(w, errMsg, status)
 }
 
 // GetPatchesHandler gets patches from the database with filtering.
 func (env *Env) GetPatchesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := env.Logger
 	if err := r.ParseForm(); err != nil {
-		errMsg := "Error reading request:" + err.Error()
-		log.Print(errMsg)
-		http.Error(w, errMsg, http.StatusBadRequest)
+		writeError(w, logger, http.StatusBadRequest, "Error reading request", err)
 		return
 	}
 
 	filter := new(models.Filter)
 	if err := schema.NewDecoder().Decode(filter, r.Form); err != nil {
-		errMsg := "Error reading request:" + err.Error()
-		log.Print(errMsg)
-		http.Error(w, errMsg, http.StatusBadRequest)
+		writeError(w, logger, http.StatusBadRequest, "Error reading request", err)
 		return
 	}
 
+	if filter.Conversation != 0 {
+		logger = logger.With(zap.Int64("conversation_id", filter.Conversation))
+	}
+
 	// Get patches with filter
 	patches, err := env.DB.GetPatches(filter)
 
 	if err != nil {
-		errMsg := "Error getting rows:" + err.Error()
-		log.Print(errMsg)
-		http.Error(w, errMsg, http.StatusInternalServerError)
+		writeError(w, logger, http.StatusInternalServerError, "Error getting rows", err)
 		return
 	} else if patches == nil {
-		errMsg := "Error getting rows"
-		log.Print(errMsg)
-		http.Error(w, errMsg, http.StatusInternalServerError)
+		writeError(w, logger, http.StatusInternalServerError, "Error getting rows", nil)
 		return
 	}
 
 	// Return responses
-	log.Printf("%d patches returned", len(patches))
+	logger.Info("Patches returned", zap.Int("patches", len(patches)))
 	json.NewEncoder(w).Encode(patches)
 }
 
+// GetActivityHandler gets the per-user contributions to a conversation,
+// grouped into buckets of time, with filtering.
+func (env *Env) GetActivityHandler(w http.ResponseWriter, r *http.Request) {
+	logger := env.Logger
+	vars := mux.Vars(r)
+	conversationID, err := strconv.ParseInt(vars["conversation_id"], 10, 64)
+	if err != nil || conversationID <= 0 {
+		writeError(w, logger, http.StatusBadRequest, "Invalid conversation ID", err)
+		return
+	}
+	logger = logger.With(zap.Int64("conversation_id", conversationID))
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, logger, http.StatusBadRequest, "Error reading request", err)
+		return
+	}
+
+	bucket := time.Hour
+	if bucketParam := r.Form.Get("bucket"); bucketParam != "" {
+		bucket, err = time.ParseDuration(bucketParam)
+		if err != nil || bucket < time.Second {
+			writeError(w, logger, http.StatusBadRequest, "Invalid bucket duration", nil)
+			return
+		}
+	}
+	r.Form.Del("bucket")
+
+	filter := new(models.Filter)
+	if err := schema.NewDecoder().Decode(filter, r.Form); err != nil {
+		writeError(w, logger, http.StatusBadRequest, "Error reading request", err)
+		return
+	}
+	filter.Conversation = conversationID
+
+	activities, err := env.DB.GetActivity(filter, bucket)
+	if err != nil {
+		writeError(w, logger, http.StatusInternalServerError, "Error getting activity", err)
+		return
+	} else if activities == nil {
+		writeError(w, logger, http.StatusInternalServerError, "Error getting activity", nil)
+		return
+	}
+
+	logger.Info("Activity returned", zap.Int("users", len(activities)))
+	json.NewEncoder(w).Encode(struct {
+		Users []models.Activity `json:"users"`
+	}{activities})
+}
+
+// GetMessagesHandler gets the persisted messages of a conversation, such as
+// chat messages, matching the filters in the query string.
+func (env *Env) GetMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	logger := env.Logger
+	vars := mux.Vars(r)
+	conversationID, err := strconv.ParseInt(vars["conversation_id"], 10, 64)
+	if err != nil {
+		writeError(w, logger, http.StatusBadRequest, "Invalid conversation ID", err)
+		return
+	}
+	logger = logger.With(zap.Int64("conversation_id", conversationID))
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, logger, http.StatusBadRequest, "Error reading request", err)
+		return
+	}
+
+	filter := new(models.Filter)
+	if err := schema.NewDecoder().Decode(filter, r.Form); err != nil {
+		writeError(w, logger, http.StatusBadRequest, "Error reading request", err)
+		return
+	}
+	filter.Conversation = conversationID
+
+	messages, err := env.DB.GetMessages(filter)
+	if err != nil {
+		writeError(w, logger, http.StatusInternalServerError, "Error getting messages", err)
+		return
+	}
+
+	logger.Info("Messages returned", zap.Int("messages", len(messages)))
+	json.NewEncoder(w).Encode(struct {
+		Messages []models.Message `json:"messages"`
+	}{messages})
+}
+
+// GetCommentsHandler gets the comments of a conversation.
+func (env *Env) GetCommentsHandler(w http.ResponseWriter, r *http.Request) {
+	logger := env.Logger
+	vars := mux.Vars(r)
+	conversationID, err := strconv.ParseInt(vars["conversation_id"], 10, 64)
+	if err != nil {
+		writeError(w, logger, http.StatusBadRequest, "Invalid conversation ID", err)
+		return
+	}
+	logger = logger.With(zap.Int64("conversation_id", conversationID))
+
+	comments, version, err := env.WSBroker.Comments(conversationID)
+	if err != nil {
+		writeError(w, logger, http.StatusInternalServerError, "Error getting comments", err)
+		return
+	}
+
+	logger.Info("Comments returned", zap.Int("comments", len(comments)), zap.Int("version", version))
+	json.NewEncoder(w).Encode(struct {
+		Comments []protocol.Comment `json:"comments"`
+		Version  int                `json:"version"`
+	}{comments, version})
+}
+
+// CreateCommentHandler adds a comment or a reply to a conversation.
+func (env *Env) CreateCommentHandler(w http.ResponseWriter, r *http.Request) {
+	env.changeComment(w, r, protocol.CommentCreate)
+}
+
+// UpdateCommentHandler edits, moves, resolves or reopens a comment.
+func (env *Env) UpdateCommentHandler(w http.ResponseWriter, r *http.Request) {
+	env.changeComment(w, r, protocol.CommentUpdate)
+}
+
+// DeleteCommentHandler deletes a comment along with its replies.
+func (env *Env) DeleteCommentHandler(w http.ResponseWriter, r *http.Request) {
+	env.changeComment(w, r, protocol.CommentDelete)
+}
+
+// changeComment makes a change to a comment of a conversation on behalf of the
+// user in the User-ID header. The comment is read from the request body, except
+// for deletions, and its ID from the path.
+func (env *Env) changeComment(w http.ResponseWriter, r *http.Request, action string) {
+	logger := env.Logger
+	vars := mux.Vars(r)
+	conversationID, err := strconv.ParseInt(vars["conversation_id"], 10, 64)
+	if err != nil {
+		writeError(w, logger, http.StatusBadRequest, "Invalid conversation ID", err)
+		return
+	}
+	logger = logger.With(zap.Int64("conversation_id", conversationID))
+
+	userID, err := strconv.ParseInt(r.Header.Get("User-ID"), 10, 64)
+	if err != nil {
+		writeError(w, logger, http.StatusBadRequest, "Invalid user ID", err)
+		return
+	}
+	logger = logger.With(zap.Int64("user_id", userID))
+
+	req := struct {
+		protocol.Comment
+		Version *int `json:"version"`
+	}{}
+	if action != protocol.CommentDelete {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, logger, http.StatusBadRequest, "Error reading request", err)
+			return
+		}
+	}
+
+	if commentID, ok := vars["comment_id"]; ok {
+		req.ID, err = strconv.ParseInt(commentID, 10, 64)
+		if err != nil {
+			writeError(w, logger, http.StatusBadRequest, "Invalid comment ID", err)
+			return
+		}
+		logger = logger.With(zap.Int64("comment_id", req.ID))
+	}
+
+	comment, version, err := env.WSBroker.Comment(userID, conversationID, action, req.Comment, req.Version)
+	if err == websockets.ErrInvalidComment {
+		writeError(w, logger, http.StatusBadRequest, "Error reading request", err)
+		return
+	} else if err == websockets.ErrCommentNotFound {
+		writeError(w, logger, http.StatusNotFound, "Error changing comment", err)
+		return
+	} else if err == websockets.ErrForbidden {
+		writeError(w, logger, http.StatusForbidden, "Error changing comment", err)
+		return
+	} else if err != nil {
+		writeError(w, logger, http.StatusInternalServerError, "Error changing comment", err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(struct {
+		Comment protocol.Comment `json:"comment"`
+		Version int              `json:"version"`
+	}{comment, version})
+}
+
+// getHistory gets the nearest snapshot of a conversation prior to the version
+// or point in time in a request's query string, along with the patches that
+// were made after the snapshot. If anything fails, an error response is
+// written and false is returned.
+func (env *Env) getHistory(w http.ResponseWriter, r *http.Request) (*models.Snapshot, []models.Patch, bool) {
+	logger := env.Logger
+	vars := mux.Vars(r)
+	conversationID, err := strconv.ParseInt(vars["conversation_id"], 10, 64)
+	if err != nil {
+		writeError(w, logger, http.StatusBadRequest, "Invalid conversation ID", err)
+		return nil, nil, false
+	}
+	logger = logger.With(zap.Int64("conversation_id", conversationID))
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, logger, http.StatusBadRequest, "Error reading request", err)
+		return nil, nil, false
+	}
+
+	query := struct {
+		Version *int      `schema:"version"`
+		At      time.Time `schema:"at"`
+	}{}
+	if err := schema.NewDecoder().Decode(&query, r.Form); err != nil {
+		writeError(w, logger, http.StatusBadRequest, "Error reading request", err)
+		return nil, nil, false
+	}
+
+	filter := &models.Filter{
+		Conversation: conversationID,
+		EndTime:      query.At,
+		EndVersion:   query.Version,
+	}
+	snapshot, err := env.DB.GetSnapshot(filter)
+	if err != nil {
+		writeError(w, logger, http.StatusInternalServerError, "Error getting snapshot", err)
+		return nil, nil, false
+	} else if snapshot == nil {
+		writeError(w, logger, http.StatusNotFound, "No content found for conversation", nil)
+		return nil, nil, false
+	}
+
+	// Get the patches that were made after the snapshot
+	startVersion := snapshot.Version + 1
+	filter.StartVersion = &startVersion
+	patches, err := env.DB.GetPatches(filter)
+	if err != nil {
+		writeError(w, logger, http.StatusInternalServerError, "Error getting rows", err)
+		return nil, nil, false
+	}
+
+	return snapshot, patches, true
+}
+
+// GetContentHandler reconstructs the content of a conversation at a version
+// or point in time by replaying patches from the nearest prior snapshot.
+func (env *Env) GetContentHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, patches, ok := env.getHistory(w, r)
+	if !ok {
+		return
+	}
+	logger := env.Logger.With(zap.Int64("conversation_id", snapshot.ConvoID))
+
+	content, version, err := document.Replay(snapshot, patches)
+	if err != nil {
+		writeError(w, logger, http.StatusInternalServerError, "Error reconstructing content", err)
+		return
+	}
+
+	logger.Info("Content reconstructed", zap.Int("version", version))
+	json.NewEncoder(w).Encode(struct {
+		Content string `json:"content"`
+		Version int    `json:"version"`
+	}{content, version})
+}
+
+// GetBlameHandler attributes each range of the content of a conversation at a
+// version or point in time to the user and version that last changed it.
+func (env *Env) GetBlameHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, patches, ok := env.getHistory(w, r)
+	if !ok {
+		return
+	}
+	logger := env.Logger.With(zap.Int64("conversation_id", snapshot.ConvoID))
+
+	spans, version, err := document.Blame(snapshot, patches)
+	if err != nil {
+		writeError(w, logger, http.StatusInternalServerError, "Error reconstructing content", err)
+		return
+	}
+
+	logger.Info("Content attributed", zap.Int("ranges", len(spans)), zap.Int("version", version))
+	json.NewEncoder(w).Encode(struct {
+		Ranges  document.Spans `json:"ranges"`
+		Version int            `json:"version"`
+	}{spans, version})
+}
+
+// RevertHandler reverts a range of patches in a conversation as a new edit
+// made by the requesting user, who must be an admin of the conversation.
+func (env *Env) RevertHandler(w http.ResponseWriter, r *http.Request) {
+	logger := env.Logger
+	vars := mux.Vars(r)
+	conversationID, err := strconv.ParseInt(vars["conversation_id"], 10, 64)
+	if err != nil {
+		writeError(w, logger, http.StatusBadRequest, "Invalid conversation ID", err)
+		return
+	}
+	logger = logger.With(zap.Int64("conversation_id", conversationID))
+
+	userID, err := strconv.ParseInt(r.Header.Get("User-ID"), 10, 64)
+	if err != nil {
+		writeError(w, logger, http.StatusBadRequest, "Invalid user ID", err)
+		return
+	}
+	logger = logger.With(zap.Int64("user_id", userID))
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, logger, http.StatusBadRequest, "Error reading request", err)
+		return
+	}
+
+	filter := new(models.Filter)
+	if err := schema.NewDecoder().Decode(filter, r.Form); err != nil {
+		writeError(w, logger, http.StatusBadRequest, "Error reading request", err)
+		return
+	}
+
+	version, reverted, err := env.WSBroker.Revert(userID, conversationID, filter)
+	if err == websockets.ErrInvalidRevert {
+		writeError(w, logger, http.StatusBadRequest, "Error reading request", err)
+		return
+	} else if err == websockets.ErrForbidden {
+		writeError(w, logger, http.StatusForbidden, "Error reverting patches", err)
+		return
+	} else if err != nil {
+		writeError(w, logger, http.StatusInternalServerError, "Error reverting patches", err)
+		return
+	}
+
+	logger.Info("Patches reverted", zap.Int("reverted", reverted), zap.Int("version", version))
+	json.NewEncoder(w).Encode(struct {
+		Version  int `json:"version"`
+		Reverted int `json:"reverted"`
+	}{version, reverted})
+}
+
 // ConnectHandler establishes a WebSocket connection with the client.
 func (env *Env) ConnectHandler(w http.ResponseWriter, r *http.Request) {
+	logger := env.Logger
 	vars := mux.Vars(r)
 	conversationID, err := strconv.ParseInt(vars["conversation_id"], 10, 64)
 	if err != nil {
-		errMsg := "Invalid conversation ID"
-		log.Println(errMsg + ": " + err.Error())
-		http.Error(w, errMsg, http.StatusBadRequest)
+		writeError(w, logger, http.StatusBadRequest, "Invalid conversation ID", err)
 		return
 	}
+	logger = logger.With(zap.Int64("conversation_id", conversationID))
 
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Print("Upgrade to WebSocket failed: ", err)
+		logger.Info("Upgrade to WebSocket failed", zap.Error(err))
+		return
+	}
+
+	go env.WSBroker.StartClient(conversationID, c, offersCompression(r))
+}
+
+// offersCompression reports whether the client offered permessage-deflate,
+// in which case the upgrader negotiated it for the connection.
+func offersCompression(r *http.Request) bool {
+	if !upgrader.EnableCompression {
+		return false
+	}
+	for _, header := range r.Header["Sec-Websocket-Extensions"] {
+		for _, extension := range strings.Split(header, ",") {
+			name := strings.TrimSpace(strings.SplitN(extension, ";", 2)[0])
+			if strings.EqualFold(name, "permessage-deflate") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authorizeAdmin checks that a request carries the admin token. If it doesn't,
+// an error response is written and false is returned.
+func (env *Env) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		writeError(w, env.Logger, http.StatusNotFound, "Admin API is disabled", nil)
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		writeError(w, env.Logger, http.StatusUnauthorized, "Invalid admin token", nil)
+		return false
+	}
+
+	return true
+}
+
+// ListConversationsHandler lists the conversations that are active in this
+// process.
+func (env *Env) ListConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	if !env.authorizeAdmin(w, r) {
+		return
+	}
+
+	conversations := env.WSBroker.ActiveConversations()
+	env.Logger.Info("Active conversations returned", zap.Int("conversations", len(conversations)))
+	json.NewEncoder(w).Encode(struct {
+		Conversations []websockets.ConversationSummary `json:"conversations"`
+	}{conversations})
+}
+
+// InspectConversationHandler describes the internal state of an active
+// conversation.
+func (env *Env) InspectConversationHandler(w http.ResponseWriter, r *http.Request) {
+	logger := env.Logger
+	if !env.authorizeAdmin(w, r) {
+		return
+	}
+
+	vars := mux.Vars(r)
+	conversationID, err := strconv.ParseInt(vars["conversation_id"], 10, 64)
+	if err != nil {
+		writeError(w, logger, http.StatusBadRequest, "Invalid conversation ID", err)
+		return
+	}
+	logger = logger.With(zap.Int64("conversation_id", conversationID))
+
+	ctx, cancel := context.WithTimeout(r.Context(), inspectTimeout)
+	defer cancel()
+	state, err := env.WSBroker.Inspect(ctx, conversationID)
+	if err == websockets.ErrConversationNotActive {
+		writeError(w, logger, http.StatusNotFound, "Error inspecting conversation", err)
+		return
+	} else if err != nil {
+		writeError(w, logger, http.StatusServiceUnavailable, "Error inspecting conversation", err)
 		return
 	}
 
-	go env.WSBroker.StartClient(conversationID, c)
+	json.NewEncoder(w).Encode(state)
 }
@@ -0,0 +1,140 @@
+// Package health runs the checks that orchestrators probe to decide whether
+// the service is alive and ready to receive traffic.
+package health
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Statuses of checks and of reports.
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// drainingCheck is the name of the check that fails once the service starts
+// shutting down.
+const drainingCheck = "draining"
+
+// ErrDraining is returned by the draining check once the service is shutting
+// down.
+var ErrDraining = errors.New("Service is shutting down")
+
+// Check reports whether a part of the service or one of its dependencies is
+// healthy. It must return once ctx is done.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of a single check.
+type Result struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is the outcome of every check of a Checker. Its status is only ok if
+// every check passed.
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// OK reports whether every check passed.
+func (r *Report) OK() bool {
+	return r.Status == StatusOK
+}
+
+// Checker runs a set of named checks concurrently, each with its own timeout.
+type Checker struct {
+	timeout  time.Duration
+	names    []string
+	checks   map[string]Check
+	draining int32
+}
+
+// NewChecker creates a Checker whose checks fail if they take longer than
+// timeout.
+func NewChecker(timeout time.Duration) *Checker {
+	return &Checker{
+		timeout: timeout,
+		checks:  make(map[string]Check),
+	}
+}
+
+// Add registers a check under a name. Checks must be added before the Checker
+// is run.
+func (h *Checker) Add(name string, check Check) {
+	if _, ok := h.checks[name]; !ok {
+		h.names = append(h.names, name)
+	}
+	h.checks[name] = check
+}
+
+// Drain makes every later report fail, so that the service stops receiving
+// new traffic while it shuts down.
+func (h *Checker) Drain() {
+	atomic.StoreInt32(&h.draining, 1)
+}
+
+// Draining reports whether Drain has been called.
+func (h *Checker) Draining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+// Run runs every check and reports their outcomes. A check that doesn't
+// return within the timeout fails, although it is left running in the
+// background until it notices that its context is done.
+func (h *Checker) Run(ctx context.Context) *Report {
+	report := &Report{Status: StatusOK, Checks: make(map[string]Result)}
+	if h.Draining() {
+		report.Status = StatusFail
+		report.Checks[drainingCheck] = Result{Status: StatusFail, Error: ErrDraining.Error(), Duration: "0s"}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, name := range h.names {
+		wg.Add(1)
+		go func(name string, check Check) {
+			defer wg.Done()
+			result := h.run(ctx, check)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = result
+			if result.Status != StatusOK {
+				report.Status = StatusFail
+			}
+		}(name, h.checks[name])
+	}
+	wg.Wait()
+
+	return report
+}
+
+// run runs a single check, failing it if it doesn't return within the timeout.
+func (h *Checker) run(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() { errc <- check(ctx) }()
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := Result{Status: StatusOK, Duration: time.Since(start).String()}
+	if err != nil {
+		result.Status = StatusFail
+		result.Error = err.Error()
+	}
+	return result
+}
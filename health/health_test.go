@@ -0,0 +1,49 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestChecker(t *testing.T) {
+	h := NewChecker(50 * time.Millisecond)
+	h.Add("ok", func(ctx context.Context) error { return nil })
+	if report := h.Run(context.Background()); !report.OK() || report.Checks["ok"].Status != StatusOK {
+		t.Fatalf("Expected report to pass, got %+v", report)
+	}
+
+	h.Add("failing", func(ctx context.Context) error { return errors.New("unreachable") })
+	h.Add("slow", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+	report := h.Run(context.Background())
+	if report.OK() {
+		t.Fatalf("Expected report to fail, got %+v", report)
+	}
+	if result := report.Checks["ok"]; result.Status != StatusOK {
+		t.Errorf("Expected passing check to pass, got %+v", result)
+	}
+	if result := report.Checks["failing"]; result.Status != StatusFail || result.Error != "unreachable" {
+		t.Errorf("Expected failing check to fail with its error, got %+v", result)
+	}
+	if result := report.Checks["slow"]; result.Status != StatusFail || result.Error != context.DeadlineExceeded.Error() {
+		t.Errorf("Expected slow check to time out, got %+v", result)
+	}
+}
+
+func TestCheckerDrain(t *testing.T) {
+	h := NewChecker(time.Second)
+	h.Add("ok", func(ctx context.Context) error { return nil })
+	h.Drain()
+
+	report := h.Run(context.Background())
+	if report.OK() {
+		t.Fatalf("Expected draining report to fail, got %+v", report)
+	}
+	if result := report.Checks[drainingCheck]; result.Status != StatusFail || result.Error != ErrDraining.Error() {
+		t.Errorf("Expected draining check to fail, got %+v", result)
+	}
+}
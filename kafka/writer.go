@@ -3,48 +3,135 @@ package kafka
 import (
 	"context"
 	"encoding/json"
+	"patches/metrics"
 	"patches/protocol"
+	"patches/tracing"
 	"strconv"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	segkafka "github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.uber.org/zap"
 )
 
 // Publisher defines the publishing methods for a messaging system.
 type Publisher interface {
-	PublishUpdate(msg []byte) error
+	PublishUpdate(ctx context.Context, msg protocol.Message, conversationID int64) error
+}
+
+// tracer traces the publishing of messages.
+var tracer = tracing.Tracer("patches/kafka")
+
+// kafkaHeaders carries trace context in the headers of a Kafka message.
+type kafkaHeaders struct {
+	headers *[]segkafka.Header
+}
+
+// Get returns the value of the first header with a key.
+func (h kafkaHeaders) Get(key string) string {
+	for _, header := range *h.headers {
+		if header.Key == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+// Set adds a header, replacing any header with the same key.
+func (h kafkaHeaders) Set(key, value string) {
+	for i, header := range *h.headers {
+		if header.Key == key {
+			(*h.headers)[i].Value = []byte(value)
+			return
+		}
+	}
+	*h.headers = append(*h.headers, segkafka.Header{Key: key, Value: []byte(value)})
 }
 
 // Writer represents an entity for writing to one or more Kafka topics.
 type Writer struct {
 	patchesWriter *segkafka.Writer
+	location      string
+	topic         string
+	logger        *zap.Logger
 }
 
-// NewWriter initializes a new Writer.
-func NewWriter(location, topic string) *Writer {
+// NewWriter initializes a new Writer. Errors of the underlying Kafka client
+// and failed publishes are logged to a logger.
+func NewWriter(location, topic string, logger *zap.Logger) *Writer {
+	logger = logger.With(zap.String("topic", topic))
+
+	// The error level is always valid for standard loggers
+	errorLogger, _ := zap.NewStdLogAt(logger, zap.ErrorLevel)
+
 	return &Writer{
 		patchesWriter: segkafka.NewWriter(segkafka.WriterConfig{
 			Brokers:      []string{location},
 			Topic:        topic,
 			Balancer:     &segkafka.LeastBytes{},
 			BatchTimeout: 10 * time.Millisecond,
+			ErrorLogger:  errorLogger,
 		}),
+		location: location,
+		topic:    topic,
+		logger:   logger,
 	}
 }
 
 // PublishUpdate publishes a message to a Kafka topic using a conversationID as
 // the key and a struct representation of a WebSocket Update message (msg) as
-// the value.
-func (k *Writer) PublishUpdate(msg protocol.Message, conversationID int64) error {
+// the value. The trace context of ctx is added to the headers of the message so
+// that consumers can continue the trace.
+func (k *Writer) PublishUpdate(ctx context.Context, msg protocol.Message, conversationID int64) (err error) {
+	ctx, span := tracer.Start(ctx, "kafka.publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(kv.Int64("conversation_id", conversationID)),
+	)
+	defer func() { tracing.End(ctx, span, err) }()
+
 	pubBytes, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
 
-	return k.patchesWriter.WriteMessages(context.Background(),
+	var headers []segkafka.Header
+	tracing.Inject(ctx, kafkaHeaders{&headers})
+
+	timer := prometheus.NewTimer(metrics.KafkaPublishDuration)
+	err = k.patchesWriter.WriteMessages(ctx,
 		segkafka.Message{
-			Key:   []byte(strconv.FormatInt(conversationID, 10)),
-			Value: pubBytes,
+			Key:     []byte(strconv.FormatInt(conversationID, 10)),
+			Value:   pubBytes,
+			Headers: headers,
 		},
 	)
+	timer.ObserveDuration()
+	if err != nil {
+		metrics.KafkaPublishErrors.Inc()
+		fields := []zap.Field{zap.Error(err), zap.Int64("conversation_id", conversationID)}
+		if msg.Data.Version != nil {
+			fields = append(fields, zap.Int("version", *msg.Data.Version))
+		}
+		k.logger.Error("Failed to publish update", fields...)
+	}
+
+	return err
+}
+
+// Check checks that the Kafka broker can be reached and knows about the topic
+// that updates are published to.
+func (k *Writer) Check(ctx context.Context) error {
+	conn, err := segkafka.DialContext(ctx, "tcp", k.location)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	_, err = conn.ReadPartitions(k.topic)
+	return err
 }
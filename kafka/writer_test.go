@@ -0,0 +1,34 @@
+package kafka
+
+import (
+	"context"
+	"patches/tracing"
+	"patches/tracing/tracingtest"
+	"strings"
+	"testing"
+
+	segkafka "github.com/segmentio/kafka-go"
+)
+
+func TestKafkaHeaders(t *testing.T) {
+	recorder := tracingtest.Install()
+
+	ctx, span := tracing.Tracer("patches/kafka/test").Start(context.Background(), "publish")
+	headers := []segkafka.Header{{Key: "traceparent", Value: []byte("stale")}}
+	tracing.Inject(ctx, kafkaHeaders{&headers})
+	span.End()
+
+	// The trace context of the span replaces the header that was there
+	spans := recorder.Spans("publish")
+	if len(spans) != 1 {
+		t.Fatalf("Expected the span to be recorded, got %d spans", len(spans))
+	}
+	parent := spans[0].SpanContext
+	traceparent := kafkaHeaders{&headers}.Get("traceparent")
+	if len(headers) != 1 {
+		t.Fatalf("Expected a single traceparent header, got %+v", headers)
+	}
+	if want := "00-" + parent.TraceID.String() + "-" + parent.SpanID.String() + "-"; !strings.HasPrefix(traceparent, want) {
+		t.Fatalf("Expected traceparent %s for the span, got %q", want, traceparent)
+	}
+}
@@ -0,0 +1,32 @@
+// Package logging configures the structured logger of the service.
+package logging
+
+import (
+	"os"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// New creates a logger that writes to stderr. PATCHES_LOG_FORMAT selects the
+// "json" (default) or human readable "console" encoding, and PATCHES_LOG_LEVEL
+// the lowest level that is logged, which defaults to "info". Every second, only
+// the first 100 entries with the same message and level are logged, and every
+// 100th entry after that, so that hot paths don't flood the logs.
+func New() (*zap.Logger, error) {
+	config := zap.NewProductionConfig()
+
+	if format := os.Getenv("PATCHES_LOG_FORMAT"); format == "console" {
+		config.Encoding = "console"
+		config.EncoderConfig = zap.NewDevelopmentEncoderConfig()
+	}
+	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	if level := os.Getenv("PATCHES_LOG_LEVEL"); level != "" {
+		if err := config.Level.UnmarshalText([]byte(level)); err != nil {
+			return nil, err
+		}
+	}
+
+	return config.Build()
+}
@@ -0,0 +1,164 @@
+// Package metrics defines the Prometheus metrics of the service. Labels only
+// ever take a fixed set of values, so conversations and users are never used
+// as labels.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Outcomes of WebSocket handshakes.
+const (
+	HandshakeOK             = "ok"
+	HandshakeTimeout        = "timeout"
+	HandshakeReadFailed     = "read_failed"
+	HandshakeInvalid        = "invalid_handshake"
+	HandshakeInvalidToken   = "invalid_token"
+	HandshakeNotMember      = "not_member"
+	HandshakeRegisterFailed = "register_failed"
+)
+
+// Actions taken on clients that fall too far behind on syncing.
+const (
+	LaggingResynced     = "resynced"
+	LaggingDisconnected = "disconnected"
+)
+
+// Reasons that conversations kept warm without clients are evicted for.
+const (
+	EvictionExpired  = "expired"
+	EvictionCapacity = "capacity"
+)
+
+// Kinds of messages received from clients. Messages that can't be parsed or
+// have an unknown type or subtype are invalid.
+const (
+	MessageEdit      = "edit"
+	MessageCursor    = "cursor"
+	MessageUndo      = "undo"
+	MessageRedo      = "redo"
+	MessageSync      = "sync"
+	MessageRevert    = "revert"
+	MessageEphemeral = "ephemeral"
+	MessageComment   = "comment"
+	MessageInvalid   = "invalid"
+)
+
+var (
+	// ActiveConversations is the number of conversations that are running.
+	ActiveConversations = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "patches_active_conversations",
+		Help: "Number of conversations that are running.",
+	})
+
+	// WarmConversations is the number of running conversations without
+	// clients that are kept warm until their grace period elapses.
+	WarmConversations = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "patches_warm_conversations",
+		Help: "Number of running conversations without clients that are kept warm.",
+	})
+
+	// Evictions counts conversations kept warm without clients that were shut
+	// down by reason.
+	Evictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "patches_evictions_total",
+		Help: "Conversations kept warm without clients that were shut down by reason.",
+	}, []string{"reason"})
+
+	// ConnectedClients is the number of clients that are connected to a
+	// conversation.
+	ConnectedClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "patches_connected_clients",
+		Help: "Number of clients that are connected to a conversation.",
+	})
+
+	// Handshakes counts WebSocket handshakes by outcome.
+	Handshakes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "patches_handshakes_total",
+		Help: "WebSocket handshakes by outcome.",
+	}, []string{"outcome"})
+
+	// Messages counts the messages received from clients by kind.
+	Messages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "patches_messages_total",
+		Help: "Messages received from clients by kind.",
+	}, []string{"kind"})
+
+	// EditDuration measures how long it takes to apply and broadcast an edit.
+	EditDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "patches_edit_duration_seconds",
+		Help:    "Time taken to apply, broadcast and commit an edit.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+	})
+
+	// InvalidPatches counts edits whose patches couldn't be applied.
+	InvalidPatches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "patches_invalid_patches_total",
+		Help: "Edits whose patches could not be applied to the document.",
+	})
+
+	// Divergences counts Syncs from clients whose document didn't match the
+	// conversation's document at the synced version.
+	Divergences = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "patches_divergences_total",
+		Help: "Syncs from clients whose document diverged from the server's.",
+	})
+
+	// Checkpoints measures the number of checkpoints that a conversation keeps
+	// after each edit.
+	Checkpoints = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "patches_conversation_checkpoints",
+		Help:    "Number of checkpoints kept by a conversation after each edit.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	})
+
+	// RetainedCheckpoints is the number of checkpoints that are kept by all
+	// conversations.
+	RetainedCheckpoints = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "patches_retained_checkpoints",
+		Help: "Number of checkpoints kept by all conversations.",
+	})
+
+	// CheckpointWindow measures the age of the oldest checkpoint of a
+	// conversation whenever its checkpoints are collected.
+	CheckpointWindow = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "patches_checkpoint_window_seconds",
+		Help:    "Age of the oldest checkpoint kept by a conversation.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+
+	// LaggingClients counts clients that fell too far behind on syncing by
+	// what was done about them.
+	LaggingClients = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "patches_lagging_clients_total",
+		Help: "Clients that fell too far behind on syncing by action.",
+	}, []string{"action"})
+
+	// CompressionSavedBytes counts the bytes that compressing messages sent to
+	// clients saved, as estimated from a sample of the messages.
+	CompressionSavedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "patches_compression_saved_bytes_total",
+		Help: "Estimated bytes saved by compressing messages sent to clients.",
+	})
+
+	// KafkaPublishDuration measures how long it takes to publish an update to
+	// Kafka.
+	KafkaPublishDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "patches_kafka_publish_duration_seconds",
+		Help: "Time taken to publish an update to Kafka.",
+	})
+
+	// KafkaPublishErrors counts updates that failed to be published to Kafka.
+	KafkaPublishErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "patches_kafka_publish_errors_total",
+		Help: "Updates that failed to be published to Kafka.",
+	})
+
+	// DBQueryDuration measures database queries by the Datastore method that
+	// made them.
+	DBQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "patches_db_query_duration_seconds",
+		Help: "Time taken by database queries by Datastore method.",
+	}, []string{"query"})
+)
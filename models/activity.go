@@ -0,0 +1,105 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Activity represents the contributions of a user to a conversation.
+type Activity struct {
+	UserID        int64            `json:"user_id"`
+	Edits         int64            `json:"edits"`
+	Inserted      int64            `json:"inserted"`
+	Deleted       int64            `json:"deleted"`
+	ActiveSeconds int64            `json:"active_seconds"`
+	Buckets       []ActivityBucket `json:"buckets"`
+}
+
+// ActivityBucket represents the contributions of a user to a conversation
+// within a bucket of time.
+type ActivityBucket struct {
+	Start    time.Time `json:"start"`
+	Edits    int64     `json:"edits"`
+	Inserted int64     `json:"inserted"`
+	Deleted  int64     `json:"deleted"`
+}
+
+// GetActivity gets the per-user contributions to a conversation with filtering,
+// grouped into buckets of time. The TimescaleDB time_bucket function is used
+// when the extension is available.
+func (db *DB) GetActivity(filter *Filter, bucket time.Duration) ([]Activity, error) {
+	defer timeQuery("GetActivity")()
+
+	if filter.Conversation == 0 {
+		db.logger.Error("Error with conversation id")
+		return nil, nil
+	}
+
+	bucketExpr := "to_timestamp(floor(extract(epoch FROM time)::float8 / $1::float8) * $1::float8)"
+	if db.timescale {
+		bucketExpr = "time_bucket(make_interval(secs => $1::float8), time)"
+	}
+
+	args := []interface{}{bucket.Seconds(), filter.Conversation}
+	filterString := new(strings.Builder)
+	fmt.Fprintf(filterString, "convo_id = $2 AND type = '%s'", PatchTypeEdit)
+	if len(filter.User) >= 1 {
+		fmt.Fprintf(filterString, " AND (")
+		for i, userID := range filter.User {
+			if i > 0 {
+				fmt.Fprintf(filterString, " OR ")
+			}
+			args = append(args, userID)
+			fmt.Fprintf(filterString, "user_id = $%d", len(args))
+		}
+		fmt.Fprintf(filterString, ")")
+	}
+	if !filter.EndTime.IsZero() {
+		args = append(args, filter.EndTime)
+		fmt.Fprintf(filterString, " AND time <= $%d", len(args))
+	}
+	if !filter.StartTime.IsZero() {
+		args = append(args, filter.StartTime)
+		fmt.Fprintf(filterString, " AND time >= $%d", len(args))
+	}
+
+	queryString := new(strings.Builder)
+	fmt.Fprintf(
+		queryString,
+		`SELECT COALESCE(user_id, 0) AS uid, %s AS bucket, COUNT(*), COALESCE(SUM(inserted), 0), COALESCE(SUM(deleted), 0)
+		FROM patches WHERE %s GROUP BY uid, bucket ORDER BY uid, bucket`,
+		bucketExpr,
+		filterString,
+	)
+	rows, err := db.Query(queryString.String(), args...)
+	if err != nil {
+		db.logger.Error("Error getting activity", zap.Error(err), zap.Int64("conversation_id", filter.Conversation))
+		return nil, err
+	}
+	defer rows.Close()
+
+	activities := make([]Activity, 0)
+	for rows.Next() {
+		var userID int64
+		b := ActivityBucket{}
+		if err := rows.Scan(&userID, &b.Start, &b.Edits, &b.Inserted, &b.Deleted); err != nil {
+			db.logger.Error("Error reading activity", zap.Error(err), zap.Int64("conversation_id", filter.Conversation))
+			return nil, err
+		}
+
+		if len(activities) == 0 || activities[len(activities)-1].UserID != userID {
+			activities = append(activities, Activity{UserID: userID, Buckets: []ActivityBucket{}})
+		}
+		a := &activities[len(activities)-1]
+		a.Edits += b.Edits
+		a.Inserted += b.Inserted
+		a.Deleted += b.Deleted
+		a.ActiveSeconds += int64(bucket.Seconds())
+		a.Buckets = append(a.Buckets, b)
+	}
+
+	return activities, rows.Err()
+}
@@ -0,0 +1,141 @@
+package models
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Comment represents a comment that is anchored to a range of a conversation's
+// content, or a reply to one. The anchor of a comment is only meaningful at its
+// version, since it is shifted by every edit to the conversation.
+type Comment struct {
+	ID        int64     `json:"id"`
+	ConvoID   int64     `json:"convo_id"`
+	UserID    int64     `json:"user_id"`
+	ParentID  *int64    `json:"parent_id,omitempty"`
+	Start     int       `json:"start"`
+	End       int       `json:"end"`
+	Version   int       `json:"version"`
+	Body      string    `json:"body"`
+	Resolved  bool      `json:"resolved"`
+	Orphaned  bool      `json:"orphaned"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// GetComments gets every comment of a conversation from the database, oldest
+// first.
+func (db *DB) GetComments(convoID int64) ([]Comment, error) {
+	defer timeQuery("GetComments")()
+
+	rows, err := db.Query(
+		`SELECT id, convo_id, user_id, parent_id, anchor_start, anchor_end, version, body, resolved, orphaned, created_at, updated_at
+		FROM comments WHERE convo_id = $1 ORDER BY id`,
+		convoID,
+	)
+	if err != nil {
+		db.logger.Error("Error getting comments", zap.Error(err), zap.Int64("conversation_id", convoID))
+		return nil, err
+	}
+	defer rows.Close()
+
+	comments := []Comment{}
+	for rows.Next() {
+		c := Comment{}
+		err := rows.Scan(
+			&c.ID,
+			&c.ConvoID,
+			&c.UserID,
+			&c.ParentID,
+			&c.Start,
+			&c.End,
+			&c.Version,
+			&c.Body,
+			&c.Resolved,
+			&c.Orphaned,
+			&c.CreatedAt,
+			&c.UpdatedAt,
+		)
+		if err != nil {
+			db.logger.Error("Error reading comment", zap.Error(err), zap.Int64("conversation_id", convoID))
+			return nil, err
+		}
+		comments = append(comments, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return comments, nil
+}
+
+// CreateComment adds a new comment to the database and sets its ID
+func (db *DB) CreateComment(comment *Comment) error {
+	defer timeQuery("CreateComment")()
+
+	err := db.QueryRow(
+		`INSERT INTO comments(convo_id,user_id,parent_id,anchor_start,anchor_end,version,body,resolved,orphaned,created_at,updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id`,
+		comment.ConvoID,
+		comment.UserID,
+		comment.ParentID,
+		comment.Start,
+		comment.End,
+		comment.Version,
+		comment.Body,
+		comment.Resolved,
+		comment.Orphaned,
+		comment.CreatedAt.Format(time.RFC3339),
+		comment.UpdatedAt.Format(time.RFC3339),
+	).Scan(&comment.ID)
+	if err != nil {
+		db.logger.Error("Error inserting comment", zap.Error(err), zap.Int64("conversation_id", comment.ConvoID))
+		return err
+	}
+
+	return nil
+}
+
+// UpdateComment saves the anchor, body and state of a comment in the database
+func (db *DB) UpdateComment(comment *Comment) error {
+	defer timeQuery("UpdateComment")()
+
+	_, err := db.Exec(
+		`UPDATE comments SET anchor_start = $1, anchor_end = $2, version = $3, body = $4, resolved = $5, orphaned = $6, updated_at = $7
+		WHERE id = $8 AND convo_id = $9`,
+		comment.Start,
+		comment.End,
+		comment.Version,
+		comment.Body,
+		comment.Resolved,
+		comment.Orphaned,
+		comment.UpdatedAt.Format(time.RFC3339),
+		comment.ID,
+		comment.ConvoID,
+	)
+	if err != nil {
+		db.logger.Error(
+			"Error updating comment",
+			zap.Error(err),
+			zap.Int64("conversation_id", comment.ConvoID),
+			zap.Int64("comment_id", comment.ID),
+		)
+		return err
+	}
+
+	return nil
+}
+
+// DeleteComment removes a comment and its replies from the database
+func (db *DB) DeleteComment(convoID, id int64) error {
+	defer timeQuery("DeleteComment")()
+
+	_, err := db.Exec("DELETE FROM comments WHERE convo_id = $1 AND (id = $2 OR parent_id = $2)", convoID, id)
+	if err != nil {
+		db.logger.Error("Error deleting comment", zap.Error(err), zap.Int64("conversation_id", convoID), zap.Int64("comment_id", id))
+		return err
+	}
+
+	return nil
+}
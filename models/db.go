@@ -3,25 +3,49 @@ package models
 import (
 	"database/sql"
 	"io/ioutil"
+	"patches/metrics"
 	"strings"
+	"time"
 
 	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
 )
 
-// Datastore defines the CRUD operations of patches in the database
+// Datastore defines the CRUD operations of patches, snapshots, messages and
+// comments, and the queries for activity, in the database
 type Datastore interface {
 	CreatePatch(patch *Patch) error
 	GetPatches(filter *Filter) ([]Patch, error)
 	DeletePatches(convo_id int64) (int64, error)
+	CreateSnapshot(snapshot *Snapshot) error
+	GetSnapshot(filter *Filter) (*Snapshot, error)
+	GetLatestVersion(convoID int64) (int, error)
+	GetActivity(filter *Filter, bucket time.Duration) ([]Activity, error)
+	CreateMessage(message *Message) error
+	GetMessages(filter *Filter) ([]Message, error)
+	CreateComment(comment *Comment) error
+	GetComments(convoID int64) ([]Comment, error)
+	UpdateComment(comment *Comment) error
+	DeleteComment(convoID, id int64) error
+}
+
+// timeQuery starts timing the query of a Datastore method, returning a function
+// that records how long the query took.
+func timeQuery(method string) func() {
+	timer := prometheus.NewTimer(metrics.DBQueryDuration.WithLabelValues(method))
+	return func() { timer.ObserveDuration() }
 }
 
 // DB represents an SQL database connection
 type DB struct {
 	*sql.DB
+	timescale bool
+	logger    *zap.Logger
 }
 
-// DBConnect initializes a new DB
-func DBConnect(connectionString string) (*DB, error) {
+// DBConnect initializes a new DB that logs failed queries to a logger
+func DBConnect(connectionString string, logger *zap.Logger) (*DB, error) {
 	db, err := sql.Open("postgres", connectionString)
 	if err != nil {
 		return nil, err
@@ -47,24 +71,40 @@ func DBConnect(connectionString string) (*DB, error) {
 		return nil, err
 	}
 
-	return &DB{db}, nil
+	// Check whether TimescaleDB functions can be used in queries
+	var extensions int
+	err = db.QueryRow("SELECT COUNT(*) FROM pg_extension WHERE extname = 'timescaledb'").Scan(&extensions)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DB{DB: db, timescale: extensions > 0, logger: logger}, nil
 }
 
-// setupTable creates the necessary "patches" table if it doesn't already exist.
+// setupTable creates the necessary "patches" table if it doesn't already exist,
+// and then brings the schema up to date. The migrations are idempotent, so they
+// run on every start and add what databases created by earlier versions lack.
 func setupTable(db *sql.DB) error {
 	var tmp string
 
-	// Check if the "patches" table exists by querying for the table. If it does
-	// exist, just return.
+	// Check if the "patches" table exists by querying for the table. The type
+	// and hypertable are only created along with it.
 	queryTable := "SELECT table_name FROM information_schema.tables WHERE table_name='patches'"
 	err := db.QueryRow(queryTable).Scan(&tmp)
 	if err != nil && err != sql.ErrNoRows {
 		return err
-	} else if err != sql.ErrNoRows {
-		return nil
+	} else if err == sql.ErrNoRows {
+		if err := execScript(db, "dbSchema.sql"); err != nil {
+			return err
+		}
 	}
 
-	sqlScript, err := ioutil.ReadFile("dbSchema.sql")
+	return execScript(db, "dbMigrations.sql")
+}
+
+// execScript runs the statements of an SQL script in order.
+func execScript(db *sql.DB, path string) error {
+	sqlScript, err := ioutil.ReadFile(path)
 	if err != nil {
 		return err
 	}
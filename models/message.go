@@ -0,0 +1,107 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Message represents an ephemeral message that was persisted, such as a chat
+// message.
+type Message struct {
+	Timestamp time.Time       `json:"timestamp"`
+	ConvoID   int64           `json:"convo_id"`
+	UserID    int64           `json:"user_id"`
+	Namespace string          `json:"namespace"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// GetMessages gets persisted messages of a conversation from the database
+// using filters, oldest first.
+func (db *DB) GetMessages(filter *Filter) ([]Message, error) {
+	defer timeQuery("GetMessages")()
+
+	filterString := new(strings.Builder)
+	fmt.Fprintf(filterString, "convo_id = %d", filter.Conversation)
+
+	if len(filter.User) >= 1 {
+		users := make([]string, len(filter.User))
+		for i, userID := range filter.User {
+			users[i] = fmt.Sprint(userID)
+		}
+		fmt.Fprintf(filterString, " AND user_id IN (%s)", strings.Join(users, ", "))
+	}
+
+	args := []interface{}{}
+	if len(filter.Namespace) >= 1 {
+		placeholders := make([]string, len(filter.Namespace))
+		for i, namespace := range filter.Namespace {
+			args = append(args, namespace)
+			placeholders[i] = fmt.Sprintf("$%d", len(args))
+		}
+		fmt.Fprintf(filterString, " AND namespace IN (%s)", strings.Join(placeholders, ", "))
+	}
+
+	if !filter.StartTime.IsZero() {
+		t := filter.StartTime.Format("2006-01-02 15:04:05")
+		fmt.Fprintf(filterString, " AND time >= '%s'", t)
+	}
+	if !filter.EndTime.IsZero() {
+		t := filter.EndTime.Format("2006-01-02 15:04:05")
+		fmt.Fprintf(filterString, " AND time <= '%s'", t)
+	}
+
+	queryString := new(strings.Builder)
+	fmt.Fprintf(
+		queryString,
+		"SELECT time, convo_id, user_id, namespace, payload FROM messages WHERE %s ORDER BY time",
+		filterString,
+	)
+
+	rows, err := db.Query(queryString.String(), args...)
+	if err != nil {
+		db.logger.Error("Error getting messages", zap.Error(err), zap.Int64("conversation_id", filter.Conversation))
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		m := Message{}
+		var payload string
+		if err := rows.Scan(&m.Timestamp, &m.ConvoID, &m.UserID, &m.Namespace, &payload); err != nil {
+			db.logger.Error("Error reading message", zap.Error(err), zap.Int64("conversation_id", filter.Conversation))
+			return nil, err
+		}
+		m.Payload = json.RawMessage(payload)
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// CreateMessage adds a new message to the database
+func (db *DB) CreateMessage(message *Message) error {
+	defer timeQuery("CreateMessage")()
+
+	_, err := db.Exec(
+		"INSERT INTO messages(time,convo_id,user_id,namespace,payload) VALUES ($1, $2, $3, $4, $5)",
+		message.Timestamp.Format(time.RFC3339),
+		message.ConvoID,
+		message.UserID,
+		message.Namespace,
+		string(message.Payload),
+	)
+	if err != nil {
+		db.logger.Error("Error inserting message", zap.Error(err), zap.Int64("conversation_id", message.ConvoID))
+		return err
+	}
+
+	return nil
+}
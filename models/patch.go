@@ -2,17 +2,25 @@ package models
 
 import (
 	"fmt"
-	"log"
 	"strings"
 	"time"
+
+	"go.uber.org/zap"
 )
 
+// PatchTypeEdit is the type of patches that are created by Update (EDIT)
+// messages.
+const PatchTypeEdit = "edit"
+
 type Patch struct {
 	Timestamp time.Time `json:"timestamp"`
 	Patch     string    `json:"patch"`
 	ConvoID   int64     `json:"convo_id"`
 	UserID    int64     `json:"user_id"`
 	Type      string    `json:"type"`
+	Version   int       `json:"version"`
+	Inserted  int       `json:"inserted"`
+	Deleted   int       `json:"deleted"`
 }
 
 type Filter struct {
@@ -21,17 +29,21 @@ type Filter struct {
 	Type         []string  `schema:"type"`
 	EndTime      time.Time `schema:"end_time"`
 	StartTime    time.Time `schema:"start_time"`
+	EndVersion   *int      `schema:"end_version"`
+	StartVersion *int      `schema:"start_version"`
+	Namespace    []string  `schema:"namespace"`
 }
 
 // GetPatches gets patch rows from the database using filters
 func (db *DB) GetPatches(filter *Filter) ([]Patch, error) {
+	defer timeQuery("GetPatches")()
 
 	// Create filter string
 	filterString := new(strings.Builder)
 	if filter.Conversation != 0 {
 		fmt.Fprintf(filterString, "convo_id = %d", filter.Conversation)
 	} else {
-		log.Print("Error with conversation id")
+		db.logger.Error("Error with conversation id")
 		return nil, nil
 	}
 
@@ -72,13 +84,23 @@ func (db *DB) GetPatches(filter *Filter) ([]Patch, error) {
 		fmt.Fprintf(filterString, " AND time >= '%s'", t)
 	}
 
+	if filter.EndVersion != nil {
+		fmt.Fprintf(filterString, " AND version <= %d", *filter.EndVersion)
+	}
+	if filter.StartVersion != nil {
+		fmt.Fprintf(filterString, " AND version >= %d", *filter.StartVersion)
+	}
+
 	// Create query string with filters
 	queryString := new(strings.Builder)
-	fmt.Fprintf(queryString, "SELECT * FROM patches WHERE %s", filterString)
+	fmt.Fprintf(
+		queryString,
+		"SELECT time, patch, convo_id, user_id, type, COALESCE(version, 0), COALESCE(inserted, 0), COALESCE(deleted, 0) FROM patches WHERE %s ORDER BY version, time",
+		filterString,
+	)
 	rows, err := db.Query(queryString.String())
 	if err != nil {
-		log.Print("Error getting rows")
-		log.Print(err)
+		db.logger.Error("Error getting patches", zap.Error(err), zap.Int64("conversation_id", filter.Conversation))
 		return nil, err
 	}
 	defer rows.Close()
@@ -87,9 +109,9 @@ func (db *DB) GetPatches(filter *Filter) ([]Patch, error) {
 	patches := make([]Patch, 0)
 	// Create patches object
 	for rows.Next() {
-		err := rows.Scan(&p.Timestamp, &p.Patch, &p.ConvoID, &p.UserID, &p.Type)
+		err := rows.Scan(&p.Timestamp, &p.Patch, &p.ConvoID, &p.UserID, &p.Type, &p.Version, &p.Inserted, &p.Deleted)
 		if err != nil {
-			log.Print(err)
+			db.logger.Error("Error reading patch", zap.Error(err), zap.Int64("conversation_id", filter.Conversation))
 			return nil, err
 		}
 		patches = append(patches, p)
@@ -100,12 +122,18 @@ func (db *DB) GetPatches(filter *Filter) ([]Patch, error) {
 
 // CreatePatch adds a new patch to the database
 func (db *DB) CreatePatch(patch *Patch) error {
+	defer timeQuery("CreatePatch")()
 
 	// Insert patch into database
-	_, err := db.Exec("INSERT INTO patches(time,patch,convo_id,user_id,type) VALUES ($1, $2, $3, $4, $5) ", patch.Timestamp.Format(time.RFC3339), patch.Patch, patch.ConvoID, patch.UserID, patch.Type)
+	_, err := db.Exec("INSERT INTO patches(time,patch,convo_id,user_id,type,version,inserted,deleted) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ", patch.Timestamp.Format(time.RFC3339), patch.Patch, patch.ConvoID, patch.UserID, patch.Type, patch.Version, patch.Inserted, patch.Deleted)
 	if err != nil {
-		log.Print("Error inserting")
-		log.Print(err)
+		db.logger.Error(
+			"Error inserting patch",
+			zap.Error(err),
+			zap.Int64("conversation_id", patch.ConvoID),
+			zap.Int64("user_id", patch.UserID),
+			zap.Int("version", patch.Version),
+		)
 		return err
 	}
 
@@ -114,23 +142,21 @@ func (db *DB) CreatePatch(patch *Patch) error {
 
 // DeletePatches deletes patches from the database by conversation
 func (db *DB) DeletePatches(convo_id int64) (int64, error) {
+	defer timeQuery("DeletePatches")()
 
 	// Delete patches from db
 	del, err := db.Exec("DELETE FROM patches WHERE convo_id = $1", convo_id)
 	if err != nil {
-		log.Print("Error deleting")
-		log.Print(err)
+		db.logger.Error("Error deleting patches", zap.Error(err), zap.Int64("conversation_id", convo_id))
 		return 0, err
 	}
 
-	log.Print("Rows deleted")
-
 	deleted, err := del.RowsAffected()
 	if err != nil {
-		log.Print("Error deleting rows")
-		log.Print(err)
+		db.logger.Error("Error counting deleted patches", zap.Error(err), zap.Int64("conversation_id", convo_id))
 		return 0, err
 	}
 
+	db.logger.Info("Deleted patches", zap.Int64("conversation_id", convo_id), zap.Int64("deleted", deleted))
 	return deleted, err
 }
@@ -0,0 +1,93 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Snapshot represents the full content of a conversation at a version.
+type Snapshot struct {
+	Timestamp time.Time `json:"timestamp"`
+	Content   string    `json:"content"`
+	ConvoID   int64     `json:"convo_id"`
+	Version   int       `json:"version"`
+}
+
+// GetSnapshot gets the latest snapshot of a conversation that is no newer than
+// the end time and end version of the filter. Nil is returned if there is no
+// such snapshot.
+func (db *DB) GetSnapshot(filter *Filter) (*Snapshot, error) {
+	defer timeQuery("GetSnapshot")()
+
+	filterString := new(strings.Builder)
+	fmt.Fprintf(filterString, "convo_id = %d", filter.Conversation)
+
+	if !filter.EndTime.IsZero() {
+		t := filter.EndTime.Format("2006-01-02 15:04:05")
+		fmt.Fprintf(filterString, " AND time <= '%s'", t)
+	}
+	if filter.EndVersion != nil {
+		fmt.Fprintf(filterString, " AND version <= %d", *filter.EndVersion)
+	}
+
+	queryString := new(strings.Builder)
+	fmt.Fprintf(
+		queryString,
+		"SELECT time, content, convo_id, version FROM snapshots WHERE %s ORDER BY version DESC, time DESC LIMIT 1",
+		filterString,
+	)
+
+	s := Snapshot{}
+	err := db.QueryRow(queryString.String()).Scan(&s.Timestamp, &s.Content, &s.ConvoID, &s.Version)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		db.logger.Error("Error getting snapshot", zap.Error(err), zap.Int64("conversation_id", filter.Conversation))
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// CreateSnapshot adds a new snapshot to the database
+func (db *DB) CreateSnapshot(snapshot *Snapshot) error {
+	defer timeQuery("CreateSnapshot")()
+
+	_, err := db.Exec("INSERT INTO snapshots(time,content,convo_id,version) VALUES ($1, $2, $3, $4)", snapshot.Timestamp.Format(time.RFC3339), snapshot.Content, snapshot.ConvoID, snapshot.Version)
+	if err != nil {
+		db.logger.Error(
+			"Error inserting snapshot",
+			zap.Error(err),
+			zap.Int64("conversation_id", snapshot.ConvoID),
+			zap.Int("version", snapshot.Version),
+		)
+		return err
+	}
+
+	return nil
+}
+
+// GetLatestVersion gets the highest version of a conversation that has been
+// persisted through either a patch or a snapshot.
+func (db *DB) GetLatestVersion(convoID int64) (int, error) {
+	defer timeQuery("GetLatestVersion")()
+
+	var version int
+	err := db.QueryRow(
+		`SELECT GREATEST(
+			(SELECT COALESCE(MAX(version), 0) FROM patches WHERE convo_id = $1),
+			(SELECT COALESCE(MAX(version), 0) FROM snapshots WHERE convo_id = $1)
+		)`,
+		convoID,
+	).Scan(&version)
+	if err != nil {
+		db.logger.Error("Error getting latest version", zap.Error(err), zap.Int64("conversation_id", convoID))
+		return 0, err
+	}
+
+	return version, nil
+}
@@ -30,3 +30,8 @@ const (
 	// and represents the lowest level of privilege
 	User Role = "user"
 )
+
+// IsAdmin reports whether a role has elevated privilege in a conversation.
+func (r Role) IsAdmin() bool {
+	return r == Owner || r == Admin
+}
@@ -1,9 +1,72 @@
 package protocol
 
-// Caret represents a user's Start and End position in the document
+// Caret represents a user's Start and End position in the document. Carets
+// that are part of a Selection may be given a Name to tell them apart.
 type Caret struct {
-	Start int `json:"start"`
-	End   int `json:"end"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	Name  string `json:"name,omitempty"`
+}
+
+// Selection represents all of a user's carets in the document, such as the
+// ranges of a column selection or the carets of a multi-cursor editor. The
+// first caret is the user's primary caret, which is the one that edits and
+// cursor deltas apply to.
+type Selection []Caret
+
+// Primary returns the primary caret of a selection.
+func (s Selection) Primary() Caret {
+	if len(s) == 0 {
+		return Caret{}
+	}
+	return s[0]
+}
+
+// WithPrimary returns a copy of a selection with its primary caret replaced.
+func (s Selection) WithPrimary(primary Caret) Selection {
+	if len(s) == 0 {
+		return Selection{primary}
+	}
+	return append(Selection{primary}, s[1:]...)
+}
+
+// Equal reports whether two selections have the same carets in the same
+// order.
+func (s Selection) Equal(other Selection) bool {
+	if len(s) != len(other) {
+		return false
+	}
+	for i := range s {
+		if s[i] != other[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ShiftSelection takes a receiverSelection and returns a copy with every caret
+// shifted by ShiftCaret. Carets are never merged, even if they end up
+// overlapping, so that they keep their positions in the selection.
+func (receiverSelection Selection) ShiftSelection(senderCaret Caret, delta Delta) Selection {
+	shifted := make(Selection, len(receiverSelection))
+	for i, caret := range receiverSelection {
+		shifted[i] = caret.ShiftCaret(senderCaret, delta)
+	}
+	return shifted
+}
+
+// MoveSelection returns a copy of a user's selection after the user made an
+// edit at its primary caret. The primary caret moves by the caret deltas,
+// while the other carets shift around the edit like any receiver's carets.
+func (s Selection) MoveSelection(delta Delta) Selection {
+	if len(s) == 0 {
+		s = Selection{Caret{}}
+	}
+	primary := s[0]
+	moved := s.ShiftSelection(primary, delta)
+	moved[0].Start = primary.Start + *delta.CaretStart
+	moved[0].End = primary.End + *delta.CaretEnd
+	return moved
 }
 
 // processAdd takes a recceiverCaret and returns a shifted Caret according to a
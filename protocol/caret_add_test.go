@@ -9,6 +9,9 @@ var addTests = []struct {
 	SenderCaret              Caret
 	ReceiverCaret            Caret
 	ExpectedReceiverNewCaret Caret
+
+	ReceiverSelection            Selection
+	ExpectedReceiverNewSelection Selection
 }{
 	{
 		Name:            "Add::Single::Receiver Cursor::Sender After Receiver",
@@ -208,4 +211,26 @@ var addTests = []struct {
 			End:   3,
 		},
 	},
+	{
+		Name:            "Add::Single::Receiver Selection::Multiple Ranges",
+		CaretStartDelta: 1,
+		CaretEndDelta:   1,
+		DocDelta:        1,
+		SenderCaret: Caret{
+			Start: 1,
+			End:   1,
+		},
+		ReceiverSelection: Selection{
+			{Start: 0, End: 0, Name: "primary"},
+			{Start: 1, End: 1},
+			{Start: 2, End: 2},
+			{Start: 0, End: 3},
+		},
+		ExpectedReceiverNewSelection: Selection{
+			{Start: 0, End: 0, Name: "primary"},
+			{Start: 1, End: 1},
+			{Start: 3, End: 3},
+			{Start: 0, End: 4},
+		},
+	},
 }
@@ -9,6 +9,9 @@ var deleteTests = []struct {
 	SenderCaret              Caret
 	ReceiverCaret            Caret
 	ExpectedReceiverNewCaret Caret
+
+	ReceiverSelection            Selection
+	ExpectedReceiverNewSelection Selection
 }{
 	{
 		Name:            "Delete::Sender Cursor::Backward::Single::Receiver Cursor::Sender After Receiver",
@@ -622,4 +625,26 @@ var deleteTests = []struct {
 			End:   2,
 		},
 	},
+	{
+		Name:            "Delete::Sender Cursor::Backward::Single::Receiver Selection::Multiple Ranges",
+		CaretStartDelta: -1,
+		CaretEndDelta:   -1,
+		DocDelta:        -1,
+		SenderCaret: Caret{
+			Start: 1,
+			End:   1,
+		},
+		ReceiverSelection: Selection{
+			{Start: 0, End: 0},
+			{Start: 2, End: 2, Name: "secondary"},
+			{Start: 0, End: 3},
+			{Start: 1, End: 1},
+		},
+		ExpectedReceiverNewSelection: Selection{
+			{Start: 0, End: 0},
+			{Start: 1, End: 1, Name: "secondary"},
+			{Start: 0, End: 2},
+			{Start: 0, End: 0},
+		},
+	},
 }
@@ -9,6 +9,9 @@ var replaceTests = []struct {
 	SenderCaret              Caret
 	ReceiverCaret            Caret
 	ExpectedReceiverNewCaret Caret
+
+	ReceiverSelection            Selection
+	ExpectedReceiverNewSelection Selection
 }{
 	{
 		Name:            "Replace::Receiver Cursor::Smaller::Sender After Receiver",
@@ -226,4 +229,24 @@ var replaceTests = []struct {
 			End:   5,
 		},
 	},
+	{
+		Name:            "Replace::Receiver Selection::Smaller::Multiple Ranges",
+		CaretStartDelta: 1,
+		CaretEndDelta:   -1,
+		DocDelta:        -1,
+		SenderCaret: Caret{
+			Start: 2,
+			End:   4,
+		},
+		ReceiverSelection: Selection{
+			{Start: 5, End: 6, Name: "primary"},
+			{Start: 0, End: 0},
+			{Start: 3, End: 3},
+		},
+		ExpectedReceiverNewSelection: Selection{
+			{Start: 4, End: 5, Name: "primary"},
+			{Start: 0, End: 0},
+			{Start: 2, End: 2},
+		},
+	},
 }
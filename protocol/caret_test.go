@@ -14,6 +14,9 @@ func TestPostConversationsHandler(t *testing.T) {
 		SenderCaret              Caret
 		ReceiverCaret            Caret
 		ExpectedReceiverNewCaret Caret
+
+		ReceiverSelection            Selection
+		ExpectedReceiverNewSelection Selection
 	}{}
 
 	tests = append(tests, addTests...)
@@ -22,14 +25,25 @@ func TestPostConversationsHandler(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.Name, func(t *testing.T) {
-			newCaret := test.ReceiverCaret.ShiftCaret(
-				test.SenderCaret,
-				Delta{
-					&test.CaretStartDelta,
-					&test.CaretEndDelta,
-					&test.DocDelta,
-				},
-			)
+			delta := Delta{
+				&test.CaretStartDelta,
+				&test.CaretEndDelta,
+				&test.DocDelta,
+			}
+
+			if test.ReceiverSelection != nil {
+				newSelection := test.ReceiverSelection.ShiftSelection(test.SenderCaret, delta)
+				if !test.ExpectedReceiverNewSelection.Equal(newSelection) {
+					t.Errorf(
+						"Updated selection is wrong. Expected: %+v. Actual: %+v.",
+						test.ExpectedReceiverNewSelection,
+						newSelection,
+					)
+				}
+				return
+			}
+
+			newCaret := test.ReceiverCaret.ShiftCaret(test.SenderCaret, delta)
 
 			if test.ExpectedReceiverNewCaret != newCaret {
 				t.Errorf(
@@ -41,3 +55,29 @@ func TestPostConversationsHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestMoveSelection(t *testing.T) {
+	caretDelta, docDelta := 2, 2
+	delta := Delta{&caretDelta, &caretDelta, &docDelta}
+
+	// Typing at the primary caret moves it and shifts the carets after it
+	selection := Selection{
+		{Start: 3, End: 3, Name: "primary"},
+		{Start: 1, End: 1},
+		{Start: 5, End: 7},
+	}
+	expected := Selection{
+		{Start: 5, End: 5, Name: "primary"},
+		{Start: 1, End: 1},
+		{Start: 7, End: 9},
+	}
+	if moved := selection.MoveSelection(delta); !expected.Equal(moved) {
+		t.Errorf("Moved selection is wrong. Expected: %+v. Actual: %+v.", expected, moved)
+	}
+
+	// An empty selection has a primary caret at the start of the document
+	expected = Selection{{Start: 2, End: 2}}
+	if moved := (Selection{}).MoveSelection(delta); !expected.Equal(moved) {
+		t.Errorf("Moved selection is wrong. Expected: %+v. Actual: %+v.", expected, moved)
+	}
+}
@@ -0,0 +1,89 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes and decodes messages in a wire format.
+type Codec interface {
+	// Name returns the WebSocket subprotocol that selects the codec.
+	Name() string
+
+	// Binary returns whether encoded messages are sent in binary frames
+	// rather than text frames.
+	Binary() bool
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSON encodes messages as JSON text, which is what clients that don't
+	// negotiate a subprotocol use.
+	JSON Codec = jsonCodec{}
+
+	// MessagePack encodes messages in the compact binary MessagePack format
+	// using the same field names as JSON.
+	MessagePack Codec = msgpackCodec{}
+)
+
+// Subprotocols lists the WebSocket subprotocols of all codecs in the server's
+// order of preference.
+var Subprotocols = []string{MessagePack.Name(), JSON.Name()}
+
+// CodecFor returns the codec that is selected by a negotiated WebSocket
+// subprotocol, defaulting to JSON.
+func CodecFor(subprotocol string) Codec {
+	if subprotocol == MessagePack.Name() {
+		return MessagePack
+	}
+	return JSON
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "patches.json"
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "patches.msgpack"
+}
+
+func (msgpackCodec) Binary() bool {
+	return true
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
@@ -0,0 +1,123 @@
+package protocol
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// largeInit creates an Init message for a conversation with a large document
+// and many active users.
+func largeInit(users int, docSize int) Message {
+	version := 1000
+	content := strings.Repeat("<p>Lorem ipsum dolor sit amet</p>", docSize/32)
+	activeUsers := make(map[int64]Caret)
+	for i := 0; i < users; i++ {
+		activeUsers[int64(i)] = Caret{Start: i * 10, End: i*10 + 5}
+	}
+	return Message{
+		Type: TypeInit,
+		Data: InnerData{
+			Version:     &version,
+			Content:     &content,
+			ActiveUsers: &activeUsers,
+		},
+	}
+}
+
+// cursorUpdate creates an Update (CURSOR) message.
+func cursorUpdate() Message {
+	updateType := UpdateTypeCursor
+	version := 1000
+	userID := int64(42)
+	caretStart, caretEnd := 1, 1
+	return Message{
+		Type: TypeUpdate,
+		Data: InnerData{
+			Type:    &updateType,
+			Version: &version,
+			UserID:  &userID,
+			Delta: &Delta{
+				CaretStart: &caretStart,
+				CaretEnd:   &caretEnd,
+			},
+		},
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	startVersion, endVersion := 10, 12
+	revert := Message{
+		Type: TypeRevert,
+		Data: InnerData{StartVersion: &startVersion, EndVersion: &endVersion},
+	}
+	messages := map[string]Message{
+		"Init":   largeInit(3, 1024),
+		"Cursor": cursorUpdate(),
+		"Revert": revert,
+	}
+
+	for _, codec := range []Codec{JSON, MessagePack} {
+		for name, msg := range messages {
+			t.Run(codec.Name()+"::"+name, func(t *testing.T) {
+				encoded, err := codec.Marshal(msg)
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+
+				decoded := Message{}
+				if err := codec.Unmarshal(encoded, &decoded); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+
+				if !reflect.DeepEqual(msg, decoded) {
+					t.Errorf("Decoded message is wrong. Expected: %+v. Actual: %+v.", msg, decoded)
+				}
+			})
+		}
+	}
+
+	if CodecFor("patches.msgpack") != MessagePack || CodecFor("") != JSON {
+		t.Error("Codec selected for subprotocol is wrong")
+	}
+}
+
+func BenchmarkCodecs(b *testing.B) {
+	messages := []struct {
+		Name    string
+		Message Message
+	}{
+		{"Init::Large Conversation", largeInit(500, 256*1024)},
+		{"Cursor", cursorUpdate()},
+	}
+
+	for _, codec := range []Codec{JSON, MessagePack} {
+		for _, m := range messages {
+			encoded, err := codec.Marshal(m.Message)
+			if err != nil {
+				b.Fatalf("Unexpected error: %v", err)
+			}
+
+			b.Run(codec.Name()+"::"+m.Name+"::Marshal", func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(encoded)))
+				for i := 0; i < b.N; i++ {
+					if _, err := codec.Marshal(m.Message); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+
+			b.Run(codec.Name()+"::"+m.Name+"::Unmarshal", func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(len(encoded)))
+				for i := 0; i < b.N; i++ {
+					msg := Message{}
+					if err := codec.Unmarshal(encoded, &msg); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -1,5 +1,7 @@
 package protocol
 
+import "time"
+
 type Message struct {
 	Type MessageType `json:"type"`
 	Data InnerData   `json:"data"`
@@ -15,21 +17,107 @@ const (
 	TypeSync      MessageType = 3
 	TypeUserJoin  MessageType = 4
 	TypeUserLeave MessageType = 5
+	TypeRevert    MessageType = 6
+	TypeHello     MessageType = 7
+	TypePresence  MessageType = 8
+	TypeEphemeral MessageType = 9
+	TypeComment   MessageType = 10
 
 	UpdateTypeEdit   UpdateType = 0
 	UpdateTypeCursor UpdateType = 1
+	UpdateTypeUndo   UpdateType = 2
+	UpdateTypeRedo   UpdateType = 3
 )
 
 type InnerData struct {
-	Type        *UpdateType      `json:"type,omitempty"`
-	Version     *int             `json:"version,omitempty"`
-	Patch       *string          `json:"patch,omitempty"`
-	Delta       *Delta           `json:"delta,omitempty"`
-	UserID      *int64           `json:"user_id,omitempty"`
-	Content     *string          `json:"content,omitempty"`
-	ActiveUsers *map[int64]Caret `json:"active_users,omitempty"`
+	Type            *UpdateType          `json:"type,omitempty"`
+	Version         *int                 `json:"version,omitempty"`
+	Patch           *string              `json:"patch,omitempty"`
+	Delta           *Delta               `json:"delta,omitempty"`
+	UserID          *int64               `json:"user_id,omitempty"`
+	Content         *string              `json:"content,omitempty"`
+	ActiveUsers     *map[int64]Caret     `json:"active_users,omitempty"`
+	Caret           *Caret               `json:"caret,omitempty"`
+	StartVersion    *int                 `json:"start_version,omitempty"`
+	EndVersion      *int                 `json:"end_version,omitempty"`
+	StartTime       *time.Time           `json:"start_time,omitempty"`
+	EndTime         *time.Time           `json:"end_time,omitempty"`
+	Token           *string              `json:"token,omitempty"`
+	ProtocolVersion *int                 `json:"protocol_version,omitempty"`
+	Capabilities    *[]string            `json:"capabilities,omitempty"`
+	ClientID        *string              `json:"client_id,omitempty"`
+	Selection       *Selection           `json:"selection,omitempty"`
+	Selections      *map[int64]Selection `json:"selections,omitempty"`
+	Nickname        *string              `json:"nickname,omitempty"`
+	Role            *string              `json:"role,omitempty"`
+	Color           *string              `json:"color,omitempty"`
+	Presence        *Presence            `json:"presence,omitempty"`
+	Users           *map[int64]User      `json:"users,omitempty"`
+	SessionID       *int64               `json:"session_id,omitempty"`
+	Sessions        *map[int64]Session   `json:"sessions,omitempty"`
+	Namespace       *string              `json:"namespace,omitempty"`
+	Payload         interface{}          `json:"payload,omitempty"`
+	Targets         *[]int64             `json:"targets,omitempty"`
+	Action          *string              `json:"action,omitempty"`
+	Comment         *Comment             `json:"comment,omitempty"`
+	Comments        *[]Comment           `json:"comments,omitempty"`
+	Hash            *string              `json:"hash,omitempty"`
+}
+
+// Comment is a comment on a range of the document, or a reply to one. Fields
+// that are not set in a request to update a comment are left unchanged.
+type Comment struct {
+	ID        int64      `json:"id,omitempty"`
+	UserID    int64      `json:"user_id,omitempty"`
+	ParentID  *int64     `json:"parent_id,omitempty"`
+	Anchor    *Caret     `json:"anchor,omitempty"`
+	Body      *string    `json:"body,omitempty"`
+	Resolved  *bool      `json:"resolved,omitempty"`
+	Orphaned  bool       `json:"orphaned,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
 }
 
+// Actions of Comment messages.
+const (
+	CommentCreate = "create"
+	CommentUpdate = "update"
+	CommentDelete = "delete"
+)
+
+// Session describes one of the connections of a user to a conversation.
+type Session struct {
+	UserID    int64     `json:"user_id"`
+	Selection Selection `json:"selection"`
+}
+
+// User describes a user that is present in a conversation.
+type User struct {
+	Nickname *string  `json:"nickname,omitempty"`
+	Role     string   `json:"role"`
+	Color    string   `json:"color"`
+	Presence Presence `json:"presence"`
+}
+
+// Presence is what a user present in a conversation is doing.
+type Presence string
+
+const (
+	// PresenceActive is the presence of a user who has recently been active.
+	PresenceActive Presence = "active"
+
+	// PresenceTyping is the presence of a user who is editing the document.
+	PresenceTyping Presence = "typing"
+
+	// PresenceIdle is the presence of a user who hasn't been active for a
+	// while.
+	PresenceIdle Presence = "idle"
+
+	// PresenceAway is the presence of a user who hasn't been active for a long
+	// time.
+	PresenceAway Presence = "away"
+)
+
 type Delta struct {
 	CaretStart *int `json:"caret_start,omitempty"`
 	CaretEnd   *int `json:"caret_end,omitempty"`
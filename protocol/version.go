@@ -0,0 +1,151 @@
+package protocol
+
+import (
+	"errors"
+)
+
+const (
+	// ProtocolV1 is the original protocol, where the handshake is a bare token
+	// and messages have no fields beyond the ones in the first release.
+	ProtocolV1 = 1
+
+	// ProtocolV2 adds the Hello handshake and server-made edits that carry the
+	// replaced range in their caret.
+	ProtocolV2 = 2
+
+	// ProtocolV3 adds multi-range selections to Init messages and cursor
+	// updates.
+	ProtocolV3 = 3
+
+	// ProtocolV4 adds the display info of users to Init and UserJoin messages
+	// and Presence messages.
+	ProtocolV4 = 4
+
+	// ProtocolV5 adds sessions, which tell apart the connections of a user
+	// that is connected to a conversation more than once.
+	ProtocolV5 = 5
+
+	// ProtocolV6 adds Ephemeral messages, which relay signals such as chat
+	// messages and pointer positions between clients.
+	ProtocolV6 = 6
+
+	// ProtocolV7 adds comments that are anchored to ranges of the document.
+	ProtocolV7 = 7
+
+	// ProtocolV8 adds hashes of the document to Init, Ack and Sync messages,
+	// which clients check their documents against.
+	ProtocolV8 = 8
+
+	// MinProtocolVersion is the oldest protocol version that is still
+	// supported.
+	MinProtocolVersion = ProtocolV1
+
+	// MaxProtocolVersion is the newest protocol version that is supported.
+	MaxProtocolVersion = ProtocolV8
+)
+
+// ServerCapabilities lists the optional features that the server supports.
+var ServerCapabilities = []string{"revert", "undo"}
+
+// ErrUnsupportedVersion is returned when a client only supports protocol
+// versions older than MinProtocolVersion.
+var ErrUnsupportedVersion = errors.New("protocol version is not supported")
+
+// minVersions stores the first protocol version that each message type was
+// introduced in. Message types that are not listed exist in every version.
+var minVersions = map[MessageType]int{
+	TypeHello:     ProtocolV2,
+	TypePresence:  ProtocolV4,
+	TypeEphemeral: ProtocolV6,
+	TypeComment:   ProtocolV7,
+}
+
+// Negotiate returns the highest protocol version that is supported by both the
+// server and a client that supports up to clientVersion.
+func Negotiate(clientVersion int) (int, error) {
+	if clientVersion < MinProtocolVersion {
+		return 0, ErrUnsupportedVersion
+	}
+	if clientVersion > MaxProtocolVersion {
+		return MaxProtocolVersion, nil
+	}
+	return clientVersion, nil
+}
+
+// downgrade returns a copy of a message that only contains what a client
+// speaking a protocol version understands. False is returned if the client
+// does not understand the message at all.
+func downgrade(msg Message, version int) (Message, bool) {
+	if minVersion, ok := minVersions[msg.Type]; ok && version < minVersion {
+		return msg, false
+	}
+
+	if version < ProtocolV8 {
+		msg.Data.Hash = nil
+	}
+
+	if version < ProtocolV7 {
+		msg.Data.Action = nil
+		msg.Data.Comment = nil
+		msg.Data.Comments = nil
+	}
+
+	if version < ProtocolV6 {
+		msg.Data.Namespace = nil
+		msg.Data.Payload = nil
+		msg.Data.Targets = nil
+	}
+
+	if version < ProtocolV5 {
+		msg.Data.SessionID = nil
+		msg.Data.Sessions = nil
+	}
+
+	if version < ProtocolV4 {
+		msg.Data.Nickname = nil
+		msg.Data.Role = nil
+		msg.Data.Color = nil
+		msg.Data.Presence = nil
+		msg.Data.Users = nil
+	}
+
+	if version < ProtocolV3 {
+		msg.Data.Selection = nil
+		msg.Data.Selections = nil
+
+		// Only the primary carets of selections have names
+		if msg.Data.ActiveUsers != nil {
+			activeUsers := make(map[int64]Caret, len(*msg.Data.ActiveUsers))
+			for userID, caret := range *msg.Data.ActiveUsers {
+				caret.Name = ""
+				activeUsers[userID] = caret
+			}
+			msg.Data.ActiveUsers = &activeUsers
+		}
+	}
+
+	if version < ProtocolV2 {
+		msg.Data.Caret = nil
+		msg.Data.StartVersion = nil
+		msg.Data.EndVersion = nil
+		msg.Data.StartTime = nil
+		msg.Data.EndTime = nil
+		msg.Data.Token = nil
+		msg.Data.ProtocolVersion = nil
+		msg.Data.Capabilities = nil
+		msg.Data.ClientID = nil
+	}
+
+	return msg, true
+}
+
+// Encode marshals a message with a codec for a client that speaks a protocol
+// version. Nil is returned if the client does not understand the message, in
+// which case it should not be sent to the client.
+func Encode(msg Message, version int, codec Codec) ([]byte, error) {
+	msg, ok := downgrade(msg, version)
+	if !ok {
+		return nil, nil
+	}
+	return codec.Marshal(msg)
+}
@@ -0,0 +1,152 @@
+package protocol
+
+import (
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		Name            string
+		ClientVersion   int
+		ExpectedVersion int
+		ExpectedErr     error
+	}{
+		{"Too Old", 0, 0, ErrUnsupportedVersion},
+		{"Oldest", MinProtocolVersion, MinProtocolVersion, nil},
+		{"Newest", MaxProtocolVersion, MaxProtocolVersion, nil},
+		{"Newer Than Server", MaxProtocolVersion + 1, MaxProtocolVersion, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			version, err := Negotiate(test.ClientVersion)
+			if version != test.ExpectedVersion || err != test.ExpectedErr {
+				t.Errorf(
+					"Negotiated version is wrong. Expected: %d (%v). Actual: %d (%v).",
+					test.ExpectedVersion,
+					test.ExpectedErr,
+					version,
+					err,
+				)
+			}
+		})
+	}
+}
+
+func TestEncode(t *testing.T) {
+	version := 1
+	userID := int64(1)
+	updateType := UpdateTypeEdit
+	edit := Message{
+		Type: TypeUpdate,
+		Data: InnerData{
+			Type:    &updateType,
+			Version: &version,
+			UserID:  &userID,
+			Caret:   &Caret{Start: 1, End: 2},
+		},
+	}
+	activeUsers := map[int64]Caret{1: {Start: 1, End: 1, Name: "primary"}}
+	selections := map[int64]Selection{1: {{Start: 1, End: 1, Name: "primary"}, {Start: 4, End: 6}}}
+	init := Message{
+		Type: TypeInit,
+		Data: InnerData{
+			ActiveUsers: &activeUsers,
+			Selections:  &selections,
+		},
+	}
+	hash := "2cf24dba"
+	ack := Message{
+		Type: TypeAck,
+		Data: InnerData{Version: &version, Hash: &hash},
+	}
+	protocolVersion := ProtocolV2
+	hello := Message{
+		Type: TypeHello,
+		Data: InnerData{ProtocolVersion: &protocolVersion},
+	}
+
+	tests := []struct {
+		Name            string
+		Message         Message
+		ProtocolVersion int
+		Expected        string
+	}{
+		{
+			Name:            "Edit::V1",
+			Message:         edit,
+			ProtocolVersion: ProtocolV1,
+			Expected:        `{"type":1,"data":{"type":0,"version":1,"user_id":1}}`,
+		},
+		{
+			Name:            "Edit::V2",
+			Message:         edit,
+			ProtocolVersion: ProtocolV2,
+			Expected:        `{"type":1,"data":{"type":0,"version":1,"user_id":1,"caret":{"start":1,"end":2}}}`,
+		},
+		{
+			Name:            "Init::V2",
+			Message:         init,
+			ProtocolVersion: ProtocolV2,
+			Expected:        `{"type":0,"data":{"active_users":{"1":{"start":1,"end":1}}}}`,
+		},
+		{
+			Name:            "Init::V3",
+			Message:         init,
+			ProtocolVersion: ProtocolV3,
+			Expected: `{"type":0,"data":{"active_users":{"1":{"start":1,"end":1,"name":"primary"}},` +
+				`"selections":{"1":[{"start":1,"end":1,"name":"primary"},{"start":4,"end":6}]}}}`,
+		},
+		{
+			Name:            "Ack::V7",
+			Message:         ack,
+			ProtocolVersion: ProtocolV7,
+			Expected:        `{"type":2,"data":{"version":1}}`,
+		},
+		{
+			Name:            "Ack::V8",
+			Message:         ack,
+			ProtocolVersion: ProtocolV8,
+			Expected:        `{"type":2,"data":{"version":1,"hash":"2cf24dba"}}`,
+		},
+		{
+			Name:            "Hello::V1",
+			Message:         hello,
+			ProtocolVersion: ProtocolV1,
+			Expected:        "",
+		},
+		{
+			Name:            "Hello::V2",
+			Message:         hello,
+			ProtocolVersion: ProtocolV2,
+			Expected:        `{"type":7,"data":{"protocol_version":2}}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			encoded, err := Encode(test.Message, test.ProtocolVersion, JSON)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if string(encoded) != test.Expected {
+				t.Errorf("Encoded message is wrong. Expected: %s. Actual: %s.", test.Expected, encoded)
+			}
+		})
+	}
+
+	// Encoding for an old version must not modify the original message
+	if _, err := Encode(edit, ProtocolV1, JSON); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if edit.Data.Caret == nil {
+		t.Error("Encoding modified the original message")
+	}
+	if _, err := Encode(init, ProtocolV2, JSON); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if init.Data.Selections == nil || activeUsers[1].Name != "primary" {
+		t.Error("Encoding modified the original message")
+	}
+}
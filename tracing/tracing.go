@@ -0,0 +1,100 @@
+// Package tracing configures OpenTelemetry tracing of the service.
+package tracing
+
+import (
+	"context"
+	"os"
+	"strconv"
+
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/propagation"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/trace/stdout"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc/codes"
+)
+
+// serviceName identifies the service in exported spans.
+const serviceName = "patches"
+
+// Setup installs the global trace provider. PATCHES_TRACES_EXPORTER selects
+// where spans are exported to: "otlp" sends them to the collector at
+// PATCHES_OTLP_ENDPOINT, "stdout" writes them to stdout for local testing, and
+// tracing is disabled otherwise. PATCHES_TRACES_SAMPLE_RATIO is the fraction of
+// traces that are sampled, which defaults to 1. The returned function flushes
+// the spans that haven't been exported yet.
+func Setup() (func(), error) {
+	ratio := 1.0
+	if value := os.Getenv("PATCHES_TRACES_SAMPLE_RATIO"); value != "" {
+		var err error
+		if ratio, err = strconv.ParseFloat(value, 64); err != nil {
+			return nil, err
+		}
+	}
+	config := sdktrace.Config{DefaultSampler: sdktrace.ProbabilitySampler(ratio)}
+	res := resource.New(kv.String("service.name", serviceName))
+
+	var processor sdktrace.SpanProcessor
+	stop := func() {}
+	switch os.Getenv("PATCHES_TRACES_EXPORTER") {
+	case "otlp":
+		endpoint := os.Getenv("PATCHES_OTLP_ENDPOINT")
+		if endpoint == "" {
+			endpoint = "localhost:55680"
+		}
+		exporter, err := otlp.NewExporter(otlp.WithInsecure(), otlp.WithAddress(endpoint))
+		if err != nil {
+			return nil, err
+		}
+		processor, err = sdktrace.NewBatchSpanProcessor(exporter)
+		if err != nil {
+			return nil, err
+		}
+		stop = func() { exporter.Stop() }
+
+	case "stdout":
+		exporter, err := stdout.NewExporter(stdout.Options{})
+		if err != nil {
+			return nil, err
+		}
+		processor = sdktrace.NewSimpleSpanProcessor(exporter)
+
+	default:
+		return stop, nil
+	}
+
+	provider, err := sdktrace.NewProvider(sdktrace.WithConfig(config), sdktrace.WithResource(res))
+	if err != nil {
+		return nil, err
+	}
+	provider.RegisterSpanProcessor(processor)
+	global.SetTraceProvider(provider)
+
+	return func() {
+		// Unregistering the span processor flushes the spans it holds
+		provider.UnregisterSpanProcessor(processor)
+		stop()
+	}, nil
+}
+
+// Tracer returns the tracer of a package of the service.
+func Tracer(name string) trace.Tracer {
+	return global.Tracer(name)
+}
+
+// Inject adds the trace context of ctx to a carrier of string key-value pairs,
+// such as the headers of an outgoing HTTP request or Kafka message.
+func Inject(ctx context.Context, carrier propagation.HTTPSupplier) {
+	propagation.InjectHTTP(ctx, global.Propagators(), carrier)
+}
+
+// End ends a span, recording an error on it if the stage it measured failed.
+func End(ctx context.Context, span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(ctx, err, trace.WithErrorStatus(codes.Unknown))
+	}
+	span.End()
+}
@@ -0,0 +1,62 @@
+// Package tracingtest records spans in memory so that tests can check how
+// they are traced and propagated.
+package tracingtest
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/api/global"
+	export "go.opentelemetry.io/otel/sdk/export/trace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+var (
+	installOnce sync.Once
+	installed   *Recorder
+)
+
+// Recorder is a span exporter that keeps every span that ends in memory.
+type Recorder struct {
+	sync.Mutex
+	spans []*export.SpanData
+}
+
+// ExportSpan records a span that ended.
+func (r *Recorder) ExportSpan(ctx context.Context, span *export.SpanData) {
+	r.Lock()
+	defer r.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+// Spans returns the spans with a name that have ended so far.
+func (r *Recorder) Spans(name string) []*export.SpanData {
+	r.Lock()
+	defer r.Unlock()
+	spans := []*export.SpanData{}
+	for _, span := range r.spans {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// Install sets the global trace provider to one that samples every span and
+// records it. Tracers that were created before only switch to the first
+// provider that is set, so it is installed once and shared by every test of a
+// package.
+func Install() *Recorder {
+	installOnce.Do(func() {
+		installed = &Recorder{}
+		provider, err := sdktrace.NewProvider(
+			sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
+			sdktrace.WithSyncer(installed),
+		)
+		if err != nil {
+			panic(err)
+		}
+		global.SetTraceProvider(provider)
+	})
+	return installed
+}
@@ -2,21 +2,28 @@ package websockets
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"os"
 	"patches/kafka"
+	"patches/metrics"
 	"patches/models"
+	"patches/protocol"
+	"patches/tracing"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	gorillaws "github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.uber.org/zap"
 )
 
 const (
@@ -30,10 +37,16 @@ var (
 	etherHost    = os.Getenv("PATCHES_ETHER_SERVER")
 )
 
-// ConvoData represents a conversation and its associated clients.
+// ConvoData represents a conversation and its associated clients. holds counts
+// the callers that use the conversation without being its clients. A
+// conversation without clients or holds is kept warm from idleSince until its
+// idle timer fires.
 type ConvoData struct {
 	conversation *Conversation
 	clients      map[*Client]bool
+	holds        int
+	idleSince    time.Time
+	idle         *time.Timer
 }
 
 // Broker is the single entrypoint for registering and unregistering all
@@ -41,72 +54,276 @@ type ConvoData struct {
 type Broker struct {
 	sync.Mutex
 	active      map[int64]*ConvoData
+	starting    map[int64]*startup
 	db          models.Datastore
 	httpClient  *http.Client
-	kafkaWriter *kafka.Writer
+	kafkaWriter kafka.Publisher
+	logger      *zap.Logger
+
+	// ctx is the context that every conversation is started in, which is
+	// canceled once the Broker shuts down.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// connections counts the WebSocket connections that have been started,
+	// which identifies each connection in logs.
+	connections int64
+
+	// probe is the health check that is waiting to lock the Broker, if any.
+	probeMu sync.Mutex
+	probe   *brokerProbe
 }
 
 // NewBroker creates a new Broker struct.
-func NewBroker(db models.Datastore, httpClient *http.Client, kafkaWriter *kafka.Writer) *Broker {
+func NewBroker(
+	db models.Datastore,
+	httpClient *http.Client,
+	kafkaWriter kafka.Publisher,
+	logger *zap.Logger,
+) *Broker {
+	logInvalidSettings(logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Broker{
 		active:      make(map[int64]*ConvoData),
+		starting:    make(map[int64]*startup),
 		db:          db,
 		httpClient:  httpClient,
 		kafkaWriter: kafkaWriter,
+		logger:      logger,
+		ctx:         ctx,
+		cancel:      cancel,
 	}
 }
 
-// register adds a client connection to an active conversation.
-func (b *Broker) register(member *models.UserConversationMapping, conn *gorillaws.Conn) (*Client, error) {
-	b.Lock()
-	defer b.Unlock()
+var (
+	// ErrForbidden is returned when a user is not allowed to perform an action
+	// in a conversation.
+	ErrForbidden = errors.New("User is not allowed to perform this action")
 
-	cd, ok := b.active[member.ConversationID]
-	if !ok {
-		// If this is the first client connection in this conversation, then get
-		// the HTML content and create a new Conversation struct to manage the
-		// conversation
-		content, err := b.getConversationContent(member.UserID, member.ConversationID)
-		if err != nil {
-			return nil, err
-		}
+	// ErrInvalidRevert is returned when a revert does not specify which
+	// patches should be reverted.
+	ErrInvalidRevert = errors.New("Revert must specify a version range or a user")
 
-		cd = &ConvoData{
-			conversation: NewConversation(member.ConversationID, content, b.db, b.kafkaWriter),
-			clients:      make(map[*Client]bool),
-		}
-		go cd.conversation.Run()
-		b.active[member.ConversationID] = cd
+	// ErrShuttingDown is returned when a conversation is needed after the
+	// Broker has started shutting down.
+	ErrShuttingDown = errors.New("Broker is shutting down")
+)
+
+// deactivate shuts down an active conversation. The Broker must be locked by
+// the caller.
+func (b *Broker) deactivate(conversationID int64, cd *ConvoData) {
+	b.use(cd)
+	delete(b.active, conversationID)
+	cd.conversation.Stop()
+	metrics.ActiveConversations.Dec()
+}
+
+// register adds a client connection to an active conversation.
+func (b *Broker) register(
+	ctx context.Context,
+	member *models.UserConversationMapping,
+	hs *handshake,
+	conn *gorillaws.Conn,
+	compress bool,
+	logger *zap.Logger,
+) (*Client, error) {
+	cd, err := b.activate(ctx, member)
+	if err != nil {
+		return nil, err
 	}
 
-	client := NewClient(member.UserID, member.ConversationID, conn, b, cd.conversation.broadcast)
+	client := NewClient(member, hs, conn, compress, b, cd.conversation, logger)
+	err = cd.conversation.Register(client)
+
+	b.Lock()
+	defer b.Unlock()
+	cd.holds--
+	if err != nil {
+		b.release(member.ConversationID, cd)
+		return nil, err
+	}
 	cd.clients[client] = true
-	cd.conversation.register <- client
 	return client, nil
 }
 
-// unregister removes a client connection from its associated conversation.
+// unregister removes a client connection from its associated conversation. The
+// conversation is told without holding the Broker's lock, since it may be
+// busy, and is kept warm once its last client is gone.
 func (b *Broker) unregister(client *Client) {
+	client.conversation.Unregister(client)
+
 	b.Lock()
 	defer b.Unlock()
 
 	conversationID := client.conversationID
 	cd, ok := b.active[conversationID]
-	if ok {
-		cd.conversation.unregister <- client
-		delete(cd.clients, client)
-		if len(cd.clients) == 0 {
-			delete(b.active, conversationID)
-			close(cd.conversation.broadcast)
+	if !ok || !cd.clients[client] {
+		if b.ctx.Err() == nil {
+			client.logger.Warn("Tried to unregister a client in an inactive conversation")
 		}
-	} else {
-		log.Printf("Tried to unregister user %d in inactive conversation %d", client.userID, client.conversationID)
+		return
+	}
+
+	delete(cd.clients, client)
+	b.release(conversationID, cd)
+}
+
+// Shutdown stops every active conversation, which disconnects their clients,
+// and refuses to start new ones. It waits for the conversations to shut down
+// until ctx is done.
+func (b *Broker) Shutdown(ctx context.Context) error {
+	b.Lock()
+	b.cancel()
+	stopped := make([]chan struct{}, 0, len(b.active))
+	for conversationID, cd := range b.active {
+		stopped = append(stopped, cd.conversation.stopped)
+		if len(cd.clients) == 0 && cd.holds == 0 {
+			b.deactivate(conversationID, cd)
+		}
+	}
+	b.Unlock()
+
+	for _, done := range stopped {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// validateRevertFilter checks that a filter for patches to be reverted is
+// limited to a version range or to a user's patches.
+func validateRevertFilter(filter *models.Filter) error {
+	if filter.StartVersion == nil && filter.EndVersion == nil && len(filter.User) == 0 {
+		return ErrInvalidRevert
+	}
+	filter.Type = []string{models.PatchTypeEdit}
+	return nil
+}
+
+// Revert reverts the patches of a conversation that match a filter. The revert
+// is applied to the current content of the conversation as a new edit that is
+// made by the user, who must be an admin of the conversation. The new version
+// of the conversation and the number of reverted patches are returned.
+func (b *Broker) Revert(userID, conversationID int64, filter *models.Filter) (int, int, error) {
+	member, err := b.getConversationMember(context.Background(), userID, conversationID)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !member.Role.IsAdmin() {
+		return 0, 0, ErrForbidden
+	}
+
+	filter.Conversation = conversationID
+	if err := validateRevertFilter(filter); err != nil {
+		return 0, 0, err
+	}
+	patches, err := b.db.GetPatches(filter)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	cd, err := b.activate(context.Background(), member)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	res := cd.conversation.requestRevert(&revertRequest{userID: userID, patches: patches})
+	b.finish(conversationID, cd)
+
+	return res.version, res.reverted, res.err
+}
+
+// Comments gets the comments of a conversation along with the version that
+// their anchors are at. The comments of an active conversation are read from
+// the conversation, since their anchors move with every edit.
+func (b *Broker) Comments(conversationID int64) ([]protocol.Comment, int, error) {
+	b.Lock()
+	cd, ok := b.active[conversationID]
+	if ok {
+		b.hold(cd)
+	}
+	b.Unlock()
+
+	if ok {
+		res := cd.conversation.requestComment(&commentRequest{action: commentList})
+		b.finish(conversationID, cd)
+		return res.comments, res.version, res.err
+	}
+
+	saved, err := b.db.GetComments(conversationID)
+	if err != nil {
+		return nil, 0, err
+	}
+	version, err := b.db.GetLatestVersion(conversationID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	comments := make([]protocol.Comment, len(saved))
+	for i := range saved {
+		comments[i] = commentMessage(&saved[i])
+	}
+	return comments, version, nil
+}
+
+// Comment creates, updates or deletes a comment in a conversation on behalf of
+// a user and broadcasts the change to all connected clients. The anchor of the
+// comment is at version, or at the current version if it is nil. The comment
+// as changed is returned along with the current version of the conversation.
+func (b *Broker) Comment(
+	userID int64,
+	conversationID int64,
+	action string,
+	comment protocol.Comment,
+	version *int,
+) (protocol.Comment, int, error) {
+	if action != protocol.CommentCreate && action != protocol.CommentUpdate && action != protocol.CommentDelete {
+		return comment, 0, ErrInvalidComment
+	}
+
+	member, err := b.getConversationMember(context.Background(), userID, conversationID)
+	if err != nil {
+		return comment, 0, err
+	}
+
+	cd, err := b.activate(context.Background(), member)
+	if err != nil {
+		return comment, 0, err
 	}
+
+	res := cd.conversation.requestComment(&commentRequest{
+		userID:  userID,
+		role:    member.Role,
+		action:  action,
+		comment: comment,
+		version: version,
+	})
+	b.finish(conversationID, cd)
+
+	if res.err != nil {
+		return comment, res.version, res.err
+	}
+	return res.comments[0], res.version, nil
+}
+
+// startRequest starts a client span for an outgoing HTTP request and adds its
+// trace context to the request's headers.
+func startRequest(req *http.Request, name string) (*http.Request, trace.Span) {
+	ctx, span := tracer.Start(req.Context(), name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(kv.String("http.method", req.Method), kv.String("http.url", req.URL.String())),
+	)
+	tracing.Inject(ctx, req.Header)
+	return req.WithContext(ctx), span
 }
 
 // validate token checks with Heimdall whether a token is authentic and returns
 // the embedded user ID if it is.
-func (b *Broker) validateToken(token string) (int64, error) {
+func (b *Broker) validateToken(ctx context.Context, token string) (userID int64, err error) {
 	reqBody, err := json.Marshal(map[string]string{
 		"token": token,
 	})
@@ -114,11 +331,15 @@ func (b *Broker) validateToken(token string) (int64, error) {
 		return -1, err
 	}
 
-	res, err := b.httpClient.Post(
-		"http://"+heimdallHost+authRoute,
-		"application/json",
-		bytes.NewBuffer(reqBody),
-	)
+	req, err := http.NewRequest("POST", "http://"+heimdallHost+authRoute, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req, span := startRequest(req.WithContext(ctx), "heimdall.validate_token")
+	defer func() { tracing.End(req.Context(), span, err) }()
+
+	res, err := b.httpClient.Do(req)
 	if err != nil {
 		return -1, err
 	}
@@ -140,12 +361,19 @@ func (b *Broker) validateToken(token string) (int64, error) {
 	return resBody.UserID, nil
 }
 
-func (b *Broker) getConversationMember(userID, conversationID int64) (*models.UserConversationMapping, error) {
+func (b *Broker) getConversationMember(
+	ctx context.Context,
+	userID int64,
+	conversationID int64,
+) (member *models.UserConversationMapping, err error) {
 	req, err := http.NewRequest("GET", "http://"+etherHost+fmt.Sprintf(memberRoute, conversationID, userID), nil)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("User-ID", strconv.FormatInt(userID, 10))
+	req, span := startRequest(req.WithContext(ctx), "ether.get_member")
+	defer func() { tracing.End(req.Context(), span, err) }()
+
 	res, err := b.httpClient.Do(req)
 	if err != nil {
 		return nil, err
@@ -167,12 +395,15 @@ func (b *Broker) getConversationMember(userID, conversationID int64) (*models.Us
 }
 
 // getConversationContent gets the HTML content of a conversation from Ether.
-func (b *Broker) getConversationContent(userID, conversationID int64) (string, error) {
+func (b *Broker) getConversationContent(ctx context.Context, userID, conversationID int64) (content string, err error) {
 	req, err := http.NewRequest("GET", "http://"+etherHost+fmt.Sprintf(contentRoute, conversationID), nil)
 	if err != nil {
 		return "", err
 	}
 	req.Header.Set("User-ID", strconv.FormatInt(userID, 10))
+	req, span := startRequest(req.WithContext(ctx), "ether.get_content")
+	defer func() { tracing.End(req.Context(), span, err) }()
+
 	res, err := b.httpClient.Do(req)
 	if err != nil {
 		return "", err
@@ -185,38 +416,70 @@ func (b *Broker) getConversationContent(userID, conversationID int64) (string, e
 	}
 
 	defer res.Body.Close()
-	content, err := ioutil.ReadAll(res.Body)
+	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
 		return "", err
 	}
 
-	return string(content), nil
+	return string(body), nil
 }
 
 // StartClient authenticates a WebSocket connection before registering the
 // connection and starting goroutines for reading to and writing from the
+// connection. compress is whether permessage-deflate was negotiated for the
 // connection.
-func (b *Broker) StartClient(conversationID int64, conn *gorillaws.Conn) {
-	// Wait for client to send token through the WebSocket connection
+func (b *Broker) StartClient(conversationID int64, conn *gorillaws.Conn, compress bool) {
+	logger := b.logger.With(
+		zap.Int64("conversation_id", conversationID),
+		zap.Int64("connection_id", atomic.AddInt64(&b.connections, 1)),
+	)
+
+	ctx, span := tracer.Start(context.Background(), "websocket.handshake",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(kv.Int64("conversation_id", conversationID)),
+	)
+	defer span.End()
+	outcome := func(result string) {
+		metrics.Handshakes.WithLabelValues(result).Inc()
+		span.SetAttributes(kv.String("handshake.outcome", result))
+	}
+
+	// Wait for client to send a Hello message or a bare token through the
+	// WebSocket connection
 	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 	_, message, err := conn.ReadMessage()
 	if err != nil {
 		netErr, ok := err.(net.Error)
 		if ok && netErr.Timeout() {
-			log.Print("Timed out waiting for a token from the client")
+			logger.Info("Timed out waiting for a token from the client")
+			outcome(metrics.HandshakeTimeout)
+		} else {
+			outcome(metrics.HandshakeReadFailed)
 		}
 		if gorillaws.IsUnexpectedCloseError(err, gorillaws.CloseGoingAway, gorillaws.CloseAbnormalClosure) {
-			log.Printf("WebSocket closed unexpectedly: %v", err)
+			logger.Warn("WebSocket closed unexpectedly", zap.Error(err))
 		}
 		conn.Close()
 		return
 	}
 
+	hs, err := parseHandshake(message, protocol.CodecFor(conn.Subprotocol()))
+	if err != nil {
+		logger.Info("Failed to read handshake", zap.Error(err))
+		outcome(metrics.HandshakeInvalid)
+		conn.WriteMessage(
+			gorillaws.CloseMessage,
+			gorillaws.FormatCloseMessage(gorillaws.CloseProtocolError, "Failed to read handshake"),
+		)
+		conn.Close()
+		return
+	}
+
 	// Verify with Heimdall that the token is authentic
-	token := string(message)
-	userID, err := b.validateToken(token)
+	userID, err := b.validateToken(ctx, hs.token)
 	if err != nil {
-		log.Print("Failed to validate token: ", err)
+		logger.Info("Failed to validate token", zap.Error(err))
+		outcome(metrics.HandshakeInvalidToken)
 		conn.WriteMessage(
 			gorillaws.CloseMessage,
 			gorillaws.FormatCloseMessage(gorillaws.CloseGoingAway, "Failed to validate token"),
@@ -225,14 +488,10 @@ func (b *Broker) StartClient(conversationID int64, conn *gorillaws.Conn) {
 		return
 	}
 
-	member, err := b.getConversationMember(userID, conversationID)
+	member, err := b.getConversationMember(ctx, userID, conversationID)
 	if err != nil {
-		log.Printf(
-			"Failed to validate conversation member (user: %d, conversation: %d): %v",
-			userID,
-			conversationID,
-			err,
-		)
+		logger.Info("Failed to validate conversation member", zap.Int64("user_id", userID), zap.Error(err))
+		outcome(metrics.HandshakeNotMember)
 		conn.WriteMessage(
 			gorillaws.CloseMessage,
 			gorillaws.FormatCloseMessage(gorillaws.CloseGoingAway, "Failed to conversation member"),
@@ -241,17 +500,34 @@ func (b *Broker) StartClient(conversationID int64, conn *gorillaws.Conn) {
 		return
 	}
 
-	// Create client struct with the user ID and start reading/writing patches
-	client, err := b.register(member, conn)
+	logger = logger.With(zap.Int64("user_id", userID))
+	if compress {
+		if err := conn.SetCompressionLevel(compressionLevel); err != nil {
+			logger.Warn("Invalid compression level", zap.Error(err))
+		}
+	}
+
+	// Create client struct with the user ID and start reading/writing patches.
+	// A client that disconnects while the conversation starts stops waiting
+	ctx, cancel, first := watch(ctx, conn)
+	defer cancel()
+	client, err := b.register(ctx, member, hs, conn, compress, logger)
 	if err != nil {
-		log.Printf("Failed to create a new client (user: %d, conversation: %d): %v", userID, conversationID, err)
+		logger.Error("Failed to create a new client", zap.Error(err))
+		outcome(metrics.HandshakeRegisterFailed)
+		closeText := "Failed to get conversation content"
+		if err == ErrShuttingDown || err == ErrConversationClosed {
+			closeText = "Server is shutting down"
+		}
 		conn.WriteMessage(
 			gorillaws.CloseMessage,
-			gorillaws.FormatCloseMessage(gorillaws.CloseGoingAway, "Failed to get conversation content"),
+			gorillaws.FormatCloseMessage(gorillaws.CloseGoingAway, closeText),
 		)
 		conn.Close()
 		return
 	}
+	outcome(metrics.HandshakeOK)
+	client.first = first
 	go client.write()
 	go client.read()
 }
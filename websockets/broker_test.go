@@ -0,0 +1,44 @@
+package websockets
+
+import (
+	"context"
+	"net/http"
+	"patches/tracing/tracingtest"
+	"strings"
+	"testing"
+)
+
+func TestRequestTraceContext(t *testing.T) {
+	recorder := tracingtest.Install()
+
+	traceparents := make(chan string, 1)
+	b, stop := newEtherBroker(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparents <- r.Header.Get("traceparent")
+		w.Write([]byte("hello"))
+	}))
+	defer stop()
+
+	ctx, parent := tracer.Start(context.Background(), "connect")
+	if _, err := b.getConversationContent(ctx, 1, 1); err != nil {
+		t.Fatalf("Failed to get content: %v", err)
+	}
+	parent.End()
+
+	// The request is traced by a child of the caller's span, whose trace
+	// context is sent to Ether
+	parentContext := parent.SpanContext()
+	for _, span := range recorder.Spans("ether.get_content") {
+		if span.ParentSpanID != parentContext.SpanID {
+			continue
+		}
+		if span.SpanContext.TraceID != parentContext.TraceID {
+			t.Fatalf("Expected the request to be traced in trace %s, got %s", parentContext.TraceID, span.SpanContext.TraceID)
+		}
+		traceparent := <-traceparents
+		if want := "00-" + parentContext.TraceID.String() + "-" + span.SpanContext.SpanID.String() + "-"; !strings.HasPrefix(traceparent, want) {
+			t.Fatalf("Expected traceparent %s for the request's span, got %q", want, traceparent)
+		}
+		return
+	}
+	t.Fatalf("Expected a span for the request")
+}
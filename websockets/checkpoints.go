@@ -0,0 +1,127 @@
+package websockets
+
+import (
+	"patches/metrics"
+	"patches/protocol"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// maxCheckpoints is the most versions that a conversation keeps checkpoints
+	// for. Clients that hold up the oldest checkpoint once the limit is
+	// exceeded have fallen behind. It must be at least 2, since clients are
+	// otherwise behind as soon as a new version is made.
+	maxCheckpoints = envIntAtLeast("PATCHES_MAX_CHECKPOINTS", 1000, 2)
+
+	// checkpointExpiry is how long clients have to sync to a version before
+	// they have fallen behind. It must be at least a second, since every
+	// client otherwise falls behind on each collection.
+	checkpointExpiry = time.Duration(envIntAtLeast("PATCHES_CHECKPOINT_EXPIRY_S", 60, 1)) * time.Second
+
+	// checkpointInterval is how often conversations look for clients whose
+	// checkpoints have expired.
+	checkpointInterval = time.Second
+)
+
+// maxForcedResyncs is how many times in a row a client that keeps falling
+// behind is resynced before it is disconnected instead.
+const maxForcedResyncs = 3
+
+// addCheckpoint keeps the checkpoint of a version.
+func (c *Conversation) addCheckpoint(version int, checkpoint *Checkpoint) {
+	if _, ok := c.checkpoint[version]; !ok {
+		metrics.RetainedCheckpoints.Inc()
+	}
+	c.checkpoint[version] = checkpoint
+}
+
+// deleteCheckpoint removes the checkpoint of a version if it is kept.
+func (c *Conversation) deleteCheckpoint(version int) {
+	if _, ok := c.checkpoint[version]; ok {
+		delete(c.checkpoint, version)
+		metrics.RetainedCheckpoints.Dec()
+	}
+}
+
+// pruneCheckpoints removes the checkpoints of versions that no session can
+// still be at. A session that hasn't synced to a version may still be at the
+// version before it, so every checkpoint from there on is kept.
+func (c *Conversation) pruneCheckpoints() {
+	oldest := c.version
+	for version, checkpoint := range c.checkpoint {
+		if len(checkpoint.syncsLeft) > 0 && version-1 < oldest {
+			oldest = version - 1
+		}
+	}
+	for version := range c.checkpoint {
+		if version < oldest {
+			c.deleteCheckpoint(version)
+		}
+	}
+}
+
+// collectCheckpoints catches up the clients that have fallen behind, which are
+// those holding up a checkpoint that has expired or that makes the
+// conversation keep more than maxCheckpoints, and removes the checkpoints that
+// are no longer needed.
+func (c *Conversation) collectCheckpoints(now time.Time) error {
+	lagging := make(map[int64]bool)
+	oldest := now
+	for version, checkpoint := range c.checkpoint {
+		if checkpoint.created.Before(oldest) {
+			oldest = checkpoint.created
+		}
+		if len(checkpoint.syncsLeft) == 0 {
+			continue
+		}
+
+		// The checkpoint of the version before is kept as well
+		retained := c.version - version + 2
+		if retained <= maxCheckpoints && now.Sub(checkpoint.created) < checkpointExpiry {
+			continue
+		}
+		for sessionID := range checkpoint.syncsLeft {
+			lagging[sessionID] = true
+		}
+	}
+	metrics.CheckpointWindow.Observe(now.Sub(oldest).Seconds())
+
+	for client := range c.clients {
+		if lagging[client.sessionID] {
+			if err := c.catchUp(client); err != nil {
+				return err
+			}
+		}
+	}
+
+	c.pruneCheckpoints()
+	return nil
+}
+
+// catchUp resyncs a client that has fallen behind, so that it no longer holds
+// up the checkpoints of the versions it hasn't synced to. Clients that can't
+// be resynced, or that keep falling behind, are disconnected instead.
+func (c *Conversation) catchUp(client *Client) error {
+	client.forcedResyncs++
+	if client.protocolVersion < protocol.ProtocolV8 || client.forcedResyncs > maxForcedResyncs {
+		metrics.LaggingClients.WithLabelValues(metrics.LaggingDisconnected).Inc()
+		client.logger.Warn(
+			"Disconnecting client that fell behind on syncing",
+			zap.Int("version", c.version),
+			zap.Int("forced_resyncs", client.forcedResyncs-1),
+		)
+		client.closeCode = closeLagging
+		client.closeText = "Too far behind on syncing"
+		return c.unregisterClient(client)
+	}
+
+	metrics.LaggingClients.WithLabelValues(metrics.LaggingResynced).Inc()
+	client.logger.Warn(
+		"Resyncing client that fell behind on syncing",
+		zap.Int("version", c.version),
+		zap.Int("forced_resyncs", client.forcedResyncs),
+	)
+	return c.resync(client)
+}
@@ -0,0 +1,185 @@
+package websockets
+
+import (
+	"context"
+	"patches/metrics"
+	"patches/protocol"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// inspectConversation reads the state of a running conversation.
+func inspectConversation(c *Conversation) *ConversationState {
+	result := make(chan *ConversationState, 1)
+	c.inspection <- &inspectRequest{result: result}
+	return <-result
+}
+
+// closed waits for a test client to be unregistered, returning false if it
+// isn't before the timeout.
+func closed(messages <-chan protocol.Message, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case _, ok := <-messages:
+			if !ok {
+				return true
+			}
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+func TestCheckpointLimit(t *testing.T) {
+	defer func(limit int) { maxCheckpoints = limit }(maxCheckpoints)
+	maxCheckpoints = 5
+
+	c, stop := newTestConversation("")
+	defer stop()
+
+	// Neither the client that can be resynced nor the one that can't ever
+	// syncs
+	sender := newTestClient(1, c)
+	receive(t, sender)
+	lagging := newTestClient(2, c)
+	laggingMessages := receive(t, lagging)
+	legacy := newVersionedTestClient(3, protocol.ProtocolV7, c)
+	legacyMessages := receive(t, legacy)
+	if _, ok := next(laggingMessages, protocol.TypeInit, time.Second); !ok {
+		t.Fatal("Expected Init message")
+	}
+
+	resynced := testutil.ToFloat64(metrics.LaggingClients.WithLabelValues(metrics.LaggingResynced))
+	disconnected := testutil.ToFloat64(metrics.LaggingClients.WithLabelValues(metrics.LaggingDisconnected))
+
+	doc := ""
+	for i := 1; i <= 8; i++ {
+		newDoc := doc + "a"
+		c.broadcast <- &BroadcastMessage{editMessage(t, doc, newDoc, i), sender, context.Background()}
+		doc = newDoc
+
+		if retained := len(inspectConversation(c).Checkpoints); retained > maxCheckpoints {
+			t.Fatalf("Expected at most %d checkpoints after edit %d, got %d", maxCheckpoints, i, retained)
+		}
+	}
+
+	resync, ok := next(laggingMessages, protocol.TypeInit, time.Second)
+	if !ok || *resync.Data.Content != strings.Repeat("a", *resync.Data.Version) {
+		t.Fatalf("Expected lagging client to be resynced, got %+v", resync.Data)
+	}
+	if !closed(legacyMessages, time.Second) || legacy.closeCode != closeLagging {
+		t.Fatalf("Expected client that can't be resynced to be disconnected with code %d", closeLagging)
+	}
+
+	state := inspectConversation(c)
+	if len(state.Clients) != 2 {
+		t.Errorf("Expected the sender and the resynced client to stay connected, got %+v", state.Clients)
+	}
+	if diff := testutil.ToFloat64(metrics.LaggingClients.WithLabelValues(metrics.LaggingResynced)) - resynced; diff != 1 {
+		t.Errorf("Expected 1 client to be counted as resynced, got %v", diff)
+	}
+	if diff := testutil.ToFloat64(metrics.LaggingClients.WithLabelValues(metrics.LaggingDisconnected)) - disconnected; diff != 1 {
+		t.Errorf("Expected 1 client to be counted as disconnected, got %v", diff)
+	}
+}
+
+func TestCheckpointExpiry(t *testing.T) {
+	defer func(expiry, interval time.Duration) {
+		checkpointExpiry = expiry
+		checkpointInterval = interval
+	}(checkpointExpiry, checkpointInterval)
+	checkpointExpiry = 20 * time.Millisecond
+	checkpointInterval = 5 * time.Millisecond
+
+	c, stop := newTestConversation("")
+	defer stop()
+
+	sender := newTestClient(1, c)
+	receive(t, sender)
+	lagging := newTestClient(2, c)
+	laggingMessages := receive(t, lagging)
+	if _, ok := next(laggingMessages, protocol.TypeInit, time.Second); !ok {
+		t.Fatal("Expected Init message")
+	}
+
+	// The client is resynced every time one of its checkpoints expires, until
+	// it has been resynced too many times
+	doc := ""
+	for i := 1; i <= maxForcedResyncs; i++ {
+		newDoc := doc + "a"
+		c.broadcast <- &BroadcastMessage{editMessage(t, doc, newDoc, i), sender, context.Background()}
+		doc = newDoc
+
+		resync, ok := next(laggingMessages, protocol.TypeInit, time.Second)
+		if !ok || *resync.Data.Version != i {
+			t.Fatalf("Expected lagging client to be resynced to version %d, got %+v", i, resync.Data)
+		}
+		if checkpoints := inspectConversation(c).Checkpoints; len(checkpoints) != 1 || checkpoints[0].Version != i {
+			t.Fatalf("Expected only the checkpoint of version %d to be kept, got %+v", i, checkpoints)
+		}
+	}
+
+	c.broadcast <- &BroadcastMessage{editMessage(t, doc, doc+"a", maxForcedResyncs+1), sender, context.Background()}
+	if !closed(laggingMessages, time.Second) || lagging.closeCode != closeLagging {
+		t.Fatalf("Expected client that keeps falling behind to be disconnected with code %d", closeLagging)
+	}
+	if checkpoints := inspectConversation(c).Checkpoints; len(checkpoints) != 1 {
+		t.Errorf("Expected the checkpoints of the disconnected client to be removed, got %+v", checkpoints)
+	}
+}
+
+func TestForcedResyncsReset(t *testing.T) {
+	defer func(expiry, interval time.Duration) {
+		checkpointExpiry = expiry
+		checkpointInterval = interval
+	}(checkpointExpiry, checkpointInterval)
+	checkpointExpiry = 100 * time.Millisecond
+	checkpointInterval = 5 * time.Millisecond
+
+	c, stop := newTestConversation("")
+	defer stop()
+
+	sender := newTestClient(1, c)
+	receive(t, sender)
+	lagging := newTestClient(2, c)
+	laggingMessages := receive(t, lagging)
+	if _, ok := next(laggingMessages, protocol.TypeInit, time.Second); !ok {
+		t.Fatal("Expected Init message")
+	}
+
+	doc := ""
+	edit := func(version int) {
+		newDoc := doc + "a"
+		c.broadcast <- &BroadcastMessage{editMessage(t, doc, newDoc, version), sender, context.Background()}
+		doc = newDoc
+	}
+	expectResync := func(version int) {
+		resync, ok := next(laggingMessages, protocol.TypeInit, time.Second)
+		if !ok || *resync.Data.Version != version {
+			t.Fatalf("Expected lagging client to be resynced to version %d, got %+v", version, resync.Data)
+		}
+	}
+
+	version := 0
+	for i := 0; i < maxForcedResyncs; i++ {
+		version++
+		edit(version)
+		expectResync(version)
+	}
+
+	// Once the client syncs on its own again, it may fall behind as many
+	// times as before
+	version++
+	edit(version)
+	c.broadcast <- &BroadcastMessage{syncMessage(t, version), lagging, context.Background()}
+	version++
+	edit(version)
+	expectResync(version)
+	if state := inspectConversation(c); len(state.Clients) != 2 {
+		t.Errorf("Expected the client that synced to stay connected, got %+v", state.Clients)
+	}
+}
@@ -1,11 +1,16 @@
 package websockets
 
 import (
-	"log"
+	"context"
+	"patches/models"
 	"patches/protocol"
+	"sync"
 	"time"
 
 	gorillaws "github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.uber.org/zap"
 )
 
 const (
@@ -17,62 +22,201 @@ const (
 
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
+
+	// Maximum number of messages queued to be written to the peer.
+	sendQueueSize = 256
+
+	// Number of queued messages above which cursor updates are dropped
+	// instead of being queued.
+	cursorDropThreshold = sendQueueSize / 2
+
+	// Close code sent to a peer that is disconnected for not keeping up with
+	// the messages queued for it.
+	closeSlowConsumer = 4001
+
+	// Close code sent to a peer that is disconnected for not syncing to the
+	// versions of the conversation.
+	closeLagging = 4002
 )
 
+// outgoing is an encoded message that is queued to be written to a client.
+// The prepared message is shared by all receivers of a broadcast so that the
+// message is only framed and compressed once.
+type outgoing struct {
+	prepared *gorillaws.PreparedMessage
+	data     []byte
+
+	compressOnce   sync.Once
+	compressedSize int
+}
+
+// compressed estimates the size of the message once compressed, which is only
+// computed once for all receivers that sample it.
+func (out *outgoing) compressed() int {
+	out.compressOnce.Do(func() {
+		out.compressedSize = compressedSize(out.data)
+	})
+	return out.compressedSize
+}
+
 // Client manages a WebSocket connection with a client.
 type Client struct {
-	userID         int64
-	conversationID int64
-	caret          protocol.Caret
-	conn           *gorillaws.Conn
-	broker         *Broker
-	broadcast      chan<- *BroadcastMessage
-	send           chan []byte
+	userID          int64
+	sessionID       int64
+	conversationID  int64
+	role            models.Role
+	nickname        *string
+	color           string
+	presence        protocol.Presence
+	lastActive      time.Time
+	lastTyped       time.Time
+	buckets         map[string]*tokenBucket
+	selection       protocol.Selection
+	protocolVersion int
+	capabilities    map[string]bool
+	clientID        string
+	codec           protocol.Codec
+	conn            *gorillaws.Conn
+	broker          *Broker
+	conversation    *Conversation
+	send            chan *outgoing
+	closeCode       int
+	closeText       string
+	forcedResyncs   int
+	compress        bool
+	first           <-chan received
+	logger          *zap.Logger
+}
+
+// received is a message read from a WebSocket connection, or the error that
+// ended the connection.
+type received struct {
+	data []byte
+	err  error
 }
 
-// NewClient creates a new Client struct.
+// watch starts reading a WebSocket connection while its client waits to be
+// registered, so that the returned context is canceled once the connection
+// closes, or once it sends nothing for pongWait. The message that is read is
+// handed to the client's read loop through the returned channel.
+func watch(ctx context.Context, conn *gorillaws.Conn) (context.Context, context.CancelFunc, <-chan received) {
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(ctx)
+	first := make(chan received, 1)
+	go func() {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			cancel()
+		}
+		first <- received{data, err}
+	}()
+	return ctx, cancel, first
+}
+
+// NewClient creates a new Client struct for a member of a conversation, which
+// the client's messages are sent to. The logger should identify the client's
+// connection.
 func NewClient(
-	userID int64,
-	conversationID int64,
+	member *models.UserConversationMapping,
+	hs *handshake,
 	conn *gorillaws.Conn,
+	compress bool,
 	broker *Broker,
-	broadcast chan<- *BroadcastMessage,
+	conversation *Conversation,
+	logger *zap.Logger,
 ) *Client {
+	if hs.clientID != "" {
+		logger = logger.With(zap.String("client_id", hs.clientID))
+	}
 	return &Client{
-		userID:         userID,
-		conversationID: conversationID,
-		caret:          protocol.Caret{Start: 0, End: 0},
-		conn:           conn,
-		broadcast:      broadcast,
-		broker:         broker,
-		send:           make(chan []byte),
+		userID:          member.UserID,
+		conversationID:  member.ConversationID,
+		role:            member.Role,
+		nickname:        member.Nickname,
+		color:           colorFor(member.ConversationID, member.UserID),
+		presence:        protocol.PresenceActive,
+		lastActive:      time.Now(),
+		buckets:         make(map[string]*tokenBucket),
+		selection:       protocol.Selection{protocol.Caret{}},
+		protocolVersion: hs.protocolVersion,
+		capabilities:    hs.capabilities,
+		clientID:        hs.clientID,
+		codec:           hs.codec,
+		conn:            conn,
+		broker:          broker,
+		conversation:    conversation,
+		send:            make(chan *outgoing, sendQueueSize),
+		closeCode:       gorillaws.CloseGoingAway,
+		closeText:       "Going away",
+		compress:        compress,
+		logger:          logger.With(zap.Int("protocol_version", hs.protocolVersion)),
+	}
+}
+
+// enqueue queues a message to be written to the client without blocking. Cursor
+// updates are dropped once the queue starts filling up, and false is returned
+// if the queue is full.
+func (c *Client) enqueue(out *outgoing, droppable bool) bool {
+	if droppable && len(c.send) >= cursorDropThreshold {
+		return true
+	}
+
+	select {
+	case c.send <- out:
+		return true
+	default:
+		return false
 	}
 }
 
 // read consumes messages from the WebSocket connection and sends them to the
-// associated conversation to be broadcast.
+// associated conversation to be broadcast, until the connection is closed or
+// the conversation shuts down. The connection is already being watched.
 func (c *Client) read() {
 	defer func() {
 		c.conn.Close()
 		c.broker.unregister(c)
 	}()
 
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
-		return nil
-	})
 	for {
-		_, data, err := c.conn.ReadMessage()
+		data, err := c.next()
 		if err != nil {
 			if gorillaws.IsUnexpectedCloseError(err, gorillaws.CloseGoingAway, gorillaws.CloseAbnormalClosure) {
-				log.Printf("WebSocket closed unexpectedly: %v", err)
+				c.logger.Warn("WebSocket closed unexpectedly", zap.Error(err))
 			}
 			break
 		}
 
-		c.broadcast <- &BroadcastMessage{data, c}
+		// Each message starts a new trace. Its span ends once the
+		// conversation has received the message, while processing it is
+		// traced by a child span
+		ctx, span := tracer.Start(context.Background(), "websocket.message",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(kv.Int64("user_id", c.userID), kv.Int("message.size", len(data))),
+		)
+		submitted := c.conversation.submit(&BroadcastMessage{data, c, ctx})
+		span.End()
+		if !submitted {
+			break
+		}
+	}
+}
+
+// next reads the next message from the WebSocket connection, starting with the
+// one that was read while the client waited to be registered.
+func (c *Client) next() ([]byte, error) {
+	if c.first != nil {
+		r := <-c.first
+		c.first = nil
+		return r.data, r.err
 	}
+	_, data, err := c.conn.ReadMessage()
+	return data, err
 }
 
 // write sends messages to the WebSocket connection whenever new messages are
@@ -91,21 +235,28 @@ func (c *Client) write() {
 			if !ok {
 				c.conn.WriteMessage(
 					gorillaws.CloseMessage,
-					gorillaws.FormatCloseMessage(gorillaws.CloseGoingAway, "Going away"),
+					gorillaws.FormatCloseMessage(c.closeCode, c.closeText),
 				)
 				return
 			}
 
-			err := c.conn.WriteMessage(gorillaws.TextMessage, message)
+			// Only compress messages that are big enough to benefit from it
+			compress := c.compress && len(message.data) >= compressionThreshold
+			c.conn.EnableWriteCompression(compress)
+			if compress {
+				c.conversation.compression.add(message)
+			}
+
+			err := c.conn.WritePreparedMessage(message.prepared)
 			if err != nil {
-				log.Print("Failed to write message to WebSocket: ", err)
+				c.logger.Warn("Failed to write message to WebSocket", zap.Error(err))
 				return
 			}
 
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(gorillaws.PingMessage, nil); err != nil {
-				log.Print("Failed to write ping message to WebSocket: ", err)
+				c.logger.Warn("Failed to write ping message to WebSocket", zap.Error(err))
 				return
 			}
 		}
@@ -0,0 +1,602 @@
+package websockets
+
+import (
+	"errors"
+	"fmt"
+	"patches/document"
+	"patches/models"
+	"patches/protocol"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxCommentSize is the largest size in bytes of the body of a comment.
+const maxCommentSize = 8192
+
+// commentList is the action of requests for every comment of a conversation,
+// which clients learn from Init messages instead.
+const commentList = "list"
+
+var (
+	// ErrCommentNotFound is returned when a comment doesn't exist in a
+	// conversation.
+	ErrCommentNotFound = errors.New("Comment not found")
+
+	// ErrInvalidComment is returned when a comment or a change to it is
+	// malformed, or its anchor is outside of the document.
+	ErrInvalidComment = errors.New("Comment is invalid")
+)
+
+// commentRequest stores a change that a user wants to make to the comments of
+// a conversation and where the outcome should be reported to, if anywhere.
+// The anchor of the comment is at version, or at the current version if it is
+// nil.
+type commentRequest struct {
+	userID  int64
+	role    models.Role
+	action  string
+	comment protocol.Comment
+	version *int
+	result  chan<- commentResult
+}
+
+// commentResult stores the outcome of a commentRequest, with the comments that
+// were changed or listed and the version that their anchors are at.
+type commentResult struct {
+	comments []protocol.Comment
+	version  int
+	err      error
+}
+
+// commentWrite is a change to a comment that is being saved to the database
+// off the Run loop. The comment is applied to the conversation once it has been
+// saved, and its anchor is shifted around the edits made in the meantime. id
+// and err are set by the save before it is handed back to the Run loop.
+type commentWrite struct {
+	req     *commentRequest
+	comment *models.Comment
+	shifted bool
+	id      int64
+	err     error
+}
+
+// commentMessage converts a comment into how it is sent to clients. Replies
+// don't have anchors.
+func commentMessage(comment *models.Comment) protocol.Comment {
+	body := comment.Body
+	resolved := comment.Resolved
+	createdAt := comment.CreatedAt
+	updatedAt := comment.UpdatedAt
+	msg := protocol.Comment{
+		ID:        comment.ID,
+		UserID:    comment.UserID,
+		ParentID:  comment.ParentID,
+		Body:      &body,
+		Resolved:  &resolved,
+		Orphaned:  comment.Orphaned,
+		CreatedAt: &createdAt,
+		UpdatedAt: &updatedAt,
+	}
+	if comment.ParentID == nil {
+		msg.Anchor = &protocol.Caret{Start: comment.Start, End: comment.End}
+	}
+	return msg
+}
+
+// loadComments reads the comments of the conversation from the database. Each
+// anchor was saved at the version of its comment, so anchors that were saved
+// before the current version are rebased through the patches persisted since.
+// Comments whose anchors can't be rebased are orphaned.
+func (c *Conversation) loadComments() {
+	comments, err := c.db.GetComments(c.conversationID)
+	if err != nil {
+		c.logger.Error("Failed to load comments", zap.Error(err))
+		return
+	}
+
+	stale := []*models.Comment{}
+	for i := range comments {
+		comment := &comments[i]
+		c.comments[comment.ID] = comment
+		if comment.ParentID == nil && comment.Version != c.version {
+			stale = append(stale, comment)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+
+	if err := c.rebaseComments(stale); err != nil {
+		c.logger.Warn("Failed to rebase comment anchors. Orphaning comments", zap.Int("comments", len(stale)), zap.Error(err))
+		for _, comment := range stale {
+			comment.Orphaned = true
+		}
+	}
+	for _, comment := range stale {
+		c.commentsDirty[comment.ID] = true
+	}
+}
+
+// rebaseComments shifts the anchors of comments that were saved at earlier
+// versions to the current version by replaying the patches persisted since
+// the latest snapshot before the oldest of them. Anchors that are collapsed by
+// the patches are orphaned.
+func (c *Conversation) rebaseComments(comments []*models.Comment) error {
+	oldest := c.version
+	for _, comment := range comments {
+		if comment.Version > c.version {
+			return fmt.Errorf("comment %d is at version %d, which is ahead of the conversation", comment.ID, comment.Version)
+		}
+		if comment.Version < oldest {
+			oldest = comment.Version
+		}
+	}
+
+	snapshot, err := c.db.GetSnapshot(&models.Filter{Conversation: c.conversationID, EndVersion: &oldest})
+	if err != nil {
+		return err
+	}
+	if snapshot == nil {
+		return fmt.Errorf("no snapshot at or before version %d", oldest)
+	}
+	start := snapshot.Version + 1
+	patches, err := c.db.GetPatches(&models.Filter{
+		Conversation: c.conversationID,
+		Type:         []string{models.PatchTypeEdit},
+		StartVersion: &start,
+		EndVersion:   &c.version,
+	})
+	if err != nil {
+		return err
+	}
+
+	doc := snapshot.Content
+	version := snapshot.Version
+	anchors := make([]protocol.Caret, len(comments))
+	for i, comment := range comments {
+		anchors[i] = protocol.Caret{Start: comment.Start, End: comment.End}
+	}
+	for _, patch := range patches {
+		if patch.ConvoID != c.conversationID || patch.Version <= version || patch.Version > c.version {
+			continue
+		}
+		if patch.Version != version+1 {
+			return fmt.Errorf("patch for version %d is missing", version+1)
+		}
+
+		newDoc, err := document.ApplyPatch(doc, patch.Patch)
+		if err != nil {
+			return fmt.Errorf("failed to apply patch for version %d: %v", patch.Version, err)
+		}
+		start, end, inserted := document.Change(doc, newDoc)
+		caret, delta := editDelta(start, end, len([]rune(inserted)))
+		for i, comment := range comments {
+			if comment.Version < patch.Version {
+				anchors[i] = anchors[i].ShiftCaret(caret, delta)
+			}
+		}
+		doc = newDoc
+		version = patch.Version
+	}
+	if version != c.version {
+		return fmt.Errorf("patches end at version %d instead of %d", version, c.version)
+	}
+
+	for i, comment := range comments {
+		comment.Start = anchors[i].Start
+		comment.End = anchors[i].End
+		if anchors[i].Start >= anchors[i].End {
+			comment.Orphaned = true
+		}
+	}
+	return nil
+}
+
+// saveComments persists the comments whose anchors have been shifted since
+// they were last saved, without blocking the Run loop. The returned WaitGroup
+// is done once they have all been saved.
+func (c *Conversation) saveComments() *sync.WaitGroup {
+	var wg sync.WaitGroup
+	for id := range c.commentsDirty {
+		// The change being saved would be overwritten, so the comment is saved
+		// again once it has been applied
+		if c.commentSaving != nil && c.commentSaving.comment.ID == id {
+			continue
+		}
+		delete(c.commentsDirty, id)
+		comment, ok := c.comments[id]
+		if !ok {
+			continue
+		}
+
+		saved := *comment
+		saved.Version = c.version
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.db.UpdateComment(&saved); err != nil {
+				c.logger.Error(
+					"Failed to save comment",
+					zap.Int64("comment_id", saved.ID),
+					zap.Int("version", saved.Version),
+					zap.Error(err),
+				)
+			}
+		}()
+	}
+	return &wg
+}
+
+// commentList returns every comment of the conversation in the order that
+// they were created.
+func (c *Conversation) commentList() []protocol.Comment {
+	ids := make([]int64, 0, len(c.comments))
+	for id := range c.comments {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	comments := make([]protocol.Comment, len(ids))
+	for i, id := range ids {
+		comments[i] = commentMessage(c.comments[id])
+	}
+	return comments
+}
+
+// broadcastComment sends a Comment message to all clients, including the one
+// that made the change, since only the server knows the IDs of comments.
+func (c *Conversation) broadcastComment(action string, comment protocol.Comment) error {
+	msg := protocol.Message{
+		Type: protocol.TypeComment,
+		Data: protocol.InnerData{
+			Action:  &action,
+			Comment: &comment,
+			Version: &c.version,
+		},
+	}
+	return c.broadcastMessage(msg, nil)
+}
+
+// shiftComments shifts the anchor of every comment around an edit like a
+// receiver's caret. Comments whose anchors are collapsed by the edit, because
+// the text they were anchored to was deleted, are orphaned and broadcast. The
+// conversation must already be at the edit's version.
+func (c *Conversation) shiftComments(senderCaret protocol.Caret, delta protocol.Delta) error {
+	now := time.Now()
+	for id, comment := range c.comments {
+		if comment.ParentID != nil {
+			continue
+		}
+
+		anchor := protocol.Caret{Start: comment.Start, End: comment.End}
+		shifted := anchor.ShiftCaret(senderCaret, delta)
+		if shifted == anchor {
+			continue
+		}
+		comment.Start = shifted.Start
+		comment.End = shifted.End
+		c.commentsDirty[id] = true
+
+		if !comment.Orphaned && shifted.Start >= shifted.End {
+			comment.Orphaned = true
+			comment.UpdatedAt = now
+			if err := c.broadcastComment(protocol.CommentUpdate, commentMessage(comment)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The comment being saved is only broadcast once it has been applied
+	if write := c.commentSaving; write != nil && write.req.action != protocol.CommentDelete && write.comment.ParentID == nil {
+		anchor := protocol.Caret{Start: write.comment.Start, End: write.comment.End}
+		shifted := anchor.ShiftCaret(senderCaret, delta)
+		if shifted != anchor {
+			write.comment.Start = shifted.Start
+			write.comment.End = shifted.End
+			write.shifted = true
+			if shifted.Start >= shifted.End {
+				write.comment.Orphaned = true
+			}
+		}
+	}
+
+	return nil
+}
+
+// rebaseAnchor shifts an anchor at a version to the current version through
+// the checkpoints of the versions in between, and checks that it is a range of
+// the current document.
+func (c *Conversation) rebaseAnchor(anchor protocol.Caret, version int) (protocol.Caret, error) {
+	if version > c.version {
+		c.logger.Debug("Comment anchor is ahead of the conversation", zap.Int("version", c.version), zap.Int("anchor_version", version))
+		return anchor, ErrInvalidComment
+	}
+	for v := version + 1; v <= c.version; v++ {
+		checkpoint, ok := c.checkpoint[v]
+		if !ok {
+			c.logger.Debug(
+				"Comment anchor is at a version that is no longer checkpointed",
+				zap.Int("version", c.version),
+				zap.Int("anchor_version", version),
+			)
+			return anchor, ErrInvalidComment
+		}
+		anchor = anchor.ShiftCaret(checkpoint.senderCaret, checkpoint.delta)
+	}
+
+	if anchor.Start < 0 || anchor.Start >= anchor.End || anchor.End > len([]rune(c.doc)) {
+		c.logger.Debug(
+			"Comment anchor is not a range of the document",
+			zap.Int("version", c.version),
+			zap.Int("anchor_start", anchor.Start),
+			zap.Int("anchor_end", anchor.End),
+		)
+		return anchor, ErrInvalidComment
+	}
+	anchor.Name = ""
+	return anchor, nil
+}
+
+// validCommentBody reports whether a comment body may be saved.
+func validCommentBody(body *string) bool {
+	return body != nil && *body != "" && len(*body) <= maxCommentSize
+}
+
+// handleComment makes the change to the comments of the conversation that a
+// user requested, or lists them. Changes are saved to the database off the Run
+// loop one at a time, and are applied and broadcast once they have been saved,
+// which is when their outcome is reported. Changes requested while another is
+// being saved are queued. Changes that are rejected are reported right away,
+// and their error is returned.
+func (c *Conversation) handleComment(req *commentRequest) error {
+	if req.action == commentList {
+		c.replyComment(req, commentResult{comments: c.commentList(), version: c.version})
+		return nil
+	}
+	if c.commentSaving != nil {
+		c.commentQueue = append(c.commentQueue, req)
+		return nil
+	}
+
+	var write *commentWrite
+	var err error
+	switch req.action {
+	case protocol.CommentCreate:
+		write, err = c.createComment(req)
+	case protocol.CommentUpdate:
+		write, err = c.updateComment(req)
+	case protocol.CommentDelete:
+		write, err = c.deleteComment(req)
+	default:
+		err = ErrInvalidComment
+	}
+	if err != nil {
+		c.replyComment(req, commentResult{version: c.version, err: err})
+		return err
+	}
+	c.commentSaving = write
+	return nil
+}
+
+// saveComment starts saving a change to a comment to the database and hands it
+// back to the Run loop once it has been saved. The save gets a copy of the
+// comment, since the Run loop keeps shifting its anchor.
+func (c *Conversation) saveComment(req *commentRequest, comment *models.Comment, save func(*models.Comment) error) *commentWrite {
+	write := &commentWrite{req: req, comment: comment}
+	saved := *comment
+	go func() {
+		write.err = save(&saved)
+		write.id = saved.ID
+		c.commentSaved <- write
+	}()
+	return write
+}
+
+// applyComment applies a change to a comment that has finished saving,
+// broadcasts it and reports its outcome, and then starts the queued changes.
+func (c *Conversation) applyComment(write *commentWrite) {
+	c.commentSaving = nil
+	c.replyComment(write.req, c.commitComment(write))
+
+	for c.commentSaving == nil && len(c.commentQueue) > 0 {
+		req := c.commentQueue[0]
+		c.commentQueue = c.commentQueue[1:]
+		if err := c.handleComment(req); err != nil {
+			c.logger.Info("Ignored comment change", zap.Int64("user_id", req.userID), zap.String("action", req.action), zap.Error(err))
+		}
+	}
+}
+
+// commitComment makes a saved change to a comment in the conversation and
+// broadcasts it.
+func (c *Conversation) commitComment(write *commentWrite) commentResult {
+	req, comment := write.req, write.comment
+	if write.err != nil {
+		c.logger.Error("Failed to save comment", zap.Int64("user_id", req.userID), zap.String("action", req.action), zap.Error(write.err))
+		return commentResult{version: c.version, err: write.err}
+	}
+
+	msg := protocol.Comment{ID: comment.ID}
+	switch req.action {
+	case protocol.CommentCreate:
+		comment.ID = write.id
+		c.comments[comment.ID] = comment
+		c.logger.Info("User added comment", zap.Int64("user_id", req.userID), zap.Int64("comment_id", comment.ID), zap.Int("version", c.version))
+		msg = commentMessage(comment)
+	case protocol.CommentUpdate:
+		existing := c.comments[comment.ID]
+		*existing = *comment
+		delete(c.commentsDirty, existing.ID)
+		msg = commentMessage(existing)
+	case protocol.CommentDelete:
+		for id, reply := range c.comments {
+			if id == comment.ID || (reply.ParentID != nil && *reply.ParentID == comment.ID) {
+				delete(c.comments, id)
+				delete(c.commentsDirty, id)
+			}
+		}
+		c.logger.Info("User deleted comment", zap.Int64("user_id", req.userID), zap.Int64("comment_id", comment.ID))
+	}
+
+	// The anchor was shifted after the comment was saved, so it is saved again
+	if write.shifted {
+		c.commentsDirty[comment.ID] = true
+	}
+
+	if err := c.broadcastComment(req.action, msg); err != nil {
+		c.logger.Error("Failed to broadcast comment", zap.Int64("comment_id", comment.ID), zap.Error(err))
+		return commentResult{version: c.version, err: err}
+	}
+	return commentResult{comments: []protocol.Comment{msg}, version: c.version}
+}
+
+// replyComment reports the outcome of a commentRequest, if it is wanted.
+func (c *Conversation) replyComment(req *commentRequest, result commentResult) {
+	if req.result != nil {
+		req.result <- result
+	}
+}
+
+// createComment adds a comment that is anchored to a range of the document, or
+// a reply to a comment if a parent is given. Replies to replies are added to
+// the thread of the comment they reply to.
+func (c *Conversation) createComment(req *commentRequest) (*commentWrite, error) {
+	in := req.comment
+	if !validCommentBody(in.Body) {
+		return nil, ErrInvalidComment
+	}
+
+	now := time.Now()
+	comment := &models.Comment{
+		ConvoID:   c.conversationID,
+		UserID:    req.userID,
+		Version:   c.version,
+		Body:      *in.Body,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	if in.ParentID != nil {
+		parent, ok := c.comments[*in.ParentID]
+		if !ok {
+			return nil, ErrCommentNotFound
+		}
+		if parent.ParentID != nil {
+			parent = c.comments[*parent.ParentID]
+		}
+		parentID := parent.ID
+		comment.ParentID = &parentID
+	} else {
+		if in.Anchor == nil {
+			return nil, ErrInvalidComment
+		}
+		version := c.version
+		if req.version != nil {
+			version = *req.version
+		}
+		anchor, err := c.rebaseAnchor(*in.Anchor, version)
+		if err != nil {
+			return nil, err
+		}
+		comment.Start = anchor.Start
+		comment.End = anchor.End
+	}
+
+	return c.saveComment(req, comment, c.db.CreateComment), nil
+}
+
+// updateComment changes the fields of a comment that are given. Only the
+// author of a comment may change its body or move its anchor, which also
+// restores orphaned comments, while any user may resolve or reopen a thread.
+func (c *Conversation) updateComment(req *commentRequest) (*commentWrite, error) {
+	in := req.comment
+	existing, ok := c.comments[in.ID]
+	if !ok {
+		return nil, ErrCommentNotFound
+	}
+	if in.Body == nil && in.Anchor == nil && in.Resolved == nil {
+		return nil, ErrInvalidComment
+	}
+
+	updated := *existing
+	if in.Body != nil || in.Anchor != nil {
+		if existing.UserID != req.userID {
+			return nil, ErrForbidden
+		}
+	}
+	if in.Body != nil {
+		if !validCommentBody(in.Body) {
+			return nil, ErrInvalidComment
+		}
+		updated.Body = *in.Body
+	}
+	if in.Anchor != nil {
+		if existing.ParentID != nil {
+			return nil, ErrInvalidComment
+		}
+		version := c.version
+		if req.version != nil {
+			version = *req.version
+		}
+		anchor, err := c.rebaseAnchor(*in.Anchor, version)
+		if err != nil {
+			return nil, err
+		}
+		updated.Start = anchor.Start
+		updated.End = anchor.End
+		updated.Orphaned = false
+	}
+	if in.Resolved != nil {
+		if existing.ParentID != nil {
+			return nil, ErrInvalidComment
+		}
+		updated.Resolved = *in.Resolved
+	}
+	updated.Version = c.version
+	updated.UpdatedAt = time.Now()
+
+	return c.saveComment(req, &updated, c.db.UpdateComment), nil
+}
+
+// deleteComment removes a comment along with its replies. Only the author of a
+// comment or an admin of the conversation may delete it.
+func (c *Conversation) deleteComment(req *commentRequest) (*commentWrite, error) {
+	in := req.comment
+	existing, ok := c.comments[in.ID]
+	if !ok {
+		return nil, ErrCommentNotFound
+	}
+	if existing.UserID != req.userID && !req.role.IsAdmin() {
+		return nil, ErrForbidden
+	}
+
+	return c.saveComment(req, existing, func(comment *models.Comment) error {
+		return c.db.DeleteComment(comment.ConvoID, comment.ID)
+	}), nil
+}
+
+// handleCommentMessage processes a Comment message from a client. Changes that
+// the sender isn't allowed to make or that are invalid are ignored, and changes
+// that fail to be saved are only logged.
+func (c *Conversation) handleCommentMessage(msg protocol.Message, sender *Client) error {
+	data := msg.Data
+
+	if data.Action == nil || data.Comment == nil || *data.Action == commentList {
+		return fmt.Errorf(`comment is missing required fields in "data"`)
+	}
+
+	err := c.handleComment(&commentRequest{
+		userID:  sender.userID,
+		role:    sender.role,
+		action:  *data.Action,
+		comment: *data.Comment,
+		version: data.Version,
+	})
+	if err != nil {
+		sender.logger.Info("Ignored comment change", zap.String("action", *data.Action), zap.Error(err))
+	}
+	return nil
+}
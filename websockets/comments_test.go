@@ -0,0 +1,253 @@
+package websockets
+
+import (
+	"context"
+	"encoding/json"
+	"patches/document"
+	"patches/models"
+	"patches/protocol"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// commentChange encodes a Comment message that makes a change to a comment.
+func commentChange(t *testing.T, action string, comment protocol.Comment, version int) []byte {
+	msg := protocol.Message{
+		Type: protocol.TypeComment,
+		Data: protocol.InnerData{
+			Action:  &action,
+			Comment: &comment,
+			Version: &version,
+		},
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Failed to encode comment: %v", err)
+	}
+	return data
+}
+
+// listComments gets the comments of a conversation from its Run loop.
+func listComments(c *Conversation) []protocol.Comment {
+	result := make(chan commentResult, 1)
+	c.comment <- &commentRequest{action: commentList, result: result}
+	return (<-result).comments
+}
+
+func TestComments(t *testing.T) {
+	c, stop := newTestConversation("hello world")
+	defer stop()
+
+	author := newTestClient(1, c)
+	authorMessages := receive(t, author)
+	other := newTestClient(2, c)
+	messages := receive(t, other)
+
+	// nextComment waits for the next Comment message that both clients get
+	nextComment := func() protocol.Message {
+		if _, ok := next(authorMessages, protocol.TypeComment, time.Second); !ok {
+			t.Fatal("Expected the author to get a comment")
+		}
+		msg, ok := next(messages, protocol.TypeComment, time.Second)
+		if !ok {
+			t.Fatal("Expected a comment")
+		}
+		return msg
+	}
+
+	body := "Greet everyone?"
+	anchor := protocol.Caret{Start: 6, End: 11}
+	c.broadcast <- &BroadcastMessage{commentChange(t, protocol.CommentCreate, protocol.Comment{Anchor: &anchor, Body: &body}, 0), author, context.Background()}
+	msg := nextComment()
+	comment := *msg.Data.Comment
+	if *msg.Data.Action != protocol.CommentCreate || comment.ID == 0 || comment.UserID != 1 || *comment.Anchor != anchor {
+		t.Fatalf("Expected comment by user 1 anchored to %+v, got %+v", anchor, comment)
+	}
+
+	reply := "Sure"
+	parentID := comment.ID
+	c.broadcast <- &BroadcastMessage{commentChange(t, protocol.CommentCreate, protocol.Comment{ParentID: &parentID, Body: &reply}, 0), other, context.Background()}
+	msg = nextComment()
+	if msg.Data.Comment.ParentID == nil || *msg.Data.Comment.ParentID != parentID || msg.Data.Comment.Anchor != nil {
+		t.Fatalf("Expected reply to comment %d, got %+v", parentID, msg.Data.Comment)
+	}
+
+	// Only the author may change the body of a comment
+	changed := "Greet nobody"
+	c.broadcast <- &BroadcastMessage{commentChange(t, protocol.CommentUpdate, protocol.Comment{ID: parentID, Body: &changed}, 0), other, context.Background()}
+
+	// Anchors shift around edits
+	updateType := protocol.UpdateTypeEdit
+	edit := func(doc, newDoc string, version, caretStart, caretEnd, docDelta int) {
+		patch := document.MakePatch(doc, newDoc)
+		data, err := json.Marshal(protocol.Message{
+			Type: protocol.TypeUpdate,
+			Data: protocol.InnerData{
+				Type:    &updateType,
+				Version: &version,
+				Patch:   &patch,
+				Delta:   &protocol.Delta{CaretStart: &caretStart, CaretEnd: &caretEnd, Doc: &docDelta},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Failed to encode edit: %v", err)
+		}
+		c.broadcast <- &BroadcastMessage{data, author, context.Background()}
+	}
+	edit("hello world", "abhello world", 1, 2, 2, 2)
+	comments := listComments(c)
+	if len(comments) != 2 || *comments[0].Anchor != (protocol.Caret{Start: 8, End: 13}) || *comments[0].Body != body {
+		t.Fatalf("Expected comment anchored to (8, 13) with its reply, got %+v", comments)
+	}
+
+	// Deleting the anchored text orphans the comment
+	updateType = protocol.UpdateTypeCursor
+	version := 1
+	selection := protocol.Selection{{Start: 8, End: 13}}
+	data, err := json.Marshal(protocol.Message{
+		Type: protocol.TypeUpdate,
+		Data: protocol.InnerData{Type: &updateType, Version: &version, Selection: &selection},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode cursor update: %v", err)
+	}
+	c.broadcast <- &BroadcastMessage{data, author, context.Background()}
+	updateType = protocol.UpdateTypeEdit
+	edit("abhello world", "abhello ", 2, 0, -5, -5)
+	msg = nextComment()
+	if *msg.Data.Action != protocol.CommentUpdate || !msg.Data.Comment.Orphaned || *msg.Data.Version != 2 {
+		t.Fatalf("Expected comment to be orphaned at version 2, got %+v", msg.Data)
+	}
+
+	// Only the author or an admin may delete a comment, along with its replies
+	c.broadcast <- &BroadcastMessage{commentChange(t, protocol.CommentDelete, protocol.Comment{ID: parentID}, 2), other, context.Background()}
+	if comments := listComments(c); len(comments) != 2 {
+		t.Fatalf("Expected comment to be kept, got %+v", comments)
+	}
+	c.broadcast <- &BroadcastMessage{commentChange(t, protocol.CommentDelete, protocol.Comment{ID: parentID}, 2), author, context.Background()}
+	msg = nextComment()
+	if *msg.Data.Action != protocol.CommentDelete || msg.Data.Comment.ID != parentID {
+		t.Fatalf("Expected comment %d to be deleted, got %+v", parentID, msg.Data)
+	}
+	if comments := listComments(c); len(comments) != 0 {
+		t.Fatalf("Expected no comments, got %+v", comments)
+	}
+}
+
+func TestLoadComments(t *testing.T) {
+	db := &testDatastore{
+		snapshots: []models.Snapshot{{ConvoID: 1, Version: 0, Content: "hello world"}},
+		patches: []models.Patch{
+			{ConvoID: 1, Version: 1, Type: models.PatchTypeEdit, Patch: document.MakePatch("hello world", "abhello world")},
+			{ConvoID: 1, Version: 2, Type: models.PatchTypeEdit, Patch: document.MakePatch("abhello world", "abhelloworld")},
+		},
+		comments: []models.Comment{
+			{ID: 1, ConvoID: 1, Version: 0, Start: 0, End: 5},
+			{ID: 2, ConvoID: 1, Version: 1, Start: 8, End: 13},
+			{ID: 3, ConvoID: 1, Version: 2, Start: 2, End: 7},
+		},
+	}
+	c := NewConversation(context.Background(), 1, "abhelloworld", 2, db, &testPublisher{}, zap.NewNop())
+	go c.Run()
+	defer func() {
+		c.Stop()
+		<-c.stopped
+	}()
+
+	// Anchors saved at earlier versions are rebased through the patches since
+	anchors := make(map[int64]protocol.Caret)
+	for _, comment := range listComments(c) {
+		if comment.Orphaned {
+			t.Fatalf("Expected comment %d not to be orphaned", comment.ID)
+		}
+		anchors[comment.ID] = *comment.Anchor
+	}
+	expected := map[int64]protocol.Caret{
+		1: {Start: 2, End: 7},
+		2: {Start: 7, End: 12},
+		3: {Start: 2, End: 7},
+	}
+	for id, anchor := range expected {
+		if anchors[id] != anchor {
+			t.Fatalf("Expected comment %d anchored to %+v, got %+v", id, anchor, anchors[id])
+		}
+	}
+}
+
+func TestLoadCommentsWithoutPatches(t *testing.T) {
+	db := &testDatastore{
+		snapshots: []models.Snapshot{{ConvoID: 1, Version: 0, Content: "hello world"}},
+		comments: []models.Comment{
+			{ID: 1, ConvoID: 1, Version: 0, Start: 0, End: 5},
+			{ID: 2, ConvoID: 1, Version: 2, Start: 2, End: 7},
+		},
+	}
+	c := NewConversation(context.Background(), 1, "abhelloworld", 2, db, &testPublisher{}, zap.NewNop())
+	go c.Run()
+	defer func() {
+		c.Stop()
+		<-c.stopped
+	}()
+
+	// Anchors that can't be rebased are orphaned, while those saved at the
+	// current version are kept
+	for _, comment := range listComments(c) {
+		if orphaned := comment.ID == 1; comment.Orphaned != orphaned {
+			t.Fatalf("Expected comment %d orphaned to be %v, got %+v", comment.ID, orphaned, comment)
+		}
+	}
+}
+
+// slowCommentStore is a testDatastore whose comments aren't created until it
+// is released.
+type slowCommentStore struct {
+	*testDatastore
+	release chan struct{}
+}
+
+func (db *slowCommentStore) CreateComment(comment *models.Comment) error {
+	<-db.release
+	return db.testDatastore.CreateComment(comment)
+}
+
+func TestSlowCommentSave(t *testing.T) {
+	db := &slowCommentStore{&testDatastore{}, make(chan struct{})}
+	c := NewConversation(context.Background(), 1, "hello world", 0, db, &testPublisher{}, zap.NewNop())
+	go c.Run()
+
+	author := newTestClient(1, c)
+	messages := receive(t, author)
+
+	body := "Greet everyone?"
+	anchor := protocol.Caret{Start: 6, End: 11}
+	c.broadcast <- &BroadcastMessage{commentChange(t, protocol.CommentCreate, protocol.Comment{Anchor: &anchor, Body: &body}, 0), author, context.Background()}
+	reply := "Sure"
+	parentID := int64(1)
+	c.broadcast <- &BroadcastMessage{commentChange(t, protocol.CommentCreate, protocol.Comment{ParentID: &parentID, Body: &reply}, 0), author, context.Background()}
+
+	// Edits are made while the comment is being saved, and its anchor is
+	// shifted around them
+	c.broadcast <- &BroadcastMessage{editMessage(t, "hello world", "abhello world", 1), author, context.Background()}
+	if state := inspectConversation(c); state.Version != 1 {
+		t.Fatalf("Expected the edit to be made while the comment is saved, got version %d", state.Version)
+	}
+	close(db.release)
+	msg, ok := next(messages, protocol.TypeComment, time.Second)
+	if !ok {
+		t.Fatal("Expected a comment")
+	}
+	if *msg.Data.Comment.Anchor != (protocol.Caret{Start: 8, End: 13}) || *msg.Data.Version != 1 {
+		t.Fatalf("Expected comment anchored to (8, 13) at version 1, got %+v", msg.Data)
+	}
+
+	// Changes requested in the meantime wait for the comment to be saved, and
+	// are finished before the conversation stops
+	c.Stop()
+	<-c.stopped
+	comments, _ := db.GetComments(1)
+	if len(comments) != 2 || comments[1].ParentID == nil || *comments[1].ParentID != parentID {
+		t.Fatalf("Expected the reply to be saved, got %+v", comments)
+	}
+}
@@ -0,0 +1,161 @@
+package websockets
+
+import (
+	"compress/flate"
+	"os"
+	"patches/metrics"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// compressionLevel is the flate compression level of messages that are
+	// sent to clients that negotiated permessage-deflate.
+	compressionLevel = envInt("PATCHES_COMPRESSION_LEVEL", flate.BestSpeed)
+
+	// compressionThreshold is the size in bytes below which messages are sent
+	// uncompressed, since compressing them isn't worth the overhead.
+	compressionThreshold = envInt("PATCHES_COMPRESSION_THRESHOLD", 1024)
+)
+
+// compressionSampleRate is how many messages sent compressed in a
+// conversation there are for each one whose compressed size is estimated,
+// since estimating it compresses the message a second time.
+const compressionSampleRate = 16
+
+// flateWriters pools writers for estimating compressed message sizes.
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, err := flate.NewWriter(nil, compressionLevel)
+		if err != nil {
+			w, _ = flate.NewWriter(nil, flate.BestSpeed)
+		}
+		return w
+	},
+}
+
+// invalidSetting is an environment variable whose value was ignored. Settings
+// are read before there is a logger, so they are logged by NewBroker.
+type invalidSetting struct {
+	name     string
+	value    string
+	fallback int
+}
+
+var invalidSettings []invalidSetting
+
+// logInvalidSettings logs the environment variables whose values were ignored.
+func logInvalidSettings(logger *zap.Logger) {
+	for _, setting := range invalidSettings {
+		logger.Warn(
+			"Invalid setting, using the default",
+			zap.String("name", setting.name),
+			zap.String("value", setting.value),
+			zap.Int("default", setting.fallback),
+		)
+	}
+}
+
+// envInt reads an integer from an environment variable, falling back to a
+// default if the variable is unset or invalid.
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		invalidSettings = append(invalidSettings, invalidSetting{name, value, fallback})
+		return fallback
+	}
+	return n
+}
+
+// envIntAtLeast reads an integer from an environment variable like envInt,
+// also falling back to the default if the value is less than min.
+func envIntAtLeast(name string, fallback, min int) int {
+	n := envInt(name, fallback)
+	if n < min {
+		invalidSettings = append(invalidSettings, invalidSetting{name, strconv.Itoa(n), fallback})
+		return fallback
+	}
+	return n
+}
+
+// atLeast returns n, or min if n is smaller.
+func atLeast(n, min int) int {
+	if n < min {
+		return min
+	}
+	return n
+}
+
+// byteCounter is a writer that only counts the bytes written to it.
+type byteCounter int
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// compressedSize estimates the size of data once compressed by
+// permessage-deflate at the configured compression level.
+func compressedSize(data []byte) int {
+	var counter byteCounter
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+
+	w.Reset(&counter)
+	w.Write(data)
+	w.Flush()
+
+	// permessage-deflate strips the 4 byte tail of the flushed block
+	return int(counter) - 4
+}
+
+// compressionStats counts the bytes of the messages in a conversation that
+// were sent compressed. Their compressed size is estimated from a sample of
+// them.
+type compressionStats struct {
+	messages          int64
+	raw               int64
+	sampledRaw        int64
+	sampledCompressed int64
+}
+
+// add records a message that was sent compressed. The compressed size of the
+// first of every compressionSampleRate messages is estimated, and the bytes it
+// saved are counted for each message it stands for.
+func (s *compressionStats) add(out *outgoing) {
+	raw := int64(len(out.data))
+	atomic.AddInt64(&s.raw, raw)
+	if (atomic.AddInt64(&s.messages, 1)-1)%compressionSampleRate != 0 {
+		return
+	}
+
+	compressed := int64(out.compressed())
+	atomic.AddInt64(&s.sampledRaw, raw)
+	atomic.AddInt64(&s.sampledCompressed, compressed)
+	if raw > compressed {
+		metrics.CompressionSavedBytes.Add(float64((raw - compressed) * compressionSampleRate))
+	}
+}
+
+// saved estimates the number of bytes that compression saved.
+func (s *compressionStats) saved() int64 {
+	raw := atomic.LoadInt64(&s.raw)
+	return raw - int64(float64(raw)*s.ratio())
+}
+
+// ratio estimates the compressed size of messages as a fraction of their raw
+// size from the sampled messages.
+func (s *compressionStats) ratio() float64 {
+	raw := atomic.LoadInt64(&s.sampledRaw)
+	if raw == 0 {
+		return 1
+	}
+	return float64(atomic.LoadInt64(&s.sampledCompressed)) / float64(raw)
+}
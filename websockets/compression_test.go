@@ -0,0 +1,64 @@
+package websockets
+
+import (
+	"os"
+	"patches/metrics"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCompressionStats(t *testing.T) {
+	data := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog. ", 100))
+	size := compressedSize(data)
+	if size <= 0 || size >= len(data)/4 {
+		t.Fatalf("Expected %d bytes to compress well, got %d", len(data), size)
+	}
+
+	out := &outgoing{data: data}
+	if out.compressed() != size || out.compressed() != size {
+		t.Errorf("Expected compressed size %d, got %d", size, out.compressed())
+	}
+
+	stats := &compressionStats{}
+	if stats.ratio() != 1 {
+		t.Errorf("Expected ratio 1 without messages, got %f", stats.ratio())
+	}
+	// Only the first of every compressionSampleRate messages is compressed
+	// again, and it stands for the others
+	counted := testutil.ToFloat64(metrics.CompressionSavedBytes)
+	sent := make([]*outgoing, 2*compressionSampleRate)
+	for i := range sent {
+		sent[i] = &outgoing{data: data}
+		stats.add(sent[i])
+	}
+	for i, out := range sent {
+		if sampled := i%compressionSampleRate == 0; sampled != (out.compressedSize != 0) {
+			t.Errorf("Expected message %d sampled to be %v", i, sampled)
+		}
+	}
+
+	want := int64(len(sent) * (len(data) - size))
+	if saved := stats.saved(); saved < want-1 || saved > want+1 {
+		t.Errorf("Expected %d bytes saved, got %d", want, saved)
+	}
+	if counted := testutil.ToFloat64(metrics.CompressionSavedBytes) - counted; counted != float64(want) {
+		t.Errorf("Expected %d bytes saved to be counted, got %f", want, counted)
+	}
+	if want := float64(size) / float64(len(data)); stats.ratio() != want {
+		t.Errorf("Expected ratio %f, got %f", want, stats.ratio())
+	}
+}
+
+func TestEnvIntAtLeast(t *testing.T) {
+	const name = "PATCHES_TEST_LIMIT"
+	defer os.Unsetenv(name)
+
+	for value, expected := range map[string]int{"": 10, "5": 5, "2": 2, "1": 10, "-3": 10, "many": 10} {
+		os.Setenv(name, value)
+		if n := envIntAtLeast(name, 10, 2); n != expected {
+			t.Errorf("Expected %q to be read as %d, got %d", value, expected, n)
+		}
+	}
+}
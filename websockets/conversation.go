@@ -1,112 +1,317 @@
 package websockets
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"log"
+	"patches/document"
 	"patches/kafka"
+	"patches/metrics"
 	"patches/models"
 	"patches/protocol"
+	"patches/tracing"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	gorillaws "github.com/gorilla/websocket"
-	"github.com/sergi/go-diff/diffmatchpatch"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.uber.org/zap"
 )
 
+// tracer traces handshakes and the processing of messages.
+var tracer = tracing.Tracer("patches/websockets")
+
+// snapshotInterval is the number of versions between persisted snapshots of a
+// conversation's content.
+const snapshotInterval = 100
+
+// cursorWindow is how long Update (CURSOR) messages from a client are
+// coalesced before its latest caret is broadcast. Cursor updates are broadcast
+// immediately if it isn't positive.
+var cursorWindow = time.Duration(envInt("PATCHES_CURSOR_WINDOW_MS", 50)) * time.Millisecond
+
+// maxSelectionRanges is the most carets that a user's selection may have.
+const maxSelectionRanges = 1000
+
 // Conversation manages all WebSocket connections in a single conversation.
 type Conversation struct {
 	conversationID int64
+	status         int32
 	doc            string
+	hash           string
 	clients        map[*Client]bool
 	version        int
 	checkpoint     map[int]*Checkpoint
-
-	register   chan *Client
+	history        map[*Client]*editHistory
+	slow           map[*Client]bool
+	compression    *compressionStats
+
+	// ephemeral configures the namespaces of Ephemeral messages that clients
+	// are known to use in the conversation.
+	ephemeral map[string]ephemeralLimit
+
+	// size is the length of the document in bytes, which is read by the
+	// Broker to estimate how much memory the conversation takes up.
+	// snapshotVersion is the version of the latest snapshot that was saved.
+	size            int64
+	snapshotVersion int
+
+	// cursors stores the selections of clients as last broadcast to the rest of
+	// the conversation, shifted to the current version. Clients whose
+	// selection has changed since are pending until the cursor window elapses.
+	cursors        map[*Client]protocol.Selection
+	cursorsPending map[*Client]bool
+	cursorFlush    <-chan time.Time
+
+	// userPresence stores the presence of each user as last broadcast, which
+	// is that of the user's most active session.
+	userPresence map[int64]protocol.Presence
+	sessions     int64
+
+	// comments stores the comments of the conversation with their anchors
+	// shifted to the current version. Comments whose anchors have been shifted
+	// since they were saved are dirty.
+	comments      map[int64]*models.Comment
+	commentsDirty map[int64]bool
+
+	// commentSaving is the change to a comment that is being saved to the
+	// database, if any. Changes requested in the meantime wait in commentQueue
+	// so that each is made against the comments as the previous one left them.
+	commentSaving *commentWrite
+	commentQueue  []*commentRequest
+	commentSaved  chan *commentWrite
+
+	register   chan *registerRequest
 	unregister chan *Client
 	broadcast  chan *BroadcastMessage
+	revert     chan *revertRequest
+	comment    chan *commentRequest
+	inspection chan *inspectRequest
 	errc       chan error
 
+	// pings receives channels that are closed as soon as the conversation gets
+	// to them, which shows that it isn't stuck. stopped is closed once the
+	// conversation has shut down.
+	pings   chan chan struct{}
+	stopped chan struct{}
+
+	// ctx is done once the conversation should shut down. Its channels are
+	// never closed, so anything sent to the conversation from another
+	// goroutine must give up once ctx is done.
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	db          models.Datastore
-	kafkaWriter *kafka.Writer
+	kafkaWriter kafka.Publisher
+	logger      *zap.Logger
 }
 
 // BroadcastMessage stores the content and sender of a WebSocket message that is
-// meant to be broadcasted to all other clients in a conversation.
+// meant to be broadcasted to all other clients in a conversation, along with
+// the trace context that it was received in.
 type BroadcastMessage struct {
 	content []byte
 	sender  *Client
+	ctx     context.Context
 }
 
-// Checkpoint stores active users' carets for a version, the caret position of
-// the sender and the delta of the patch that brought the conversation to this
-// version, and the outstanding Sync's for the version.
-type Checkpoint struct {
-	activeUsers map[int64]protocol.Caret
-	senderCaret protocol.Caret
-	delta       protocol.Delta
-	syncsLeft   map[int64]bool
+// revertRequest stores the patches that a user wants reverted and where the
+// outcome should be reported to, if anywhere.
+type revertRequest struct {
+	userID  int64
+	patches []models.Patch
+	result  chan<- revertResult
 }
 
-var dmp *diffmatchpatch.DiffMatchPatch = diffmatchpatch.New()
+// revertResult stores the outcome of a revertRequest.
+type revertResult struct {
+	version  int
+	reverted int
+	err      error
+}
 
-// NewConversation creates a new Conversation struct.
+// Checkpoint stores the selections of active sessions for a version, the caret
+// position of the sender and the delta of the patch that brought the
+// conversation to this version, the hash of the document at the version, when
+// the version was created, and the sessions with outstanding Sync's for the
+// version.
+type Checkpoint struct {
+	activeSessions map[int64]protocol.Selection
+	senderCaret    protocol.Caret
+	delta          protocol.Delta
+	hash           string
+	created        time.Time
+	syncsLeft      map[int64]bool
+}
+
+// NewConversation creates a new Conversation struct starting at the given
+// version. The conversation shuts down once ctx is done or it is stopped.
 func NewConversation(
+	ctx context.Context,
 	conversationID int64,
 	doc string,
+	version int,
 	db models.Datastore,
-	kafkaWriter *kafka.Writer,
+	kafkaWriter kafka.Publisher,
+	logger *zap.Logger,
 ) *Conversation {
+	hash := document.Hash(doc)
+	ctx, cancel := context.WithCancel(ctx)
 	return &Conversation{
 		conversationID: conversationID,
 		doc:            doc,
+		hash:           hash,
+		size:           int64(len(doc)),
 		clients:        make(map[*Client]bool),
-		version:        0,
+		version:        version,
 		checkpoint: map[int]*Checkpoint{
-			0: &Checkpoint{
-				activeUsers: make(map[int64]protocol.Caret),
-				syncsLeft:   make(map[int64]bool),
+			version: &Checkpoint{
+				activeSessions: make(map[int64]protocol.Selection),
+				hash:           hash,
+				created:        time.Now(),
+				syncsLeft:      make(map[int64]bool),
 			},
 		},
-		register:    make(chan *Client),
-		unregister:  make(chan *Client),
-		broadcast:   make(chan *BroadcastMessage),
-		errc:        make(chan error),
-		db:          db,
-		kafkaWriter: kafkaWriter,
+		history:        make(map[*Client]*editHistory),
+		slow:           make(map[*Client]bool),
+		compression:    &compressionStats{},
+		ephemeral:      ephemeralLimits,
+		cursors:        make(map[*Client]protocol.Selection),
+		cursorsPending: make(map[*Client]bool),
+		userPresence:   make(map[int64]protocol.Presence),
+		comments:       make(map[int64]*models.Comment),
+		commentsDirty:  make(map[int64]bool),
+		commentSaved:   make(chan *commentWrite),
+		register:       make(chan *registerRequest),
+		unregister:     make(chan *Client),
+		broadcast:      make(chan *BroadcastMessage),
+		revert:         make(chan *revertRequest),
+		comment:        make(chan *commentRequest),
+		inspection:     make(chan *inspectRequest),
+		errc:           make(chan error),
+		pings:          make(chan chan struct{}),
+		stopped:        make(chan struct{}),
+		ctx:            ctx,
+		cancel:         cancel,
+		db:             db,
+		kafkaWriter:    kafkaWriter,
+		logger:         logger.With(zap.Int64("conversation_id", conversationID)),
 	}
 }
 
 // sendMessage sends a message to a single receiving client.
 func (c *Conversation) sendMessage(msg protocol.Message, receiver *Client) error {
-	messageBytes, err := json.Marshal(msg)
+	out, err := prepareMessage(msg, encoding{receiver.protocolVersion, receiver.codec})
 	if err != nil {
 		return err
 	}
 
-	receiver.send <- messageBytes
+	if out != nil && !receiver.enqueue(out, c.isDroppable(msg)) {
+		c.slow[receiver] = true
+	}
 
 	return nil
 }
 
-// broadcastMessage sends a message to all clients except a specified sender.
-func (c *Conversation) broadcastMessage(msg protocol.Message, sender *Client) error {
-	broadcastMessageBytes, err := json.Marshal(msg)
+// encoding identifies how a message is encoded for a client.
+type encoding struct {
+	protocolVersion int
+	codec           protocol.Codec
+}
+
+// prepareMessage encodes a message and prepares it to be written to any number
+// of clients that use an encoding. Nil is returned if clients using the
+// encoding don't understand the message.
+func prepareMessage(msg protocol.Message, e encoding) (*outgoing, error) {
+	data, err := protocol.Encode(msg, e.protocolVersion, e.codec)
+	if err != nil || data == nil {
+		return nil, err
+	}
+
+	frameType := gorillaws.TextMessage
+	if e.codec.Binary() {
+		frameType = gorillaws.BinaryMessage
+	}
+	prepared, err := gorillaws.NewPreparedMessage(frameType, data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	return &outgoing{prepared: prepared, data: data}, nil
+}
+
+// isDroppable reports whether a message may be dropped for a client that is
+// falling behind, which is only the case for cursor updates and Ephemeral
+// messages of droppable namespaces, such as pointer positions.
+func (c *Conversation) isDroppable(msg protocol.Message) bool {
+	if msg.Type == protocol.TypeEphemeral {
+		return msg.Data.Namespace != nil && c.limitFor(*msg.Data.Namespace).droppable
+	}
+	return msg.Type == protocol.TypeUpdate &&
+		msg.Data.Type != nil &&
+		*msg.Data.Type == protocol.UpdateTypeCursor
+}
+
+// broadcastMessage sends a message to all clients except a specified sender.
+func (c *Conversation) broadcastMessage(msg protocol.Message, sender *Client) error {
+	return c.broadcastWhere(msg, func(client *Client) bool {
+		return client != sender
+	})
+}
+
+// broadcastWhere sends a message to the clients that include returns true for.
+// The message is encoded and prepared once for each protocol version and codec
+// in use.
+func (c *Conversation) broadcastWhere(msg protocol.Message, include func(*Client) bool) error {
+	droppable := c.isDroppable(msg)
+	prepared := make(map[encoding]*outgoing)
 	for client := range c.clients {
-		if client != sender {
-			client.send <- broadcastMessageBytes
+		if !include(client) {
+			continue
+		}
+
+		e := encoding{client.protocolVersion, client.codec}
+		out, ok := prepared[e]
+		if !ok {
+			var err error
+			out, err = prepareMessage(msg, e)
+			if err != nil {
+				return err
+			}
+			prepared[e] = out
+		}
+
+		if out != nil && !client.enqueue(out, droppable) {
+			c.slow[client] = true
 		}
 	}
 
 	return nil
 }
 
+// dropSlowClients disconnects the clients whose queues were full when a message
+// was sent to them, so that they don't hold up the rest of the conversation.
+func (c *Conversation) dropSlowClients() {
+	for len(c.slow) > 0 {
+		for client := range c.slow {
+			delete(c.slow, client)
+			client.logger.Warn("Disconnecting slow client", zap.Int("version", c.version))
+			client.closeCode = closeSlowConsumer
+			client.closeText = "Too slow to keep up"
+			if err := c.unregisterClient(client); err != nil {
+				client.logger.Error("Error occured while unregistering slow client", zap.Error(err))
+			}
+		}
+	}
+}
+
 // handleEditUpdate processes an Update message of subtype Edit and broadcasts
 // it out to all clients in the conversation that aren't the sender.
-func (c *Conversation) handleEditUpdate(msg protocol.Message, sender *Client) error {
+func (c *Conversation) handleEditUpdate(ctx context.Context, msg protocol.Message, sender *Client) error {
+	defer prometheus.NewTimer(metrics.EditDuration).ObserveDuration()
+
 	update := msg.Data
 
 	if update.Type == nil || update.Version == nil || update.Patch == nil || update.Delta == nil {
@@ -121,18 +326,20 @@ func (c *Conversation) handleEditUpdate(msg protocol.Message, sender *Client) er
 		return fmt.Errorf("update (EDIT) has invalid version number %d", update.Version)
 	}
 
-	patches, err := dmp.PatchFromText(*update.Patch)
-	if err != nil {
-		return err
-	}
-	if len(patches) != 1 {
+	newDoc, err := document.ApplyPatch(c.doc, *update.Patch)
+	if err == document.ErrPatchCount {
+		metrics.InvalidPatches.Inc()
 		return fmt.Errorf("update (EDIT) must contain one patch")
-	}
-
-	newDoc, okList := dmp.PatchApply(patches, c.doc)
-	if !okList[0] {
-		log.Println("Received invalid patch. Will not be broadcasted or acknowledged.")
+	} else if err == document.ErrPatchFailed {
+		metrics.InvalidPatches.Inc()
+		sender.logger.Warn(
+			"Received invalid patch. Will not be broadcasted or acknowledged.",
+			zap.Int("version", c.version),
+			zap.Int("update_version", *update.Version),
+		)
 		return nil
+	} else if err != nil {
+		return err
 	}
 
 	if *msg.Data.Version != c.version+1 {
@@ -141,108 +348,452 @@ func (c *Conversation) handleEditUpdate(msg protocol.Message, sender *Client) er
 
 	// Broadcast Update (EDIT) message to all existing clients
 	msg.Data.UserID = &sender.userID
+	msg.Data.SessionID = &sender.sessionID
 	if err := c.broadcastMessage(msg, sender); err != nil {
 		return err
 	}
 
-	// Publish Update (EDIT) message to Kafka topic
-	go func() {
-		if err := c.kafkaWriter.PublishUpdate(msg, c.conversationID); err != nil {
-			c.errc <- err
-		}
-	}()
-
-	// TODO: Write relevant Update (EDIT) message data to TimescaleDB hypertable
-
+	hash := document.Hash(newDoc)
 	ackMessage := protocol.Message{
 		Type: protocol.TypeAck,
 		Data: protocol.InnerData{
 			Version: msg.Data.Version,
+			Hash:    &hash,
 		},
 	}
 	if err := c.sendMessage(ackMessage, sender); err != nil {
 		return err
 	}
 
+	inverse, err := c.commitEdit(ctx, msg, newDoc, hash, sender, sender.selection.Primary())
+	if err != nil {
+		return err
+	}
+
+	// Track the edit so that the sender can undo it
+	history := c.history[sender]
+	history.undo = push(history.undo, inverse)
+	history.redo = nil
+
+	return nil
+}
+
+// applyServerEdit turns the conversation's document into newDoc through an
+// Update (EDIT) message that is made by the server on behalf of a user and
+// broadcast to all clients in the conversation. The new version is returned
+// along with the history entry that undoes the edit.
+func (c *Conversation) applyServerEdit(ctx context.Context, newDoc string, userID int64) (int, historyEntry, error) {
+	start, end, inserted := document.Change(c.doc, newDoc)
+	patch := document.MakePatch(c.doc, newDoc)
+	caret, delta := editDelta(start, end, len([]rune(inserted)))
+
+	version := c.version + 1
+	updateType := protocol.UpdateTypeEdit
+	msg := protocol.Message{
+		Type: protocol.TypeUpdate,
+		Data: protocol.InnerData{
+			Type:    &updateType,
+			Version: &version,
+			Patch:   &patch,
+			Delta:   &delta,
+			UserID:  &userID,
+			Caret:   &caret,
+		},
+	}
+
+	// Broadcast Update (EDIT) message to all clients, since none of them know
+	// about the edit yet
+	if err := c.broadcastMessage(msg, nil); err != nil {
+		return c.version, historyEntry{}, err
+	}
+
+	inverse, err := c.commitEdit(ctx, msg, newDoc, document.Hash(newDoc), nil, caret)
+	if err != nil {
+		return c.version, historyEntry{}, err
+	}
+
+	return version, inverse, nil
+}
+
+// commitEdit publishes and persists an Update (EDIT) message that has been
+// broadcast, creates a checkpoint for its version and moves the conversation
+// to the new document, whose hash is given. The sender's caret is moved by the
+// edit's delta while all other clients' carets are shifted around senderCaret.
+// The sender is nil for edits that are made by the server. The history entry
+// that undoes the edit is returned. The edit is published and persisted in the
+// trace of ctx.
+func (c *Conversation) commitEdit(
+	ctx context.Context,
+	msg protocol.Message,
+	newDoc string,
+	hash string,
+	sender *Client,
+	senderCaret protocol.Caret,
+) (historyEntry, error) {
+	update := msg.Data
+	start, end, inserted := document.Change(c.doc, newDoc)
+	insertedLength := len([]rune(inserted))
+
+	// Publish Update (EDIT) message to Kafka topic
+	go func() {
+		if err := c.kafkaWriter.PublishUpdate(ctx, msg, c.conversationID); err != nil {
+			c.report(err)
+		}
+	}()
+
+	// Write relevant Update (EDIT) message data to TimescaleDB hypertable
+	patch := &models.Patch{
+		Timestamp: time.Now(),
+		Patch:     *update.Patch,
+		ConvoID:   c.conversationID,
+		UserID:    *update.UserID,
+		Type:      models.PatchTypeEdit,
+		Version:   *update.Version,
+		Inserted:  insertedLength,
+		Deleted:   end - start,
+	}
+	go func() {
+		ctx, span := tracer.Start(ctx, "db.create_patch", trace.WithAttributes(kv.Int("version", patch.Version)))
+		err := c.db.CreatePatch(patch)
+		tracing.End(ctx, span, err)
+		if err != nil {
+			c.report(err)
+		}
+	}()
+
 	newCheckpoint := &Checkpoint{
-		activeUsers: make(map[int64]protocol.Caret),
-		senderCaret: sender.caret,
-		delta:       *update.Delta,
-		syncsLeft:   make(map[int64]bool),
+		activeSessions: make(map[int64]protocol.Selection),
+		senderCaret:    senderCaret,
+		delta:          *update.Delta,
+		hash:           hash,
+		created:        time.Now(),
+		syncsLeft:      make(map[int64]bool),
 	}
 
-	// Update all other clients' carets
+	// Clients that don't know about sessions move the selection of the
+	// sender's user as if the sender were its primary session
+	var believed protocol.Selection
+	primary := sender
+	if sender != nil {
+		primary = c.primarySession(sender.userID)
+		believed = c.cursors[primary].MoveSelection(*update.Delta)
+	}
+
+	// Update all other clients' selections, along with the selections that
+	// were last broadcast for them
 	for client := range c.clients {
 		if client != sender {
-			client.caret = client.caret.ShiftCaret(sender.caret, *update.Delta)
-			newCheckpoint.syncsLeft[client.userID] = true
-			newCheckpoint.activeUsers[client.userID] = client.caret
+			client.selection = client.selection.ShiftSelection(senderCaret, *update.Delta)
+			c.cursors[client] = c.cursors[client].ShiftSelection(senderCaret, *update.Delta)
+			newCheckpoint.syncsLeft[client.sessionID] = true
+			newCheckpoint.activeSessions[client.sessionID] = client.selection
 		}
 	}
 
-	// Update the sender's caret
-	sender.caret.Start += *update.Delta.CaretStart
-	sender.caret.End += *update.Delta.CaretEnd
-	newCheckpoint.activeUsers[sender.userID] = sender.caret
+	// Update the sender's selection
+	if sender != nil {
+		sender.selection = sender.selection.MoveSelection(*update.Delta)
+		c.cursors[sender] = c.cursors[sender].MoveSelection(*update.Delta)
+		newCheckpoint.activeSessions[sender.sessionID] = sender.selection
+	}
 
-	c.checkpoint[*msg.Data.Version] = newCheckpoint
+	c.addCheckpoint(*update.Version, newCheckpoint)
 
-	if len(newCheckpoint.syncsLeft) == 0 {
-		syncMessage := protocol.Message{
-			Type: protocol.TypeSync,
-			Data: protocol.InnerData{
-				Version: msg.Data.Version,
-			},
+	if primary != sender {
+		if err := c.correctLegacySelection(sender.userID, believed); err != nil {
+			return historyEntry{}, err
 		}
-		if err := c.handleSync(syncMessage, sender); err != nil {
-			return err
+	}
+
+	if len(newCheckpoint.syncsLeft) == 0 {
+		if err := c.broadcastMessage(c.syncMessage(*update.Version), nil); err != nil {
+			return historyEntry{}, err
 		}
 	}
 
+	// Shift the history of every client around the range of the document that
+	// was actually changed
+	changeCaret, changeDelta := editDelta(start, end, insertedLength)
+	for _, history := range c.history {
+		history.shift(changeCaret, changeDelta)
+	}
+	inverse := historyEntry{
+		caret:    protocol.Caret{Start: start, End: start + insertedLength},
+		replaced: string([]rune(c.doc)[start:end]),
+	}
+
 	c.version++
 	c.doc = newDoc
+	c.hash = hash
+	atomic.StoreInt64(&c.size, int64(len(newDoc)))
+	c.pruneCheckpoints()
+	metrics.Checkpoints.Observe(float64(len(c.checkpoint)))
+
+	if err := c.shiftComments(senderCaret, *update.Delta); err != nil {
+		return historyEntry{}, err
+	}
+
+	if c.version%snapshotInterval == 0 {
+		c.saveSnapshot()
+		c.saveComments()
+	}
+
+	return inverse, nil
+}
+
+// handleUndoUpdate processes an Update message of subtype Undo or Redo by
+// applying the top entry of the sender's undo or redo stack as a new edit and
+// moving the entry that reverses it onto the opposite stack.
+func (c *Conversation) handleUndoUpdate(ctx context.Context, msg protocol.Message, sender *Client) error {
+	history := c.history[sender]
+	undo := *msg.Data.Type == protocol.UpdateTypeUndo
+
+	var entry historyEntry
+	var ok bool
+	if undo {
+		history.undo, entry, ok = pop(history.undo)
+	} else {
+		history.redo, entry, ok = pop(history.redo)
+	}
+	if !ok {
+		sender.logger.Debug("User has nothing to undo or redo", zap.Int("version", c.version))
+		return nil
+	}
+
+	newDoc := entry.apply(c.doc)
+	if newDoc == c.doc {
+		return nil
+	}
+
+	_, inverse, err := c.applyServerEdit(ctx, newDoc, sender.userID)
+	if err != nil {
+		return err
+	}
+
+	if undo {
+		history.redo = push(history.redo, inverse)
+	} else {
+		history.undo = push(history.undo, inverse)
+	}
+
+	return nil
+}
+
+// handleRevertMessage processes a Revert message from an admin of the
+// conversation. The patches to be reverted are read from the database
+// asynchronously and then queued up as a revert on the conversation.
+func (c *Conversation) handleRevertMessage(msg protocol.Message, sender *Client) error {
+	if !sender.role.IsAdmin() {
+		sender.logger.Warn("User is not allowed to revert patches")
+		return nil
+	}
+
+	data := msg.Data
+	filter := &models.Filter{
+		Conversation: c.conversationID,
+		StartVersion: data.StartVersion,
+		EndVersion:   data.EndVersion,
+	}
+	if data.UserID != nil {
+		filter.User = []int64{*data.UserID}
+	}
+	if data.StartTime != nil {
+		filter.StartTime = *data.StartTime
+	}
+	if data.EndTime != nil {
+		filter.EndTime = *data.EndTime
+	}
+	if err := validateRevertFilter(filter); err != nil {
+		return fmt.Errorf("revert is invalid: %v", err)
+	}
+
+	userID := sender.userID
+	go func() {
+		patches, err := c.db.GetPatches(filter)
+		if err != nil {
+			c.logger.Error("Failed to get patches to revert", zap.Int64("user_id", userID), zap.Error(err))
+			return
+		}
+		select {
+		case c.revert <- &revertRequest{userID: userID, patches: patches}:
+		case <-c.ctx.Done():
+			c.logger.Warn("Conversation shut down before patches were reverted", zap.Int64("user_id", userID))
+		}
+	}()
 
 	return nil
 }
 
-// handleCursorUpdate processes an Update message of subtype Cursor and
-// broadcasts it out to all clients in the conversation that aren't the sender.
+// handleRevert reverts the requested patches on the current document as a new
+// edit made by the requesting user.
+func (c *Conversation) handleRevert(req *revertRequest) revertResult {
+	patchTexts := []string{}
+	for _, patch := range req.patches {
+		if patch.ConvoID == c.conversationID && patch.Version <= c.version {
+			patchTexts = append(patchTexts, patch.Patch)
+		}
+	}
+
+	newDoc, reverted, err := document.Revert(c.doc, patchTexts)
+	if err != nil {
+		return revertResult{version: c.version, err: err}
+	}
+	if newDoc == c.doc {
+		return revertResult{version: c.version}
+	}
+
+	version, _, err := c.applyServerEdit(context.Background(), newDoc, req.userID)
+	c.logger.Info(
+		"User reverted patches",
+		zap.Int64("user_id", req.userID),
+		zap.Int("reverted", reverted),
+		zap.Int("version", version),
+	)
+	return revertResult{version: version, reverted: reverted, err: err}
+}
+
+// saveSnapshot persists the current content and version of the conversation so
+// that its history can be reconstructed without replaying every patch.
+func (c *Conversation) saveSnapshot() {
+	snapshot := c.snapshot()
+	go func() {
+		if err := c.db.CreateSnapshot(snapshot); err != nil {
+			c.logger.Error("Failed to save snapshot", zap.Int("version", snapshot.Version), zap.Error(err))
+		}
+	}()
+}
+
+// snapshot creates a snapshot of the current content and version of the
+// conversation, which is about to be saved.
+func (c *Conversation) snapshot() *models.Snapshot {
+	c.snapshotVersion = c.version
+	return &models.Snapshot{
+		Timestamp: time.Now(),
+		Content:   c.doc,
+		ConvoID:   c.conversationID,
+		Version:   c.version,
+	}
+}
+
+// memory estimates how many bytes the conversation takes up, which is
+// dominated by its document once it has no clients. It may be called from any
+// goroutine.
+func (c *Conversation) memory() int64 {
+	return atomic.LoadInt64(&c.size)
+}
+
+// handleCursorUpdate processes an Update message of subtype Cursor by recording
+// the sender's selection at every checkpoint. The selection either replaces the
+// sender's selection or the delta moves its primary caret. It is broadcast to
+// all other clients in the conversation once the cursor window elapses,
+// together with any other changes the sender makes in the meantime.
 func (c *Conversation) handleCursorUpdate(msg protocol.Message, sender *Client) error {
 	update := msg.Data
 
-	if update.Type == nil || update.Delta == nil || update.Version == nil {
+	if update.Type == nil || update.Version == nil || (update.Delta == nil && update.Selection == nil) {
 		return fmt.Errorf(`update (CURSOR) is missing required fields in "data"`)
 	}
 
-	if update.Delta.CaretStart == nil || update.Delta.CaretEnd == nil {
+	if update.Selection == nil && (update.Delta.CaretStart == nil || update.Delta.CaretEnd == nil) {
 		return fmt.Errorf(`update (CURSOR) is missing required fields in "data.delta"`)
 	}
 
-	// Broadcast Update (CURSOR) message to all existing clients
-	msg.Data.UserID = &sender.userID
-	if err := c.broadcastMessage(msg, sender); err != nil {
-		return err
+	if update.Selection != nil && (len(*update.Selection) == 0 || len(*update.Selection) > maxSelectionRanges) {
+		return fmt.Errorf("update (CURSOR) has %d carets in its selection", len(*update.Selection))
 	}
 
-	// Apply delta to the sender's caret position at its version checkpoint
+	// Apply the update to the sender's selection at its version checkpoint
 	updateCheckpoint, ok := c.checkpoint[*update.Version]
 	if !ok {
 		return fmt.Errorf("Version %d does not exist in checkpoints", *update.Version)
 	}
-	senderCaret := updateCheckpoint.activeUsers[sender.userID]
-	senderCaret.Start += *update.Delta.CaretStart
-	senderCaret.End += *update.Delta.CaretEnd
-	updateCheckpoint.activeUsers[sender.userID] = senderCaret
-	sender.caret = senderCaret
+	selection := updateCheckpoint.activeSessions[sender.sessionID]
+	if update.Selection != nil {
+		selection = *update.Selection
+	} else {
+		primary := selection.Primary()
+		primary.Start += *update.Delta.CaretStart
+		primary.End += *update.Delta.CaretEnd
+		selection = selection.WithPrimary(primary)
+	}
+
+	// Nothing changed, so there is nothing to record or broadcast
+	if selection.Equal(updateCheckpoint.activeSessions[sender.sessionID]) {
+		return nil
+	}
+	updateCheckpoint.activeSessions[sender.sessionID] = selection
 
-	// Adjust sender's caret position at subsequent version checkpoints
+	// Adjust sender's selection at subsequent version checkpoints
 	for v := *update.Version + 1; v <= c.version; v++ {
-		prevCaret := c.checkpoint[v-1].activeUsers[sender.userID]
-		c.checkpoint[v].activeUsers[sender.userID] = prevCaret.ShiftCaret(
+		prevSelection := c.checkpoint[v-1].activeSessions[sender.sessionID]
+		c.checkpoint[v].activeSessions[sender.sessionID] = prevSelection.ShiftSelection(
 			c.checkpoint[v].senderCaret,
 			c.checkpoint[v].delta,
 		)
 	}
+	sender.selection = c.checkpoint[c.version].activeSessions[sender.sessionID]
+
+	// Coalesce the sender's changes until the cursor window elapses
+	c.cursorsPending[sender] = true
+	if cursorWindow <= 0 {
+		return c.flushCursors()
+	}
+	if c.cursorFlush == nil {
+		c.cursorFlush = time.After(cursorWindow)
+	}
+
+	return nil
+}
+
+// flushCursors broadcasts an Update (CURSOR) message for every client whose
+// selection changed since it was last broadcast, with the client's latest
+// selection at the current version and the delta from the broadcast primary
+// caret to its latest primary caret for clients that only know about carets.
+func (c *Conversation) flushCursors() error {
+	c.cursorFlush = nil
+
+	for client := range c.cursorsPending {
+		delete(c.cursorsPending, client)
+
+		cursor := c.cursors[client]
+		if client.selection.Equal(cursor) {
+			continue
+		}
+
+		updateType := protocol.UpdateTypeCursor
+		version := c.version
+		selection := client.selection
+		caretStart := selection.Primary().Start - cursor.Primary().Start
+		caretEnd := selection.Primary().End - cursor.Primary().End
+		msg := protocol.Message{
+			Type: protocol.TypeUpdate,
+			Data: protocol.InnerData{
+				Type:      &updateType,
+				Version:   &version,
+				UserID:    &client.userID,
+				SessionID: &client.sessionID,
+				Delta: &protocol.Delta{
+					CaretStart: &caretStart,
+					CaretEnd:   &caretEnd,
+				},
+				Selection: &selection,
+			},
+		}
+
+		// Clients that don't know about sessions only see the primary
+		// session of other users
+		primary := c.primarySession(client.userID) == client
+		err := c.broadcastWhere(msg, func(receiver *Client) bool {
+			if receiver.knowsSessions() {
+				return receiver != client
+			}
+			return primary && receiver.userID != client.userID
+		})
+		if err != nil {
+			return err
+		}
+		c.cursors[client] = selection
+	}
 
 	return nil
 }
@@ -257,11 +808,16 @@ func (c *Conversation) handleSync(msg protocol.Message, sender *Client) error {
 		return fmt.Errorf(`sync is missing required fields in "data"`)
 	}
 
-	if _, ok := c.checkpoint[*sync.Version]; !ok {
-		log.Printf("Checkpoint for version %d does not exist. Removing all previous checkpoints", *sync.Version)
+	checkpoint, ok := c.checkpoint[*sync.Version]
+	if !ok {
+		sender.logger.Warn(
+			"Checkpoint for synced version does not exist. Removing all previous checkpoints",
+			zap.Int("version", c.version),
+			zap.Int("sync_version", *sync.Version),
+		)
 		for i := *sync.Version - 1; ; i-- {
 			if _, ok := c.checkpoint[i]; ok {
-				delete(c.checkpoint, i)
+				c.deleteCheckpoint(i)
 			} else {
 				break
 			}
@@ -269,11 +825,47 @@ func (c *Conversation) handleSync(msg protocol.Message, sender *Client) error {
 		return nil
 	}
 
-	delete(c.checkpoint[*sync.Version].syncsLeft, sender.userID)
+	// Clients that report the hash of their document at the synced version
+	// are sent the whole document again if theirs has diverged
+	if sync.Hash != nil && *sync.Hash != checkpoint.hash {
+		metrics.Divergences.Inc()
+		sender.logger.Warn(
+			"Client document diverged from the conversation. Resyncing client",
+			zap.Int("version", c.version),
+			zap.Int("sync_version", *sync.Version),
+			zap.String("hash", checkpoint.hash),
+			zap.String("client_hash", *sync.Hash),
+		)
+		return c.resync(sender)
+	}
+
+	return c.markSynced(sender, *sync.Version)
+}
+
+// syncMessage creates the Sync message that tells clients that every session
+// has synced to a checkpointed version.
+func (c *Conversation) syncMessage(version int) protocol.Message {
+	hash := c.checkpoint[version].hash
+	return protocol.Message{
+		Type: protocol.TypeSync,
+		Data: protocol.InnerData{
+			Version: &version,
+			Hash:    &hash,
+		},
+	}
+}
 
-	if len(c.checkpoint[*sync.Version].syncsLeft) == 0 {
-		delete(c.checkpoint, *sync.Version-1)
-		if err := c.broadcastMessage(msg, nil); err != nil {
+// markSynced records that a client has synced to a checkpointed version, so it
+// is no longer falling behind. Once every session has synced to the version,
+// the checkpoint before it is removed and all clients are told.
+func (c *Conversation) markSynced(client *Client, version int) error {
+	checkpoint := c.checkpoint[version]
+	delete(checkpoint.syncsLeft, client.sessionID)
+	client.forcedResyncs = 0
+
+	if len(checkpoint.syncsLeft) == 0 {
+		c.pruneCheckpoints()
+		if err := c.broadcastMessage(c.syncMessage(version), nil); err != nil {
 			return err
 		}
 	}
@@ -281,104 +873,283 @@ func (c *Conversation) handleSync(msg protocol.Message, sender *Client) error {
 	return nil
 }
 
-// registerClient starts tracking a client in the conversation, sends the client
-// an Init message, and broadcasts a UserJoin message to the rest of the
-// clients.
-func (c *Conversation) registerClient(client *Client) error {
-	// Create and send Init message to the new client
+// resync sends a client the whole document at the current version in a new
+// Init message, which replaces the client's own document. The client no
+// longer has to sync to any earlier version.
+func (c *Conversation) resync(client *Client) error {
+	if err := c.sendMessage(c.initMessage(client), client); err != nil {
+		return err
+	}
+
+	// Tell everyone about the versions that only the client hadn't synced to
+	synced := []int{}
+	for version, checkpoint := range c.checkpoint {
+		if checkpoint.syncsLeft[client.sessionID] {
+			delete(checkpoint.syncsLeft, client.sessionID)
+			if len(checkpoint.syncsLeft) == 0 {
+				synced = append(synced, version)
+			}
+		}
+	}
+	sort.Ints(synced)
+	for _, version := range synced {
+		if err := c.broadcastMessage(c.syncMessage(version), nil); err != nil {
+			return err
+		}
+	}
+	c.pruneCheckpoints()
+
+	return nil
+}
+
+// initMessage creates the Init message that tells a client the current
+// document and everything else about the conversation, except for the client's
+// own session.
+func (c *Conversation) initMessage(client *Client) protocol.Message {
 	init := protocol.Message{
 		Type: protocol.TypeInit,
 		Data: protocol.InnerData{
-			Version: &c.version,
-			Content: &c.doc,
+			Version:   &c.version,
+			Content:   &c.doc,
+			SessionID: &client.sessionID,
+			Hash:      &c.hash,
 		},
 	}
-	if len(c.clients) > 0 {
-		activeUsers := make(map[int64]protocol.Caret)
-		for client := range c.clients {
-			activeUsers[client.userID] = protocol.Caret{
-				Start: client.caret.Start,
-				End:   client.caret.End,
-			}
+	if len(c.comments) > 0 {
+		comments := c.commentList()
+		init.Data.Comments = &comments
+	}
+
+	// Selections are sent as they were last broadcast, so that pending cursor
+	// updates apply to them like they do for every other client. Users are
+	// shown at the selection of their primary session to clients that don't
+	// know about sessions.
+	activeUsers := make(map[int64]protocol.Caret)
+	selections := make(map[int64]protocol.Selection)
+	users := make(map[int64]protocol.User)
+	sessions := make(map[int64]protocol.Session)
+	for other := range c.clients {
+		if other == client {
+			continue
+		}
+		sessions[other.sessionID] = protocol.Session{
+			UserID:    other.userID,
+			Selection: c.cursors[other],
 		}
+		user := other.user()
+		user.Presence = c.userPresence[other.userID]
+		users[other.userID] = user
+		if c.primarySession(other.userID) != other {
+			continue
+		}
+		activeUsers[other.userID] = c.cursors[other].Primary()
+		selections[other.userID] = c.cursors[other]
+	}
+	if len(sessions) > 0 {
 		init.Data.ActiveUsers = &activeUsers
+		init.Data.Selections = &selections
+		init.Data.Users = &users
+		init.Data.Sessions = &sessions
 	}
-	initMessage, err := json.Marshal(init)
-	if err != nil {
+
+	return init
+}
+
+// registerClient starts tracking a client in the conversation as a new session,
+// sends the client an Init message, and broadcasts a UserJoin message to the
+// rest of the clients.
+func (c *Conversation) registerClient(client *Client) error {
+	c.sessions++
+	client.sessionID = c.sessions
+
+	// Reply to the client's Hello message with the negotiated protocol
+	// version, which clients using the legacy handshake don't receive
+	hello := protocol.Message{
+		Type: protocol.TypeHello,
+		Data: protocol.InnerData{
+			ProtocolVersion: &client.protocolVersion,
+			Capabilities:    &protocol.ServerCapabilities,
+		},
+	}
+	if err := c.sendMessage(hello, client); err != nil {
 		return err
 	}
-	client.conn.SetWriteDeadline(time.Now().Add(writeWait))
-	err = client.conn.WriteMessage(gorillaws.TextMessage, initMessage)
-	if err != nil {
+
+	// Create and send Init message to the new client
+	if err := c.sendMessage(c.initMessage(client), client); err != nil {
 		return err
 	}
 
-	// Create and broadcast UserJoin message to all existing clients
+	// Create and broadcast UserJoin message to all existing clients. Clients
+	// that don't know about sessions are only told when the user's first
+	// session joins.
+	firstSession := len(c.sessionsOf(client.userID)) == 0
+	role := string(client.role)
 	userJoinMsg := protocol.Message{
 		Type: protocol.TypeUserJoin,
 		Data: protocol.InnerData{
-			UserID: &client.userID,
+			UserID:    &client.userID,
+			SessionID: &client.sessionID,
+			Nickname:  client.nickname,
+			Role:      &role,
+			Color:     &client.color,
+			Presence:  &client.presence,
 		},
 	}
-	if err := c.broadcastMessage(userJoinMsg, nil); err != nil {
+	err := c.broadcastWhere(userJoinMsg, func(receiver *Client) bool {
+		return firstSession || receiver.knowsSessions()
+	})
+	if err != nil {
 		return err
 	}
 
 	c.clients[client] = true
-	log.Printf("Registered a client in conversation %d (%d active)", c.conversationID, len(c.clients))
-
-	return nil
+	metrics.ConnectedClients.Inc()
+	c.history[client] = &editHistory{}
+	c.cursors[client] = client.selection
+	if firstSession {
+		c.userPresence[client.userID] = client.presence
+	}
+	client.logger.Info(
+		"Registered a client",
+		zap.Int64("session_id", client.sessionID),
+		zap.Int("active", len(c.clients)),
+		zap.Int("version", c.version),
+	)
+
+	return c.updateUserPresence(client.userID)
 }
 
 // unregisterClient stops tracking a client in the conversation and broadcasts
-// a UserLeave message to the rest of the clients.
+// a UserLeave message to the rest of the clients. Clients that aren't tracked
+// are ignored, so a client is only ever disconnected once.
 func (c *Conversation) unregisterClient(client *Client) error {
 	if _, ok := c.clients[client]; !ok {
-		log.Printf("Attempted to unregister an inactive client in conversation %d", c.conversationID)
+		client.logger.Warn("Attempted to unregister an inactive client")
 		return nil
 	}
 
-	for version := range c.checkpoint {
-		delete(c.checkpoint[version].activeUsers, client.userID)
-		delete(c.checkpoint[version].syncsLeft, client.userID)
-	}
-
-	delete(c.clients, client)
-	close(client.send)
-	log.Printf("Unregistered a client in conversation %d (%d active)", c.conversationID, len(c.clients))
+	wasPrimary := c.primarySession(client.userID) == client
+	believed := c.cursors[client]
+	c.removeClient(client)
 
-	// Create and broadcast UserLeave message to all existing clients
+	// Create and broadcast UserLeave message to all existing clients. Clients
+	// that don't know about sessions are only told when the user's last
+	// session leaves.
+	lastSession := len(c.sessionsOf(client.userID)) == 0
 	userLeaveMsg := protocol.Message{
 		Type: protocol.TypeUserLeave,
 		Data: protocol.InnerData{
-			UserID: &client.userID,
+			UserID:    &client.userID,
+			SessionID: &client.sessionID,
 		},
 	}
-	if err := c.broadcastMessage(userLeaveMsg, nil); err != nil {
+	err := c.broadcastWhere(userLeaveMsg, func(receiver *Client) bool {
+		return lastSession || receiver.knowsSessions()
+	})
+	if err != nil {
 		return err
 	}
 
-	return nil
+	// The user is now shown at the selection of its next oldest session to
+	// clients that don't know about sessions
+	if wasPrimary && !lastSession {
+		if err := c.correctLegacySelection(client.userID, believed); err != nil {
+			return err
+		}
+	}
+
+	return c.updateUserPresence(client.userID)
+}
+
+// removeClient stops tracking a client in the conversation and closes its
+// queue, which disconnects it once the queue has been written.
+func (c *Conversation) removeClient(client *Client) {
+	for version := range c.checkpoint {
+		delete(c.checkpoint[version].activeSessions, client.sessionID)
+		delete(c.checkpoint[version].syncsLeft, client.sessionID)
+	}
+	c.pruneCheckpoints()
+
+	delete(c.clients, client)
+	metrics.ConnectedClients.Dec()
+	delete(c.history, client)
+	delete(c.slow, client)
+	delete(c.cursors, client)
+	delete(c.cursorsPending, client)
+	close(client.send)
+	client.logger.Info(
+		"Unregistered a client",
+		zap.Int64("session_id", client.sessionID),
+		zap.Int("active", len(c.clients)),
+		zap.Int("version", c.version),
+	)
+}
+
+// messageKind returns the kind of a message received from a client, which is
+// how it is counted in metrics.
+func messageKind(msg protocol.Message) string {
+	switch msg.Type {
+	case protocol.TypeSync:
+		return metrics.MessageSync
+	case protocol.TypeRevert:
+		return metrics.MessageRevert
+	case protocol.TypeEphemeral:
+		return metrics.MessageEphemeral
+	case protocol.TypeComment:
+		return metrics.MessageComment
+	case protocol.TypeUpdate:
+		if msg.Data.Type == nil {
+			return metrics.MessageInvalid
+		}
+		switch *msg.Data.Type {
+		case protocol.UpdateTypeEdit:
+			return metrics.MessageEdit
+		case protocol.UpdateTypeCursor:
+			return metrics.MessageCursor
+		case protocol.UpdateTypeUndo:
+			return metrics.MessageUndo
+		case protocol.UpdateTypeRedo:
+			return metrics.MessageRedo
+		}
+	}
+	return metrics.MessageInvalid
 }
 
 // processBroadcast processes a received Update message and handles it according
 // to the message's subtype.
-func (c *Conversation) processBroadcast(broadcastMsg *BroadcastMessage) error {
+func (c *Conversation) processBroadcast(broadcastMsg *BroadcastMessage) (err error) {
 	if _, ok := c.clients[broadcastMsg.sender]; !ok {
-		log.Printf("Attempted to broadcast from an inactive client in conversation %d", c.conversationID)
+		broadcastMsg.sender.logger.Warn("Attempted to broadcast from an inactive client")
 		return nil
 	}
 
+	ctx, span := tracer.Start(broadcastMsg.ctx, "conversation.process",
+		trace.WithAttributes(kv.Int64("conversation_id", c.conversationID), kv.Int("version", c.version)),
+	)
+	defer func() { tracing.End(ctx, span, err) }()
+
 	msg := protocol.Message{}
-	if err := json.Unmarshal(broadcastMsg.content, &msg); err != nil {
+	if err := broadcastMsg.sender.codec.Unmarshal(broadcastMsg.content, &msg); err != nil {
+		metrics.Messages.WithLabelValues(metrics.MessageInvalid).Inc()
 		return fmt.Errorf("failed to parse WebSocket message content: %v", err)
 	}
-
-	if msg.Type != protocol.TypeUpdate && msg.Type != protocol.TypeSync {
+	kind := messageKind(msg)
+	metrics.Messages.WithLabelValues(kind).Inc()
+	span.SetAttributes(kv.String("message.kind", kind))
+
+	if msg.Type != protocol.TypeUpdate &&
+		msg.Type != protocol.TypeSync &&
+		msg.Type != protocol.TypeRevert &&
+		msg.Type != protocol.TypeEphemeral &&
+		msg.Type != protocol.TypeComment {
 		return fmt.Errorf(
-			"message is not of type %d or type %d",
+			"message is not of type %d, type %d, type %d, type %d or type %d",
 			protocol.TypeUpdate,
 			protocol.TypeSync,
+			protocol.TypeRevert,
+			protocol.TypeEphemeral,
+			protocol.TypeComment,
 		)
 	}
 
@@ -386,60 +1157,154 @@ func (c *Conversation) processBroadcast(broadcastMsg *BroadcastMessage) error {
 		return c.handleSync(msg, broadcastMsg.sender)
 	}
 
+	// Every other message is sent because of something the user did, unlike Syncs
+	broadcastMsg.sender.lastActive = time.Now()
+
+	if msg.Type == protocol.TypeRevert {
+		return c.handleRevertMessage(msg, broadcastMsg.sender)
+	}
+
+	if msg.Type == protocol.TypeEphemeral {
+		return c.handleEphemeral(msg, broadcastMsg.sender, len(broadcastMsg.content))
+	}
+
+	if msg.Type == protocol.TypeComment {
+		return c.handleCommentMessage(msg, broadcastMsg.sender)
+	}
+
 	if msg.Data.Type == nil {
 		return fmt.Errorf(`update is missing required "type" field in "data"`)
 	}
 
 	switch *msg.Data.Type {
 	case protocol.UpdateTypeEdit:
-		if err := c.handleEditUpdate(msg, broadcastMsg.sender); err != nil {
+		if err := c.handleEditUpdate(ctx, msg, broadcastMsg.sender); err != nil {
 			return err
 		}
+		broadcastMsg.sender.lastTyped = time.Now()
 
 	case protocol.UpdateTypeCursor:
 		if err := c.handleCursorUpdate(msg, broadcastMsg.sender); err != nil {
 			return err
 		}
 
+	case protocol.UpdateTypeUndo, protocol.UpdateTypeRedo:
+		if err := c.handleUndoUpdate(ctx, msg, broadcastMsg.sender); err != nil {
+			return err
+		}
+		broadcastMsg.sender.lastTyped = time.Now()
+
 	default:
 		return fmt.Errorf("update has invalid subtype %d", *msg.Data.Type)
 	}
 
-	return nil
+	// The sender has just been active, so update its presence right away
+	// instead of waiting for the next presence check
+	return c.setPresence(broadcastMsg.sender, presenceAt(broadcastMsg.sender, time.Now()))
 }
 
-// Run waits on a Conversation's three channels for clients to be added, clients
-// to be removed, and messages to be broadcast. Only one of these operations may
-// be performed at a time.
+// Run waits on a Conversation's channels for clients to be added, clients to be
+// removed, messages to be broadcast, patches to be reverted, comments to be
+// changed or to finish saving, inspections, and liveness pings. Only one of
+// these operations may be performed at a time. Run returns once the
+// conversation's context is done and every client has been disconnected.
 func (c *Conversation) Run() {
+	defer func() {
+		c.setStatus(StatusStopped)
+		close(c.stopped)
+	}()
+	c.saveSnapshot()
+	c.loadComments()
+
+	presence := time.NewTicker(presenceInterval)
+	defer presence.Stop()
+	collect := time.NewTicker(checkpointInterval)
+	defer collect.Stop()
+
+	metrics.RetainedCheckpoints.Add(float64(len(c.checkpoint)))
+	defer func() { metrics.RetainedCheckpoints.Sub(float64(len(c.checkpoint))) }()
+
+	c.setStatus(StatusRunning)
 	for {
 		select {
-		case client := <-c.register:
-			if err := c.registerClient(client); err != nil {
-				log.Print("Error occured while registering new client: ", err)
+		case <-c.ctx.Done():
+			c.drain()
+			return
+
+		case req := <-c.register:
+			err := c.registerClient(req.client)
+			if err != nil {
+				req.client.logger.Error("Error occured while registering new client", zap.Error(err))
 			}
+			req.result <- err
 
 		case client := <-c.unregister:
 			if err := c.unregisterClient(client); err != nil {
-				log.Print("Error occured while unregistering client: ", err)
+				client.logger.Error("Error occured while unregistering client", zap.Error(err))
 			}
 
-		case broadcastMsg, ok := <-c.broadcast:
-			if !ok {
-				log.Printf("Shutting down conversation %d", c.conversationID)
-				return
-			}
+		case broadcastMsg := <-c.broadcast:
 			if err := c.processBroadcast(broadcastMsg); err != nil {
-				log.Print("Failed to process broadcast message: ", err)
+				broadcastMsg.sender.logger.Warn(
+					"Failed to process broadcast message",
+					zap.Int("version", c.version),
+					zap.Error(err),
+				)
 				c.unregisterClient(broadcastMsg.sender)
 			}
 
+		case req := <-c.revert:
+			result := c.handleRevert(req)
+			if result.err != nil {
+				c.logger.Error("Failed to revert patches", zap.Int64("user_id", req.userID), zap.Error(result.err))
+			}
+			if req.result != nil {
+				req.result <- result
+			}
+
+		case req := <-c.comment:
+			c.handleComment(req)
+
+		case write := <-c.commentSaved:
+			c.applyComment(write)
+
+		case req := <-c.inspection:
+			req.result <- c.inspect()
+
+		case done := <-c.pings:
+			close(done)
+
+		case <-c.cursorFlush:
+			if err := c.flushCursors(); err != nil {
+				c.logger.Error("Failed to broadcast cursor updates", zap.Error(err))
+			}
+
+		case now := <-collect.C:
+			if err := c.collectCheckpoints(now); err != nil {
+				c.logger.Error("Failed to collect checkpoints", zap.Error(err))
+			}
+
+		case now := <-presence.C:
+			if err := c.updatePresence(now); err != nil {
+				c.logger.Error("Failed to broadcast presence updates", zap.Error(err))
+			}
+
 		case err := <-c.errc:
-			log.Print("Error occured during asynchronous action: ", err)
+			c.logger.Error("Error occured during asynchronous action", zap.Int("version", c.version), zap.Error(err))
 			for client := range c.clients {
 				c.unregisterClient(client)
 			}
 
 		}
+
+		// Catch up lagging clients right away once there are too many
+		// checkpoints instead of waiting for them to expire
+		if len(c.checkpoint) > maxCheckpoints {
+			if err := c.collectCheckpoints(time.Now()); err != nil {
+				c.logger.Error("Failed to collect checkpoints", zap.Error(err))
+			}
+		}
+
+		c.dropSlowClients()
 	}
 }
@@ -0,0 +1,432 @@
+package websockets
+
+import (
+	"context"
+	"encoding/json"
+	"patches/document"
+	"patches/metrics"
+	"patches/models"
+	"patches/protocol"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+// testDatastore is an in-memory models.Datastore.
+type testDatastore struct {
+	sync.Mutex
+	patches   []models.Patch
+	snapshots []models.Snapshot
+	messages  []models.Message
+	comments  []models.Comment
+}
+
+func (db *testDatastore) CreatePatch(patch *models.Patch) error {
+	db.Lock()
+	defer db.Unlock()
+	db.patches = append(db.patches, *patch)
+	return nil
+}
+
+func (db *testDatastore) GetPatches(filter *models.Filter) ([]models.Patch, error) {
+	db.Lock()
+	defer db.Unlock()
+	return append([]models.Patch{}, db.patches...), nil
+}
+
+func (db *testDatastore) DeletePatches(convoID int64) (int64, error) {
+	return 0, nil
+}
+
+func (db *testDatastore) CreateSnapshot(snapshot *models.Snapshot) error {
+	db.Lock()
+	defer db.Unlock()
+	db.snapshots = append(db.snapshots, *snapshot)
+	return nil
+}
+
+func (db *testDatastore) GetSnapshot(filter *models.Filter) (*models.Snapshot, error) {
+	db.Lock()
+	defer db.Unlock()
+	var latest *models.Snapshot
+	for i, snapshot := range db.snapshots {
+		if filter.EndVersion != nil && snapshot.Version > *filter.EndVersion {
+			continue
+		}
+		if latest == nil || snapshot.Version >= latest.Version {
+			latest = &db.snapshots[i]
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+	snapshot := *latest
+	return &snapshot, nil
+}
+
+func (db *testDatastore) GetLatestVersion(convoID int64) (int, error) {
+	return 0, nil
+}
+
+func (db *testDatastore) GetActivity(filter *models.Filter, bucket time.Duration) ([]models.Activity, error) {
+	return []models.Activity{}, nil
+}
+
+func (db *testDatastore) CreateMessage(message *models.Message) error {
+	db.Lock()
+	defer db.Unlock()
+	db.messages = append(db.messages, *message)
+	return nil
+}
+
+func (db *testDatastore) GetMessages(filter *models.Filter) ([]models.Message, error) {
+	db.Lock()
+	defer db.Unlock()
+	return append([]models.Message{}, db.messages...), nil
+}
+
+func (db *testDatastore) CreateComment(comment *models.Comment) error {
+	db.Lock()
+	defer db.Unlock()
+	comment.ID = int64(len(db.comments) + 1)
+	db.comments = append(db.comments, *comment)
+	return nil
+}
+
+func (db *testDatastore) GetComments(convoID int64) ([]models.Comment, error) {
+	db.Lock()
+	defer db.Unlock()
+	comments := []models.Comment{}
+	for _, comment := range db.comments {
+		if comment.ID != 0 && comment.ConvoID == convoID {
+			comments = append(comments, comment)
+		}
+	}
+	return comments, nil
+}
+
+func (db *testDatastore) UpdateComment(comment *models.Comment) error {
+	db.Lock()
+	defer db.Unlock()
+	for i := range db.comments {
+		if db.comments[i].ID == comment.ID {
+			db.comments[i] = *comment
+		}
+	}
+	return nil
+}
+
+// DeleteComment zeroes the IDs of deleted comments so that new comments keep
+// getting unique IDs.
+func (db *testDatastore) DeleteComment(convoID, id int64) error {
+	db.Lock()
+	defer db.Unlock()
+	for i, comment := range db.comments {
+		if comment.ID == id || (comment.ParentID != nil && *comment.ParentID == id) {
+			db.comments[i].ID = 0
+		}
+	}
+	return nil
+}
+
+// testPublisher is a kafka.Publisher that discards all messages.
+type testPublisher struct{}
+
+func (p *testPublisher) PublishUpdate(ctx context.Context, msg protocol.Message, conversationID int64) error {
+	return nil
+}
+
+// newTestConversation creates and starts a Conversation with in-memory
+// dependencies. The returned function shuts the conversation down and waits for
+// it to stop running.
+func newTestConversation(doc string) (*Conversation, func()) {
+	c := NewConversation(context.Background(), 1, doc, 0, &testDatastore{}, &testPublisher{}, zap.NewNop())
+	go c.Run()
+	return c, func() {
+		c.Stop()
+		<-c.stopped
+	}
+}
+
+// newTestClient creates a Client without a WebSocket connection and registers
+// it in a conversation. Messages sent to the client are read from its send
+// channel.
+func newTestClient(userID int64, c *Conversation) *Client {
+	return newVersionedTestClient(userID, protocol.MaxProtocolVersion, c)
+}
+
+// newVersionedTestClient creates a test client that speaks a protocol version.
+func newVersionedTestClient(userID int64, version int, c *Conversation) *Client {
+	hs := &handshake{
+		protocolVersion: version,
+		capabilities:    make(map[string]bool),
+		codec:           protocol.JSON,
+	}
+	member := &models.UserConversationMapping{
+		UserID:         userID,
+		ConversationID: c.conversationID,
+		Role:           models.User,
+	}
+	client := NewClient(member, hs, nil, false, nil, c, zap.NewNop())
+	if err := c.Register(client); err != nil {
+		panic(err)
+	}
+	return client
+}
+
+// receive decodes the messages sent to a test client until it is unregistered.
+func receive(t *testing.T, client *Client) <-chan protocol.Message {
+	messages := make(chan protocol.Message, sendQueueSize)
+	go func() {
+		defer close(messages)
+		for out := range client.send {
+			msg := protocol.Message{}
+			if err := json.Unmarshal(out.data, &msg); err != nil {
+				t.Errorf("Failed to decode message: %v", err)
+				return
+			}
+			messages <- msg
+		}
+	}()
+	return messages
+}
+
+// editMessage encodes an Update (EDIT) message that turns doc into newDoc by
+// typing at the end of the document.
+func editMessage(t *testing.T, doc, newDoc string, version int) []byte {
+	updateType := protocol.UpdateTypeEdit
+	patch := document.MakePatch(doc, newDoc)
+	insertedLength := len([]rune(newDoc)) - len([]rune(doc))
+	msg := protocol.Message{
+		Type: protocol.TypeUpdate,
+		Data: protocol.InnerData{
+			Type:    &updateType,
+			Version: &version,
+			Patch:   &patch,
+			Delta: &protocol.Delta{
+				CaretStart: &insertedLength,
+				CaretEnd:   &insertedLength,
+				Doc:        &insertedLength,
+			},
+		},
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Failed to encode edit: %v", err)
+	}
+	return data
+}
+
+// isEdit reports whether a message is an Update (EDIT) message.
+func isEdit(msg protocol.Message) bool {
+	return msg.Type == protocol.TypeUpdate &&
+		msg.Data.Type != nil &&
+		*msg.Data.Type == protocol.UpdateTypeEdit
+}
+
+func TestConversationLoad(t *testing.T) {
+	const (
+		numClients = 300
+		numSlow    = 10
+		numEdits   = 200
+	)
+
+	c, stop := newTestConversation("")
+	defer stop()
+
+	sender := newTestClient(0, c)
+	receive(t, sender)
+
+	// Slow clients never read their messages while fast clients count the
+	// edits they receive
+	slow := []*Client{}
+	done := make(chan int, numClients)
+	for i := 1; i <= numClients; i++ {
+		client := newTestClient(int64(i), c)
+		if i <= numSlow {
+			slow = append(slow, client)
+			continue
+		}
+
+		messages := receive(t, client)
+		go func() {
+			edits := 0
+			for msg := range messages {
+				if isEdit(msg) {
+					edits++
+				}
+				if edits == numEdits {
+					break
+				}
+			}
+			done <- edits
+		}()
+	}
+
+	start := time.Now()
+	doc := ""
+	for i := 1; i <= numEdits; i++ {
+		newDoc := doc + "a"
+		c.broadcast <- &BroadcastMessage{editMessage(t, doc, newDoc, i), sender, context.Background()}
+		doc = newDoc
+	}
+
+	timeout := time.After(10 * time.Second)
+	for i := 0; i < numClients-numSlow; i++ {
+		select {
+		case edits := <-done:
+			if edits != numEdits {
+				t.Fatalf("Fast client received %d edits instead of %d", edits, numEdits)
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for fast clients to receive %d edits", numEdits)
+		}
+	}
+	t.Logf("Broadcast %d edits to %d clients in %v", numEdits, numClients, time.Since(start))
+
+	for _, client := range slow {
+		drained := make(chan bool)
+		go func() {
+			for range client.send {
+			}
+			close(drained)
+		}()
+
+		select {
+		case <-drained:
+		case <-time.After(time.Second):
+			t.Fatalf("Slow client of user %d was not disconnected", client.userID)
+		}
+		if client.closeCode != closeSlowConsumer {
+			t.Errorf("Slow client was closed with code %d instead of %d", client.closeCode, closeSlowConsumer)
+		}
+	}
+}
+
+// cursorMessage encodes an Update (CURSOR) message that moves a caret by the
+// given offsets.
+func cursorMessage(t *testing.T, caretStart, caretEnd, version int) []byte {
+	updateType := protocol.UpdateTypeCursor
+	msg := protocol.Message{
+		Type: protocol.TypeUpdate,
+		Data: protocol.InnerData{
+			Type:    &updateType,
+			Version: &version,
+			Delta: &protocol.Delta{
+				CaretStart: &caretStart,
+				CaretEnd:   &caretEnd,
+			},
+		},
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Failed to encode cursor update: %v", err)
+	}
+	return data
+}
+
+func TestCursorCoalescing(t *testing.T) {
+	defer func(window time.Duration) { cursorWindow = window }(cursorWindow)
+	cursorWindow = 20 * time.Millisecond
+
+	c, stop := newTestConversation("hello world")
+	defer stop()
+
+	sender := newTestClient(1, c)
+	receive(t, sender)
+	receiver := newTestClient(2, c)
+	messages := receive(t, receiver)
+
+	// nextCursor waits for the next Update (CURSOR) message the receiver gets,
+	// returning false if none arrives within a few cursor windows
+	nextCursor := func() (protocol.Message, bool) {
+		timeout := time.After(5 * cursorWindow)
+		for {
+			select {
+			case msg := <-messages:
+				if msg.Type == protocol.TypeUpdate && *msg.Data.Type == protocol.UpdateTypeCursor {
+					return msg, true
+				}
+			case <-timeout:
+				return protocol.Message{}, false
+			}
+		}
+	}
+
+	// Moves within a window are broadcast as a single update
+	c.broadcast <- &BroadcastMessage{cursorMessage(t, 1, 1, 0), sender, context.Background()}
+	c.broadcast <- &BroadcastMessage{cursorMessage(t, 2, 2, 0), sender, context.Background()}
+	c.broadcast <- &BroadcastMessage{cursorMessage(t, 0, 3, 0), sender, context.Background()}
+	msg, ok := nextCursor()
+	if !ok {
+		t.Fatal("Expected a cursor update")
+	}
+	if *msg.Data.UserID != sender.userID || *msg.Data.Version != 0 ||
+		*msg.Data.Delta.CaretStart != 3 || *msg.Data.Delta.CaretEnd != 6 {
+		t.Errorf("Expected user 1 to move by (3, 6) at version 0, got %+v", msg.Data)
+	}
+	if msg, ok := nextCursor(); ok {
+		t.Errorf("Expected a single cursor update, got %+v", msg.Data)
+	}
+
+	// Moves that cancel out aren't broadcast at all
+	c.broadcast <- &BroadcastMessage{cursorMessage(t, 2, 1, 0), sender, context.Background()}
+	c.broadcast <- &BroadcastMessage{cursorMessage(t, -2, -1, 0), sender, context.Background()}
+	c.broadcast <- &BroadcastMessage{cursorMessage(t, 0, 0, 0), sender, context.Background()}
+	if msg, ok := nextCursor(); ok {
+		t.Errorf("Expected no cursor update, got %+v", msg.Data)
+	}
+
+	// Selections replace the sender's selection
+	updateType := protocol.UpdateTypeCursor
+	version := 0
+	selection := protocol.Selection{{Start: 3, End: 6, Name: "primary"}, {Start: 8, End: 9}}
+	data, err := json.Marshal(protocol.Message{
+		Type: protocol.TypeUpdate,
+		Data: protocol.InnerData{Type: &updateType, Version: &version, Selection: &selection},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode cursor update: %v", err)
+	}
+	c.broadcast <- &BroadcastMessage{data, sender, context.Background()}
+	msg, ok = nextCursor()
+	if !ok {
+		t.Fatal("Expected a cursor update")
+	}
+	if msg.Data.Selection == nil || !msg.Data.Selection.Equal(selection) ||
+		*msg.Data.Delta.CaretStart != 0 || *msg.Data.Delta.CaretEnd != 0 {
+		t.Errorf("Expected user 1 to select %+v, got %+v", selection, msg.Data)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	c, stop := newTestConversation("")
+	defer stop()
+
+	connected := testutil.ToFloat64(metrics.ConnectedClients)
+	edits := testutil.ToFloat64(metrics.Messages.WithLabelValues(metrics.MessageEdit))
+	invalid := testutil.ToFloat64(metrics.Messages.WithLabelValues(metrics.MessageInvalid))
+
+	sender := newTestClient(1, c)
+	messages := receive(t, sender)
+	c.broadcast <- &BroadcastMessage{editMessage(t, "", "a", 1), sender, context.Background()}
+	if _, ok := next(messages, protocol.TypeAck, time.Second); !ok {
+		t.Fatal("Expected the edit to be acknowledged")
+	}
+	c.broadcast <- &BroadcastMessage{[]byte(`{"type": 1, "data": {"type": 9}}`), sender, context.Background()}
+	for range messages {
+	}
+
+	if got := testutil.ToFloat64(metrics.ConnectedClients) - connected; got != 0 {
+		t.Errorf("Expected the client to be connected and disconnected, got %v more clients", got)
+	}
+	if got := testutil.ToFloat64(metrics.Messages.WithLabelValues(metrics.MessageEdit)) - edits; got != 1 {
+		t.Errorf("Expected 1 edit, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.Messages.WithLabelValues(metrics.MessageInvalid)) - invalid; got != 1 {
+		t.Errorf("Expected 1 invalid message, got %v", got)
+	}
+}
@@ -0,0 +1,163 @@
+package websockets
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"patches/models"
+	"patches/protocol"
+	"regexp"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxEphemeralSize is the largest size in bytes of an Ephemeral message.
+const maxEphemeralSize = 8192
+
+// namespacePattern is what the namespaces of Ephemeral messages look like.
+var namespacePattern = regexp.MustCompile(`^[a-z][a-z0-9_.-]{0,63}$`)
+
+// persistChat is whether chat messages are saved to the database.
+var persistChat = os.Getenv("PATCHES_PERSIST_CHAT") != ""
+
+// ephemeralLimit configures how Ephemeral messages of a namespace are handled.
+// Each client may send rate messages per second of the namespace, in bursts of
+// up to burst messages.
+type ephemeralLimit struct {
+	rate      float64
+	burst     float64
+	droppable bool
+	persist   bool
+}
+
+// ephemeralLimits configures the namespaces that clients are known to use,
+// which every conversation is created with.
+var ephemeralLimits = map[string]ephemeralLimit{
+	"chat":     {rate: 2, burst: 10, persist: persistChat},
+	"reaction": {rate: 5, burst: 10},
+	"pointer":  {rate: 30, burst: 30, droppable: true},
+	"follow":   {rate: 1, burst: 3},
+}
+
+// defaultEphemeralLimit configures every other namespace.
+var defaultEphemeralLimit = ephemeralLimit{rate: 10, burst: 20}
+
+// limitFor returns how Ephemeral messages of a namespace are handled in the
+// conversation.
+func (c *Conversation) limitFor(namespace string) ephemeralLimit {
+	if limit, ok := c.ephemeral[namespace]; ok {
+		return limit
+	}
+	return defaultEphemeralLimit
+}
+
+// tokenBucket rate limits the messages of a client in a namespace.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow reports whether a message may be sent at a point in time, and takes a
+// token for it if so.
+func (b *tokenBucket) allow(now time.Time, limit ephemeralLimit) bool {
+	if b.last.IsZero() {
+		b.tokens = limit.burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * limit.rate
+		if b.tokens > limit.burst {
+			b.tokens = limit.burst
+		}
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// handleEphemeral relays an Ephemeral message to the other clients in the
+// conversation, or only the clients of its target users. The message doesn't
+// change the document, and is dropped if the sender exceeds the rate limit of
+// its namespace.
+func (c *Conversation) handleEphemeral(msg protocol.Message, sender *Client, size int) error {
+	data := msg.Data
+
+	if data.Namespace == nil || data.Payload == nil {
+		return fmt.Errorf(`ephemeral message is missing required fields in "data"`)
+	}
+
+	if !namespacePattern.MatchString(*data.Namespace) {
+		return fmt.Errorf("ephemeral message has invalid namespace %q", *data.Namespace)
+	}
+
+	if size > maxEphemeralSize {
+		return fmt.Errorf("ephemeral message is %d bytes, larger than %d", size, maxEphemeralSize)
+	}
+
+	limit := c.limitFor(*data.Namespace)
+	bucket, ok := sender.buckets[*data.Namespace]
+	if !ok {
+		bucket = &tokenBucket{}
+		sender.buckets[*data.Namespace] = bucket
+	}
+	now := time.Now()
+	if !bucket.allow(now, limit) {
+		sender.logger.Debug("Dropped ephemeral message over the rate limit", zap.String("namespace", *data.Namespace))
+		return nil
+	}
+
+	relayed := protocol.Message{
+		Type: protocol.TypeEphemeral,
+		Data: protocol.InnerData{
+			UserID:    &sender.userID,
+			SessionID: &sender.sessionID,
+			Namespace: data.Namespace,
+			Payload:   data.Payload,
+			Targets:   data.Targets,
+		},
+	}
+
+	targets := make(map[int64]bool)
+	if data.Targets != nil {
+		for _, userID := range *data.Targets {
+			targets[userID] = true
+		}
+	}
+	err := c.broadcastWhere(relayed, func(receiver *Client) bool {
+		return receiver != sender && (data.Targets == nil || targets[receiver.userID])
+	})
+	if err != nil {
+		return err
+	}
+
+	// Only messages to everyone are saved, since anyone in the conversation
+	// can read them back
+	if limit.persist && data.Targets == nil {
+		payload, err := json.Marshal(data.Payload)
+		if err != nil {
+			return err
+		}
+		message := &models.Message{
+			Timestamp: now,
+			ConvoID:   c.conversationID,
+			UserID:    sender.userID,
+			Namespace: *data.Namespace,
+			Payload:   payload,
+		}
+		go func() {
+			if err := c.db.CreateMessage(message); err != nil {
+				c.logger.Error(
+					"Failed to save ephemeral message",
+					zap.Int64("user_id", message.UserID),
+					zap.String("namespace", message.Namespace),
+					zap.Error(err),
+				)
+			}
+		}()
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package websockets
+
+import (
+	"context"
+	"encoding/json"
+	"patches/models"
+	"patches/protocol"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ephemeralMessage encodes an Ephemeral message.
+func ephemeralMessage(t *testing.T, namespace string, payload interface{}, targets []int64) []byte {
+	msg := protocol.Message{
+		Type: protocol.TypeEphemeral,
+		Data: protocol.InnerData{
+			Namespace: &namespace,
+			Payload:   payload,
+		},
+	}
+	if targets != nil {
+		msg.Data.Targets = &targets
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Failed to encode ephemeral message: %v", err)
+	}
+	return data
+}
+
+func TestEphemeral(t *testing.T) {
+	// Chat messages are persisted in this conversation only
+	limits := make(map[string]ephemeralLimit)
+	for namespace, limit := range ephemeralLimits {
+		limits[namespace] = limit
+	}
+	limits["chat"] = ephemeralLimit{rate: 2, burst: 10, persist: true}
+
+	c := NewConversation(context.Background(), 1, "hello world", 0, &testDatastore{}, &testPublisher{}, zap.NewNop())
+	c.ephemeral = limits
+	go c.Run()
+	stop := func() {
+		c.Stop()
+		<-c.stopped
+	}
+	sender := newTestClient(1, c)
+	receive(t, sender)
+	targeted := newTestClient(2, c)
+	targetedMessages := receive(t, targeted)
+	other := newTestClient(3, c)
+	otherMessages := receive(t, other)
+
+	// Messages to everyone are relayed to every other client
+	c.broadcast <- &BroadcastMessage{ephemeralMessage(t, "chat", map[string]string{"text": "hi"}, nil), sender, context.Background()}
+	for _, messages := range []<-chan protocol.Message{targetedMessages, otherMessages} {
+		msg, ok := next(messages, protocol.TypeEphemeral, time.Second)
+		if !ok {
+			t.Fatal("Expected an Ephemeral message")
+		}
+		payload, _ := msg.Data.Payload.(map[string]interface{})
+		if *msg.Data.UserID != 1 || *msg.Data.Namespace != "chat" || payload["text"] != "hi" {
+			t.Errorf("Expected chat message from user 1, got %+v", msg.Data)
+		}
+	}
+
+	// Targeted messages are only relayed to the targets
+	c.broadcast <- &BroadcastMessage{ephemeralMessage(t, "follow", true, []int64{2}), sender, context.Background()}
+	if _, ok := next(targetedMessages, protocol.TypeEphemeral, time.Second); !ok {
+		t.Error("Expected an Ephemeral message for the target")
+	}
+	if msg, ok := next(otherMessages, protocol.TypeEphemeral, 50*time.Millisecond); ok {
+		t.Errorf("Expected no Ephemeral message, got %+v", msg.Data)
+	}
+
+	// Messages over the rate limit of their namespace are dropped
+	for i := 0; i < 10; i++ {
+		c.broadcast <- &BroadcastMessage{ephemeralMessage(t, "follow", true, nil), sender, context.Background()}
+	}
+	received := 0
+	for {
+		if _, ok := next(otherMessages, protocol.TypeEphemeral, 50*time.Millisecond); !ok {
+			break
+		}
+		received++
+	}
+	if limit := int(c.limitFor("follow").burst) - 1; received != limit {
+		t.Errorf("Expected %d messages within the rate limit, got %d", limit, received)
+	}
+
+	// Only the chat message to everyone is saved, in the background
+	stop()
+	db := c.db.(*testDatastore)
+	var messages []models.Message
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if messages, _ = db.GetMessages(nil); len(messages) > 0 {
+			break
+		}
+	}
+	if len(messages) != 1 || messages[0].Namespace != "chat" || string(messages[0].Payload) != `{"text":"hi"}` {
+		t.Errorf("Expected the chat message to be saved, got %+v", messages)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	limit := ephemeralLimit{rate: 1, burst: 2}
+	bucket := &tokenBucket{}
+	now := time.Now()
+
+	for i, expected := range []bool{true, true, false} {
+		if allowed := bucket.allow(now, limit); allowed != expected {
+			t.Errorf("Message %d: expected allowed to be %t", i, expected)
+		}
+	}
+	if !bucket.allow(now.Add(time.Second), limit) {
+		t.Error("Expected a token to be refilled after a second")
+	}
+	if bucket.allow(now.Add(time.Second), limit) {
+		t.Error("Expected only one token to be refilled")
+	}
+}
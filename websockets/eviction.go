@@ -0,0 +1,112 @@
+package websockets
+
+import (
+	"patches/metrics"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// idleGracePeriod is how long a conversation is kept warm after its last
+	// client leaves, so that clients that reconnect don't have to wait for it
+	// to be started again. Conversations are shut down as soon as their last
+	// client leaves if it isn't positive.
+	idleGracePeriod = time.Duration(envInt("PATCHES_IDLE_GRACE_S", 300)) * time.Second
+
+	// maxWarmConversations is the most conversations without clients that are
+	// kept warm at once. Negative limits are treated as 0.
+	maxWarmConversations = atLeast(envInt("PATCHES_MAX_WARM_CONVERSATIONS", 1000), 0)
+
+	// maxWarmBytes is the most memory that conversations without clients may
+	// take up, as estimated from the size of their documents. Negative limits
+	// are treated as 0.
+	maxWarmBytes = int64(atLeast(envInt("PATCHES_MAX_WARM_MB", 256), 0)) << 20
+)
+
+// release lets go of an active conversation that may have no clients or holds
+// left. Such a conversation is kept warm until its grace period elapses, and
+// the conversations that have been without clients the longest are evicted
+// once too many are kept warm. The Broker must be locked by the caller.
+func (b *Broker) release(conversationID int64, cd *ConvoData) {
+	if b.active[conversationID] != cd || len(cd.clients) > 0 || cd.holds > 0 || !cd.idleSince.IsZero() {
+		return
+	}
+	if idleGracePeriod <= 0 || b.ctx.Err() != nil {
+		b.deactivate(conversationID, cd)
+		return
+	}
+
+	since := time.Now()
+	cd.idleSince = since
+	cd.idle = time.AfterFunc(idleGracePeriod, func() {
+		b.expire(conversationID, cd, since)
+	})
+	metrics.WarmConversations.Inc()
+
+	b.evictWarm()
+}
+
+// use stops keeping a conversation warm, since it is being used again. The
+// Broker must be locked by the caller.
+func (b *Broker) use(cd *ConvoData) {
+	if cd.idleSince.IsZero() {
+		return
+	}
+	cd.idle.Stop()
+	cd.idle = nil
+	cd.idleSince = time.Time{}
+	metrics.WarmConversations.Dec()
+}
+
+// expire evicts a conversation whose grace period has elapsed, unless it has
+// been used since it was released.
+func (b *Broker) expire(conversationID int64, cd *ConvoData, since time.Time) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.active[conversationID] != cd || !cd.idleSince.Equal(since) {
+		return
+	}
+	b.evict(conversationID, cd, metrics.EvictionExpired)
+}
+
+// evictWarm evicts the conversations that have been without clients the
+// longest until few enough conversations are kept warm and they take up little
+// enough memory. The Broker must be locked by the caller.
+func (b *Broker) evictWarm() {
+	for {
+		var oldest *ConvoData
+		var oldestID int64
+		var warm int
+		var bytes int64
+		for conversationID, cd := range b.active {
+			if cd.idleSince.IsZero() {
+				continue
+			}
+			warm++
+			bytes += cd.conversation.memory()
+			if oldest == nil || cd.idleSince.Before(oldest.idleSince) {
+				oldest, oldestID = cd, conversationID
+			}
+		}
+
+		if oldest == nil || (warm <= maxWarmConversations && bytes <= maxWarmBytes) {
+			return
+		}
+		b.evict(oldestID, oldest, metrics.EvictionCapacity)
+	}
+}
+
+// evict shuts down a conversation that is kept warm, which saves a final
+// snapshot of its document. The Broker must be locked by the caller.
+func (b *Broker) evict(conversationID int64, cd *ConvoData, reason string) {
+	metrics.Evictions.WithLabelValues(reason).Inc()
+	b.logger.Info(
+		"Evicting conversation without clients",
+		zap.Int64("conversation_id", conversationID),
+		zap.String("reason", reason),
+		zap.Duration("idle", time.Since(cd.idleSince)),
+	)
+	b.deactivate(conversationID, cd)
+}
@@ -0,0 +1,161 @@
+package websockets
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// connect registers a client of a conversation with a Broker, failing the test
+// if it can't be registered.
+func connect(t *testing.T, b *Broker, userID, conversationID int64) *Client {
+	member, hs := testMember(userID, conversationID)
+	client, err := b.register(context.Background(), member, hs, nil, false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to register client: %v", err)
+	}
+	receive(t, client)
+	return client
+}
+
+// stopped reports whether a conversation shuts down within a timeout.
+func stopped(c *Conversation, timeout time.Duration) bool {
+	select {
+	case <-c.stopped:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestIdleGracePeriod(t *testing.T) {
+	defer func(grace time.Duration) { idleGracePeriod = grace }(idleGracePeriod)
+	idleGracePeriod = 100 * time.Millisecond
+
+	b, stop := newTestBroker("hello")
+	defer stop()
+	db := b.db.(*testDatastore)
+
+	client := connect(t, b, 1, 1)
+	c := client.conversation
+	c.submit(&BroadcastMessage{editMessage(t, "hello", "hello!", 1), client, context.Background()})
+	b.unregister(client)
+
+	// The conversation is kept warm for a client that reconnects
+	active := b.ActiveConversations()
+	if len(active) != 1 || active[0].IdleSince == nil {
+		t.Fatalf("Expected the conversation to be kept warm, got %v", active)
+	}
+	client = connect(t, b, 1, 1)
+	if client.conversation != c {
+		t.Fatalf("Expected the reconnected client to join the warm conversation")
+	}
+	if state := inspectConversation(c); state.Version != 1 {
+		t.Fatalf("Expected the warm conversation to be at version 1, got %d", state.Version)
+	}
+	b.unregister(client)
+
+	// Once the grace period elapses, the conversation is evicted with a final
+	// snapshot
+	if !stopped(c, time.Second) {
+		t.Fatalf("Expected the conversation to be evicted")
+	}
+	if active := b.ActiveConversations(); len(active) != 0 {
+		t.Fatalf("Expected no active conversations, got %v", active)
+	}
+	db.Lock()
+	defer db.Unlock()
+	for _, snapshot := range db.snapshots {
+		if snapshot.Version == 1 && snapshot.Content == "hello!" {
+			return
+		}
+	}
+	t.Fatalf("Expected a final snapshot of version 1, got %v", db.snapshots)
+}
+
+func TestWarmConversationLimit(t *testing.T) {
+	defer func(grace time.Duration) { idleGracePeriod = grace }(idleGracePeriod)
+	idleGracePeriod = time.Minute
+	defer func(limit int) { maxWarmConversations = limit }(maxWarmConversations)
+	maxWarmConversations = 2
+
+	b, stop := newTestBroker("hello")
+	defer stop()
+	defer b.Shutdown(context.Background())
+
+	conversations := make(map[int64]*Conversation)
+	release := func(conversationID int64) {
+		client := connect(t, b, 1, conversationID)
+		conversations[conversationID] = client.conversation
+		b.unregister(client)
+	}
+
+	// The conversation that has been without clients the longest is evicted
+	release(1)
+	release(2)
+	release(3)
+	if !stopped(conversations[1], time.Second) {
+		t.Fatalf("Expected the least recently used conversation to be evicted")
+	}
+
+	// Using a warm conversation again makes it the most recently used
+	release(2)
+	release(4)
+	if !stopped(conversations[3], time.Second) {
+		t.Fatalf("Expected the least recently used conversation to be evicted")
+	}
+	for _, id := range []int64{2, 4} {
+		if stopped(conversations[id], 10*time.Millisecond) {
+			t.Fatalf("Expected conversation %d to be kept warm", id)
+		}
+	}
+}
+
+func TestWarmMemoryLimit(t *testing.T) {
+	defer func(grace time.Duration) { idleGracePeriod = grace }(idleGracePeriod)
+	idleGracePeriod = time.Minute
+	defer func(limit int64) { maxWarmBytes = limit }(maxWarmBytes)
+	maxWarmBytes = int64(len("hello") * 2)
+
+	b, stop := newTestBroker("hello")
+	defer stop()
+	defer b.Shutdown(context.Background())
+
+	first := connect(t, b, 1, 1)
+	b.unregister(first)
+	second := connect(t, b, 1, 2)
+	b.unregister(second)
+	if stopped(first.conversation, 10*time.Millisecond) {
+		t.Fatalf("Expected conversations within the memory limit to be kept warm")
+	}
+
+	third := connect(t, b, 1, 3)
+	b.unregister(third)
+	if !stopped(first.conversation, time.Second) {
+		t.Fatalf("Expected the least recently used conversation to be evicted")
+	}
+}
+
+func TestNegativeWarmLimit(t *testing.T) {
+	defer func(grace time.Duration) { idleGracePeriod = grace }(idleGracePeriod)
+	idleGracePeriod = time.Minute
+	defer func(limit int) { maxWarmConversations = limit }(maxWarmConversations)
+	maxWarmConversations = -1
+
+	b, stop := newTestBroker("hello")
+	defer stop()
+	defer b.Shutdown(context.Background())
+
+	// Every conversation is evicted without running out of conversations to
+	// evict
+	client := connect(t, b, 1, 1)
+	b.unregister(client)
+	if !stopped(client.conversation, time.Second) {
+		t.Fatalf("Expected the conversation to be evicted")
+	}
+	if active := b.ActiveConversations(); len(active) != 0 {
+		t.Fatalf("Expected no active conversations, got %v", active)
+	}
+}
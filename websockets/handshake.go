@@ -0,0 +1,72 @@
+package websockets
+
+import (
+	"errors"
+	"os"
+	"patches/protocol"
+)
+
+// legacyHandshake is whether clients may still connect by sending a bare token
+// instead of a Hello message.
+var legacyHandshake = os.Getenv("PATCHES_DISABLE_LEGACY_HANDSHAKE") == ""
+
+// errLegacyHandshake is returned when a client sends a bare token while the
+// legacy handshake is disabled.
+var errLegacyHandshake = errors.New("legacy handshake is not accepted")
+
+// handshake stores what a client declared about itself in the first message
+// that it sent through the WebSocket connection, and the codec of the
+// subprotocol that was negotiated when the connection was upgraded.
+type handshake struct {
+	token           string
+	protocolVersion int
+	capabilities    map[string]bool
+	clientID        string
+	codec           protocol.Codec
+}
+
+// parseHandshake reads the first message that a client sent, which is either a
+// Hello message encoded with the negotiated codec or, for clients using the
+// legacy handshake, a bare token. The protocol version is negotiated from the
+// highest version that the client supports.
+func parseHandshake(message []byte, codec protocol.Codec) (*handshake, error) {
+	msg := protocol.Message{}
+	if err := codec.Unmarshal(message, &msg); err != nil || msg.Type != protocol.TypeHello {
+		if !legacyHandshake {
+			return nil, errLegacyHandshake
+		}
+		return &handshake{
+			token:           string(message),
+			protocolVersion: protocol.ProtocolV1,
+			capabilities:    make(map[string]bool),
+			codec:           codec,
+		}, nil
+	}
+
+	hello := msg.Data
+	if hello.Token == nil || hello.ProtocolVersion == nil {
+		return nil, errors.New(`hello is missing required fields in "data"`)
+	}
+
+	version, err := protocol.Negotiate(*hello.ProtocolVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	hs := &handshake{
+		token:           *hello.Token,
+		protocolVersion: version,
+		capabilities:    make(map[string]bool),
+		codec:           codec,
+	}
+	if hello.Capabilities != nil {
+		for _, capability := range *hello.Capabilities {
+			hs.capabilities[capability] = true
+		}
+	}
+	if hello.ClientID != nil {
+		hs.clientID = *hello.ClientID
+	}
+
+	return hs, nil
+}
@@ -0,0 +1,89 @@
+package websockets
+
+import (
+	"patches/protocol"
+	"testing"
+)
+
+func TestParseHandshake(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Message string
+		Legacy  bool
+
+		ExpectedErr      bool
+		ExpectedToken    string
+		ExpectedVersion  int
+		ExpectedClientID string
+	}{
+		{
+			Name:            "Legacy Token",
+			Message:         "eyJhbGciOiJIUzI1NiJ9.e30.abc",
+			Legacy:          true,
+			ExpectedToken:   "eyJhbGciOiJIUzI1NiJ9.e30.abc",
+			ExpectedVersion: protocol.ProtocolV1,
+		},
+		{
+			Name:        "Legacy Token::Disabled",
+			Message:     "eyJhbGciOiJIUzI1NiJ9.e30.abc",
+			Legacy:      false,
+			ExpectedErr: true,
+		},
+		{
+			Name:             "Hello",
+			Message:          `{"type":7,"data":{"token":"abc","protocol_version":2,"capabilities":["undo"],"client_id":"tab-1"}}`,
+			Legacy:           false,
+			ExpectedToken:    "abc",
+			ExpectedVersion:  protocol.ProtocolV2,
+			ExpectedClientID: "tab-1",
+		},
+		{
+			Name:            "Hello::Newer Client",
+			Message:         `{"type":7,"data":{"token":"abc","protocol_version":99}}`,
+			Legacy:          true,
+			ExpectedToken:   "abc",
+			ExpectedVersion: protocol.MaxProtocolVersion,
+		},
+		{
+			Name:        "Hello::Unsupported Version",
+			Message:     `{"type":7,"data":{"token":"abc","protocol_version":0}}`,
+			Legacy:      true,
+			ExpectedErr: true,
+		},
+		{
+			Name:        "Hello::Missing Token",
+			Message:     `{"type":7,"data":{"protocol_version":2}}`,
+			Legacy:      true,
+			ExpectedErr: true,
+		},
+	}
+
+	defer func(legacy bool) { legacyHandshake = legacy }(legacyHandshake)
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			legacyHandshake = test.Legacy
+			hs, err := parseHandshake([]byte(test.Message), protocol.JSON)
+			if test.ExpectedErr {
+				if err == nil {
+					t.Error("Expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if hs.token != test.ExpectedToken || hs.protocolVersion != test.ExpectedVersion || hs.clientID != test.ExpectedClientID {
+				t.Errorf(
+					"Handshake is wrong. Expected: %q v%d %q. Actual: %q v%d %q.",
+					test.ExpectedToken,
+					test.ExpectedVersion,
+					test.ExpectedClientID,
+					hs.token,
+					hs.protocolVersion,
+					hs.clientID,
+				)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package websockets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// errBrokerBusy is returned when the Broker can't be locked before a health
+// check times out.
+var errBrokerBusy = errors.New("broker is busy")
+
+// brokerProbe gets the active conversations of the Broker for health checks.
+// Checks that start while it is still waiting for the Broker's lock share it
+// instead of each waiting for the lock. active is set before done is closed.
+type brokerProbe struct {
+	done   chan struct{}
+	active map[int64]*Conversation
+}
+
+// probeActive gets the active conversations of the Broker in the background,
+// so that a Broker that is stuck fails health checks instead of blocking them.
+func (b *Broker) probeActive() *brokerProbe {
+	b.probeMu.Lock()
+	defer b.probeMu.Unlock()
+	if b.probe != nil {
+		return b.probe
+	}
+
+	p := &brokerProbe{done: make(chan struct{})}
+	b.probe = p
+	go func() {
+		b.Lock()
+		active := make(map[int64]*Conversation, len(b.active))
+		for id, cd := range b.active {
+			active[id] = cd.conversation
+		}
+		b.Unlock()
+
+		b.probeMu.Lock()
+		b.probe = nil
+		b.probeMu.Unlock()
+		p.active = active
+		close(p.done)
+	}()
+	return p
+}
+
+// ping waits for the conversation to get to a liveness ping. A conversation
+// that has shut down isn't stuck.
+func (c *Conversation) ping(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case c.pings <- done:
+	case <-c.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// CheckConversations checks that no active conversation is stuck, which would
+// freeze every client connected to it. Conversations are pinged concurrently
+// through their Run loops.
+func (b *Broker) CheckConversations(ctx context.Context) error {
+	probe := b.probeActive()
+	select {
+	case <-probe.done:
+	case <-ctx.Done():
+		return errBrokerBusy
+	}
+	active := probe.active
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	ids := []string{}
+	for id, conversation := range active {
+		wg.Add(1)
+		go func(id int64, conversation *Conversation) {
+			defer wg.Done()
+			if err := conversation.ping(ctx); err != nil {
+				mu.Lock()
+				ids = append(ids, strconv.FormatInt(id, 10))
+				mu.Unlock()
+			}
+		}(id, conversation)
+	}
+	wg.Wait()
+
+	if len(ids) > 0 {
+		sort.Strings(ids)
+		return fmt.Errorf("conversations are not responding: %s", strings.Join(ids, ", "))
+	}
+	return nil
+}
+
+// CheckHeimdall checks that Heimdall can be reached.
+func (b *Broker) CheckHeimdall(ctx context.Context) error {
+	return b.checkHost(ctx, heimdallHost)
+}
+
+// CheckEther checks that Ether can be reached.
+func (b *Broker) CheckEther(ctx context.Context) error {
+	return b.checkHost(ctx, etherHost)
+}
+
+// checkHost checks that a host responds to HTTP requests. Any response counts,
+// since the host only has to be reachable.
+func (b *Broker) checkHost(ctx context.Context, host string) error {
+	req, err := http.NewRequest("HEAD", "http://"+host+"/", nil)
+	if err != nil {
+		return err
+	}
+	res, err := b.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
@@ -0,0 +1,77 @@
+package websockets
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestCheckConversations(t *testing.T) {
+	b := NewBroker(&testDatastore{}, nil, &testPublisher{}, zap.NewNop())
+
+	running, shutdown := newTestConversation("")
+	defer shutdown()
+	b.active[1] = &ConvoData{conversation: running, clients: make(map[*Client]bool)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := b.CheckConversations(ctx); err != nil {
+		t.Fatalf("Running conversation failed the check: %v", err)
+	}
+
+	// A conversation whose Run loop isn't getting to its channels is stuck
+	stuck := NewConversation(context.Background(), 2, "", 0, &testDatastore{}, &testPublisher{}, zap.NewNop())
+	b.active[2] = &ConvoData{conversation: stuck, clients: make(map[*Client]bool)}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := b.CheckConversations(ctx)
+	if err == nil || err.Error() != "conversations are not responding: 2" {
+		t.Fatalf("Expected only the stuck conversation to fail the check, got %v", err)
+	}
+
+	// Conversations that have shut down aren't stuck
+	close(stuck.stopped)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := b.CheckConversations(ctx); err != nil {
+		t.Fatalf("Stopped conversation failed the check: %v", err)
+	}
+}
+
+func TestCheckBusyBroker(t *testing.T) {
+	b := NewBroker(&testDatastore{}, nil, &testPublisher{}, zap.NewNop())
+
+	// Checks of a Broker that is stuck share the probe waiting for its lock
+	b.Lock()
+	var probe *brokerProbe
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if err := b.CheckConversations(ctx); err != errBrokerBusy {
+			t.Fatalf("Expected a locked Broker to fail the check, got %v", err)
+		}
+		cancel()
+
+		b.probeMu.Lock()
+		if probe == nil {
+			probe = b.probe
+		} else if b.probe != probe {
+			t.Fatalf("Expected the checks to share a single probe")
+		}
+		b.probeMu.Unlock()
+	}
+	b.Unlock()
+
+	select {
+	case <-probe.done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the probe to finish once the Broker is unlocked")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := b.CheckConversations(ctx); err != nil {
+		t.Fatalf("Expected an unlocked Broker to pass the check, got %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package websockets
+
+import (
+	"patches/protocol"
+)
+
+// maxHistory is the maximum number of edits that a client can undo or redo.
+const maxHistory = 100
+
+// historyEntry stores an edit that can be undone or redone as the range of the
+// current document that the edit produced and the text that it replaced.
+type historyEntry struct {
+	caret    protocol.Caret
+	replaced string
+}
+
+// editHistory stores the undo and redo stacks of a client's own edits.
+type editHistory struct {
+	undo []historyEntry
+	redo []historyEntry
+}
+
+// push adds an entry to the top of a stack, dropping the oldest entry if the
+// stack is full.
+func push(stack []historyEntry, entry historyEntry) []historyEntry {
+	stack = append(stack, entry)
+	if len(stack) > maxHistory {
+		stack = stack[len(stack)-maxHistory:]
+	}
+	return stack
+}
+
+// pop removes the entry at the top of a stack.
+func pop(stack []historyEntry) ([]historyEntry, historyEntry, bool) {
+	if len(stack) == 0 {
+		return stack, historyEntry{}, false
+	}
+	return stack[:len(stack)-1], stack[len(stack)-1], true
+}
+
+// shift moves the ranges of all entries in the history around an edit, so
+// that they keep referring to the same text after the edit is applied.
+func (h *editHistory) shift(senderCaret protocol.Caret, delta protocol.Delta) {
+	for i := range h.undo {
+		h.undo[i].caret = h.undo[i].caret.ShiftCaret(senderCaret, delta)
+	}
+	for i := range h.redo {
+		h.redo[i].caret = h.redo[i].caret.ShiftCaret(senderCaret, delta)
+	}
+}
+
+// apply replaces the range of an entry in a document with the text that the
+// entry replaced.
+func (e historyEntry) apply(doc string) string {
+	runes := []rune(doc)
+	start, end := e.caret.Start, e.caret.End
+	if end > len(runes) {
+		end = len(runes)
+	}
+	if start > end {
+		start = end
+	}
+
+	return string(runes[:start]) + e.replaced + string(runes[end:])
+}
+
+// editDelta creates the caret and delta of an edit that replaces the range
+// [start, end) of a document with text of length insertedLength, as if the
+// edit was made by a user with that range selected.
+func editDelta(start, end, insertedLength int) (protocol.Caret, protocol.Delta) {
+	caretStart := insertedLength
+	caretEnd := insertedLength - (end - start)
+	docDelta := insertedLength - (end - start)
+	return protocol.Caret{Start: start, End: end}, protocol.Delta{
+		CaretStart: &caretStart,
+		CaretEnd:   &caretEnd,
+		Doc:        &docDelta,
+	}
+}
@@ -0,0 +1,87 @@
+package websockets
+
+import (
+	"patches/document"
+	"patches/protocol"
+	"testing"
+)
+
+func TestEditHistory(t *testing.T) {
+	tests := []struct {
+		Name         string
+		Doc          string
+		Edit         string
+		Intervening  []string
+		ExpectedUndo string
+	}{
+		{
+			Name:         "No Intervening Edits",
+			Doc:          "hello",
+			Edit:         "hello world",
+			Intervening:  []string{},
+			ExpectedUndo: "hello",
+		},
+		{
+			Name:         "Intervening Insert Before",
+			Doc:          "hello",
+			Edit:         "hello world",
+			Intervening:  []string{"Oh, hello world"},
+			ExpectedUndo: "Oh, hello",
+		},
+		{
+			Name:         "Intervening Insert After",
+			Doc:          "hello",
+			Edit:         "hello world",
+			Intervening:  []string{"hello world!"},
+			ExpectedUndo: "hello!",
+		},
+		{
+			Name:         "Intervening Delete Before",
+			Doc:          "abc def",
+			Edit:         "abc def ghi",
+			Intervening:  []string{"def ghi"},
+			ExpectedUndo: "def",
+		},
+		{
+			Name:         "Undo Deletion With Intervening Insert Before",
+			Doc:          "one two three",
+			Edit:         "one three",
+			Intervening:  []string{"zero one three"},
+			ExpectedUndo: "zero one two three",
+		},
+		{
+			Name:         "Undo Replace With Intervening Edits Around",
+			Doc:          "the quick fox",
+			Edit:         "the slow fox",
+			Intervening:  []string{"see the slow fox", "see the slow fox run"},
+			ExpectedUndo: "see the quick fox run",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			history := &editHistory{}
+			start, end, inserted := document.Change(test.Doc, test.Edit)
+			history.undo = push(history.undo, historyEntry{
+				caret:    protocol.Caret{Start: start, End: start + len([]rune(inserted))},
+				replaced: string([]rune(test.Doc)[start:end]),
+			})
+
+			doc := test.Edit
+			for _, newDoc := range test.Intervening {
+				start, end, inserted := document.Change(doc, newDoc)
+				caret, delta := editDelta(start, end, len([]rune(inserted)))
+				history.shift(caret, delta)
+				doc = newDoc
+			}
+
+			_, entry, ok := pop(history.undo)
+			if !ok {
+				t.Fatal("Expected an entry to undo")
+			}
+			if undone := entry.apply(doc); undone != test.ExpectedUndo {
+				t.Errorf("Undone document is wrong. Expected: %q. Actual: %q.", test.ExpectedUndo, undone)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package websockets
+
+import (
+	"context"
+	"errors"
+	"patches/document"
+	"patches/protocol"
+	"sort"
+	"time"
+)
+
+// ErrConversationNotActive is returned when a conversation that isn't running
+// is inspected.
+var ErrConversationNotActive = errors.New("Conversation is not active")
+
+// ConversationSummary describes an active conversation from the Broker's point
+// of view. Conversations without clients are kept warm since IdleSince.
+type ConversationSummary struct {
+	ConversationID int64      `json:"conversation_id"`
+	Clients        int        `json:"clients"`
+	IdleSince      *time.Time `json:"idle_since,omitempty"`
+}
+
+// ConversationState describes the internal state of an active conversation for
+// debugging clients that are out of sync.
+type ConversationState struct {
+	ConversationID int64             `json:"conversation_id"`
+	Status         string            `json:"status"`
+	Version        int               `json:"version"`
+	DocumentLength int               `json:"document_length"`
+	DocumentHash   string            `json:"document_hash"`
+	Clients        []ClientState     `json:"clients"`
+	Checkpoints    []CheckpointState `json:"checkpoints"`
+	Queues         QueueState        `json:"queues"`
+	Compression    CompressionState  `json:"compression"`
+}
+
+// ClientState describes a client connected to a conversation. Its selection is
+// where the server believes the client's carets are, and its cursor is the
+// selection that was last broadcast for it.
+type ClientState struct {
+	SessionID       int64              `json:"session_id"`
+	UserID          int64              `json:"user_id"`
+	ClientID        string             `json:"client_id,omitempty"`
+	ProtocolVersion int                `json:"protocol_version"`
+	Presence        protocol.Presence  `json:"presence"`
+	Selection       protocol.Selection `json:"selection"`
+	Cursor          protocol.Selection `json:"cursor"`
+	SendQueue       int                `json:"send_queue"`
+	Slow            bool               `json:"slow"`
+	LastActive      time.Time          `json:"last_active"`
+}
+
+// CheckpointState describes a checkpoint and the sessions that haven't synced
+// to its version yet.
+type CheckpointState struct {
+	Version   int     `json:"version"`
+	SyncsLeft []int64 `json:"syncs_left"`
+}
+
+// QueueState describes the work that a conversation hasn't finished yet.
+type QueueState struct {
+	SendQueueCapacity int `json:"send_queue_capacity"`
+	PendingCursors    int `json:"pending_cursors"`
+	DirtyComments     int `json:"dirty_comments"`
+}
+
+// CompressionState describes how much compressing the messages sent to clients
+// of a conversation saved, as estimated from a sample of the messages.
+type CompressionState struct {
+	SavedBytes int64   `json:"saved_bytes"`
+	Ratio      float64 `json:"ratio"`
+}
+
+// inspectRequest asks a conversation to describe its state.
+type inspectRequest struct {
+	result chan<- *ConversationState
+}
+
+// inspect describes the current state of the conversation.
+func (c *Conversation) inspect() *ConversationState {
+	state := &ConversationState{
+		ConversationID: c.conversationID,
+		Status:         c.Status().String(),
+		Version:        c.version,
+		DocumentLength: len([]rune(c.doc)),
+		DocumentHash:   document.Hash(c.doc),
+		Clients:        []ClientState{},
+		Checkpoints:    []CheckpointState{},
+		Queues: QueueState{
+			SendQueueCapacity: sendQueueSize,
+			PendingCursors:    len(c.cursorsPending),
+			DirtyComments:     len(c.commentsDirty),
+		},
+		Compression: CompressionState{
+			SavedBytes: c.compression.saved(),
+			Ratio:      c.compression.ratio(),
+		},
+	}
+
+	for client := range c.clients {
+		state.Clients = append(state.Clients, ClientState{
+			SessionID:       client.sessionID,
+			UserID:          client.userID,
+			ClientID:        client.clientID,
+			ProtocolVersion: client.protocolVersion,
+			Presence:        client.presence,
+			Selection:       client.selection,
+			Cursor:          c.cursors[client],
+			SendQueue:       len(client.send),
+			Slow:            c.slow[client],
+			LastActive:      client.lastActive,
+		})
+	}
+	sort.Slice(state.Clients, func(i, j int) bool {
+		return state.Clients[i].SessionID < state.Clients[j].SessionID
+	})
+
+	for version, checkpoint := range c.checkpoint {
+		syncsLeft := []int64{}
+		for sessionID := range checkpoint.syncsLeft {
+			syncsLeft = append(syncsLeft, sessionID)
+		}
+		sort.Slice(syncsLeft, func(i, j int) bool { return syncsLeft[i] < syncsLeft[j] })
+		state.Checkpoints = append(state.Checkpoints, CheckpointState{Version: version, SyncsLeft: syncsLeft})
+	}
+	sort.Slice(state.Checkpoints, func(i, j int) bool {
+		return state.Checkpoints[i].Version < state.Checkpoints[j].Version
+	})
+
+	return state
+}
+
+// ActiveConversations lists the conversations that are running, ordered by ID.
+func (b *Broker) ActiveConversations() []ConversationSummary {
+	b.Lock()
+	defer b.Unlock()
+
+	summaries := make([]ConversationSummary, 0, len(b.active))
+	for id, cd := range b.active {
+		summary := ConversationSummary{ConversationID: id, Clients: len(cd.clients)}
+		if !cd.idleSince.IsZero() {
+			idleSince := cd.idleSince
+			summary.IdleSince = &idleSince
+		}
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].ConversationID < summaries[j].ConversationID
+	})
+	return summaries
+}
+
+// Inspect describes the state of an active conversation. The state is read by
+// the conversation's Run loop, so it is consistent with what clients were sent.
+func (b *Broker) Inspect(ctx context.Context, conversationID int64) (*ConversationState, error) {
+	b.Lock()
+	cd, ok := b.active[conversationID]
+	b.Unlock()
+	if !ok {
+		return nil, ErrConversationNotActive
+	}
+	c := cd.conversation
+
+	result := make(chan *ConversationState, 1)
+	select {
+	case c.inspection <- &inspectRequest{result: result}:
+	case <-c.stopped:
+		return nil, ErrConversationNotActive
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case state := <-result:
+		return state, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
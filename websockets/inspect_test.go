@@ -0,0 +1,63 @@
+package websockets
+
+import (
+	"context"
+	"patches/document"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestInspect(t *testing.T) {
+	b := NewBroker(&testDatastore{}, nil, &testPublisher{}, zap.NewNop())
+	c, stop := newTestConversation("")
+	defer stop()
+	b.active[c.conversationID] = &ConvoData{conversation: c, clients: make(map[*Client]bool)}
+
+	sender := newTestClient(1, c)
+	receive(t, sender)
+	lagging := newTestClient(2, c)
+	receive(t, lagging)
+
+	c.broadcast <- &BroadcastMessage{editMessage(t, "", "héllo", 1), sender, context.Background()}
+	c.compression.add(&outgoing{data: []byte(strings.Repeat("héllo ", 1000))})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	state, err := b.Inspect(ctx, c.conversationID)
+	if err != nil {
+		t.Fatalf("Failed to inspect conversation: %v", err)
+	}
+
+	if state.Version != 1 || state.DocumentLength != 5 || state.DocumentHash != document.Hash("héllo") {
+		t.Errorf("Expected version 1 of a 5 character document, got %+v", state)
+	}
+	if len(state.Clients) != 2 || state.Clients[0].UserID != 1 || state.Clients[1].UserID != 2 {
+		t.Fatalf("Expected both clients ordered by session, got %+v", state.Clients)
+	}
+	if caret := state.Clients[0].Selection.Primary(); caret.Start != 5 || caret.End != 5 {
+		t.Errorf("Expected the sender's caret to be moved by the edit, got %+v", caret)
+	}
+
+	// Only the client that didn't send the edit has to sync to its version
+	if len(state.Checkpoints) != 2 || state.Checkpoints[1].Version != 1 {
+		t.Fatalf("Expected checkpoints for versions 0 and 1, got %+v", state.Checkpoints)
+	}
+	syncsLeft := state.Checkpoints[1].SyncsLeft
+	if len(syncsLeft) != 1 || syncsLeft[0] != lagging.sessionID {
+		t.Errorf("Expected only session %d to have a sync left, got %v", lagging.sessionID, syncsLeft)
+	}
+
+	if state.Compression.SavedBytes <= 0 || state.Compression.Ratio >= 1 {
+		t.Errorf("Expected the bytes saved by compression, got %+v", state.Compression)
+	}
+
+	if _, err := b.Inspect(ctx, 2); err != ErrConversationNotActive {
+		t.Errorf("Expected inactive conversation to fail inspection, got %v", err)
+	}
+	if summaries := b.ActiveConversations(); len(summaries) != 1 || summaries[0].ConversationID != c.conversationID {
+		t.Errorf("Expected one active conversation, got %+v", summaries)
+	}
+}
@@ -0,0 +1,179 @@
+package websockets
+
+import (
+	"errors"
+	"sync/atomic"
+
+	gorillaws "github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// ErrConversationClosed is returned when a conversation that is shutting down
+// or has shut down is asked to do something.
+var ErrConversationClosed = errors.New("Conversation is shutting down")
+
+// Status is the stage of its lifecycle that a conversation is at. A
+// conversation only ever moves forward through the stages.
+type Status int32
+
+const (
+	// StatusStarting is the stage of a conversation that hasn't started
+	// serving requests yet.
+	StatusStarting Status = iota
+
+	// StatusRunning is the stage of a conversation that is serving requests.
+	StatusRunning
+
+	// StatusDraining is the stage of a conversation whose context is done,
+	// which disconnects its clients and saves its state.
+	StatusDraining
+
+	// StatusStopped is the stage of a conversation that has shut down.
+	StatusStopped
+)
+
+// String returns the name of a stage.
+func (s Status) String() string {
+	switch s {
+	case StatusStarting:
+		return "starting"
+	case StatusRunning:
+		return "running"
+	case StatusDraining:
+		return "draining"
+	case StatusStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// Status returns the stage of its lifecycle that the conversation is at.
+func (c *Conversation) Status() Status {
+	return Status(atomic.LoadInt32(&c.status))
+}
+
+// setStatus moves the conversation to a stage of its lifecycle.
+func (c *Conversation) setStatus(status Status) {
+	atomic.StoreInt32(&c.status, int32(status))
+}
+
+// Stop shuts the conversation down. It returns right away, and the
+// conversation's clients are disconnected while it drains.
+func (c *Conversation) Stop() {
+	c.cancel()
+}
+
+// registerRequest stores a client that should be added to the conversation and
+// where the outcome should be reported to.
+type registerRequest struct {
+	client *Client
+	result chan<- error
+}
+
+// Register adds a client to the conversation. ErrConversationClosed is returned
+// if the conversation is shutting down.
+func (c *Conversation) Register(client *Client) error {
+	result := make(chan error, 1)
+	select {
+	case c.register <- &registerRequest{client: client, result: result}:
+		return <-result
+	case <-c.ctx.Done():
+		return ErrConversationClosed
+	}
+}
+
+// Unregister removes a client from the conversation. Clients of a conversation
+// that is shutting down are disconnected by the conversation itself.
+func (c *Conversation) Unregister(client *Client) {
+	select {
+	case c.unregister <- client:
+	case <-c.ctx.Done():
+	}
+}
+
+// submit queues a message from a client to be processed by the conversation,
+// returning false if the conversation is shutting down.
+func (c *Conversation) submit(msg *BroadcastMessage) bool {
+	select {
+	case c.broadcast <- msg:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+// requestRevert asks the conversation to revert patches and waits for the
+// outcome.
+func (c *Conversation) requestRevert(req *revertRequest) revertResult {
+	result := make(chan revertResult, 1)
+	req.result = result
+	select {
+	case c.revert <- req:
+		return <-result
+	case <-c.ctx.Done():
+		return revertResult{err: ErrConversationClosed}
+	}
+}
+
+// requestComment asks the conversation to change or list its comments and
+// waits for the outcome.
+func (c *Conversation) requestComment(req *commentRequest) commentResult {
+	result := make(chan commentResult, 1)
+	req.result = result
+	select {
+	case c.comment <- req:
+		return <-result
+	case <-c.ctx.Done():
+		return commentResult{err: ErrConversationClosed}
+	}
+}
+
+// report hands the error of an asynchronous action to the conversation. Errors
+// that happen while the conversation is shutting down are only logged.
+func (c *Conversation) report(err error) {
+	select {
+	case c.errc <- err:
+	case <-c.ctx.Done():
+		c.logger.Error("Error occured during asynchronous action while shutting down", zap.Error(err))
+	}
+}
+
+// drain disconnects every client of a conversation whose context is done and
+// saves its comments and a snapshot if they haven't been saved yet. Other
+// clients aren't told about the clients that leave, since they are all
+// disconnected.
+func (c *Conversation) drain() {
+	c.setStatus(StatusDraining)
+	c.logger.Info(
+		"Shutting down conversation",
+		zap.Int("version", c.version),
+		zap.Int("active", len(c.clients)),
+		zap.Int64("compression_saved", c.compression.saved()),
+		zap.Float64("compression_ratio", c.compression.ratio()),
+	)
+
+	for client := range c.clients {
+		client.closeCode = gorillaws.CloseGoingAway
+		client.closeText = "Conversation is shutting down"
+		c.removeClient(client)
+	}
+
+	// Finish the changes to comments that have been requested, so that they
+	// are saved and their outcome is reported
+	for c.commentSaving != nil {
+		c.applyComment(<-c.commentSaved)
+	}
+
+	// The Broker may be shutting down the process once the conversation
+	// stops, so anchors are saved before it does
+	c.saveComments().Wait()
+
+	// Save a final snapshot before the document is dropped, so that starting
+	// the conversation again doesn't replay the patches since the last one
+	if c.version != c.snapshotVersion {
+		snapshot := c.snapshot()
+		if err := c.db.CreateSnapshot(snapshot); err != nil {
+			c.logger.Error("Failed to save final snapshot", zap.Int("version", snapshot.Version), zap.Error(err))
+		}
+	}
+}
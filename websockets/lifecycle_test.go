@@ -0,0 +1,259 @@
+package websockets
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"patches/models"
+	"patches/protocol"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gorillaws "github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// newTestBroker creates a Broker with in-memory dependencies whose
+// conversations are started with content from a test Ether server. The returned
+// function stops the server.
+func newTestBroker(content string) (*Broker, func()) {
+	return newEtherBroker(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(content))
+	}))
+}
+
+// newEtherBroker creates a Broker with in-memory dependencies whose requests to
+// Ether are handled by a test server. The returned function stops the server.
+func newEtherBroker(handler http.Handler) (*Broker, func()) {
+	ether := httptest.NewServer(handler)
+	host := etherHost
+	etherHost = strings.TrimPrefix(ether.URL, "http://")
+
+	b := NewBroker(&testDatastore{}, ether.Client(), &testPublisher{}, zap.NewNop())
+	return b, func() {
+		etherHost = host
+		ether.Close()
+	}
+}
+
+// testMember creates a member of a conversation with a handshake for the
+// latest protocol version.
+func testMember(userID, conversationID int64) (*models.UserConversationMapping, *handshake) {
+	member := &models.UserConversationMapping{
+		UserID:         userID,
+		ConversationID: conversationID,
+		Role:           models.User,
+	}
+	hs := &handshake{
+		protocolVersion: protocol.MaxProtocolVersion,
+		capabilities:    make(map[string]bool),
+		codec:           protocol.JSON,
+	}
+	return member, hs
+}
+
+func TestConversationShutdown(t *testing.T) {
+	c := NewConversation(context.Background(), 1, "hello", 0, &testDatastore{}, &testPublisher{}, zap.NewNop())
+	if c.Status() != StatusStarting {
+		t.Fatalf("Expected a new conversation to be starting, got %s", c.Status())
+	}
+	go c.Run()
+
+	first := newTestClient(1, c)
+	firstMessages := receive(t, first)
+	second := newTestClient(2, c)
+	secondMessages := receive(t, second)
+	if c.Status() != StatusRunning {
+		t.Fatalf("Expected the conversation to be running, got %s", c.Status())
+	}
+
+	// Clients are disconnected without being told about each other leaving
+	c.Stop()
+	for _, messages := range []<-chan protocol.Message{firstMessages, secondMessages} {
+		if _, ok := next(messages, protocol.TypeUserLeave, time.Second); ok {
+			t.Fatalf("Expected no UserLeave while the conversation shuts down")
+		}
+	}
+	for _, client := range []*Client{first, second} {
+		if client.closeCode != gorillaws.CloseGoingAway {
+			t.Fatalf("Expected clients to be disconnected as going away, got close code %d", client.closeCode)
+		}
+	}
+
+	<-c.stopped
+	if c.Status() != StatusStopped {
+		t.Fatalf("Expected the conversation to be stopped, got %s", c.Status())
+	}
+
+	// Nothing that is sent to a stopped conversation blocks
+	member, hs := testMember(3, 1)
+	late := NewClient(member, hs, nil, false, nil, c, zap.NewNop())
+	if err := c.Register(late); err != ErrConversationClosed {
+		t.Fatalf("Expected registering after shutdown to fail, got %v", err)
+	}
+	if c.submit(&BroadcastMessage{syncMessage(t, 0), first, context.Background()}) {
+		t.Fatalf("Expected messages sent after shutdown to be refused")
+	}
+	if res := c.requestComment(&commentRequest{action: commentList}); res.err != ErrConversationClosed {
+		t.Fatalf("Expected listing comments after shutdown to fail, got %v", res.err)
+	}
+	c.Unregister(first)
+	c.report(ErrConversationClosed)
+}
+
+func TestBrokerShutdown(t *testing.T) {
+	b, stop := newTestBroker("hello")
+	defer stop()
+
+	member, hs := testMember(1, 1)
+	client, err := b.register(context.Background(), member, hs, nil, false, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to register client: %v", err)
+	}
+	messages := receive(t, client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := b.Shutdown(ctx); err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+	if !closed(messages, time.Second) {
+		t.Fatalf("Expected the client to be disconnected")
+	}
+	if client.conversation.Status() != StatusStopped {
+		t.Fatalf("Expected the conversation to be stopped, got %s", client.conversation.Status())
+	}
+
+	// The client's connection closing only removes it from the Broker
+	b.unregister(client)
+	if len(b.ActiveConversations()) != 0 {
+		t.Fatalf("Expected no active conversations, got %v", b.ActiveConversations())
+	}
+
+	if _, err := b.register(context.Background(), member, hs, nil, false, zap.NewNop()); err != ErrShuttingDown {
+		t.Fatalf("Expected registering after shutdown to fail, got %v", err)
+	}
+}
+
+// TestBrokerChurn connects and disconnects clients of a few conversations
+// concurrently, some of which are disconnected by their conversation for
+// sending invalid messages, so that races show up under go test -race.
+func TestBrokerChurn(t *testing.T) {
+	const (
+		numWorkers       = 20
+		numRounds        = 25
+		numConversations = 3
+	)
+
+	// Conversations expire while clients keep reconnecting to them
+	defer func(grace time.Duration) { idleGracePeriod = grace }(idleGracePeriod)
+	idleGracePeriod = time.Millisecond
+
+	b, stop := newTestBroker("hello")
+	defer stop()
+
+	synced := syncMessage(t, 0)
+	cursor := cursorMessage(t, 1, 1, 0)
+	invalid := []byte(`{"type": 1, "data": {"type": 9}}`)
+
+	var mu sync.Mutex
+	conversations := make(map[*Conversation]bool)
+
+	done := make(chan struct{})
+	var observers sync.WaitGroup
+	observers.Add(1)
+	go func() {
+		defer observers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for id := int64(1); id <= numConversations; id++ {
+				b.Comments(id)
+				b.Inspect(context.Background(), id)
+			}
+			b.ActiveConversations()
+		}
+	}()
+
+	var workers sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		workers.Add(1)
+		go func(userID int64) {
+			defer workers.Done()
+			for round := 0; round < numRounds; round++ {
+				member, hs := testMember(userID, int64(round%numConversations)+1)
+				client, err := b.register(context.Background(), member, hs, nil, false, zap.NewNop())
+				if err != nil {
+					t.Errorf("Failed to register client: %v", err)
+					return
+				}
+				mu.Lock()
+				conversations[client.conversation] = true
+				mu.Unlock()
+				messages := receive(t, client)
+
+				client.conversation.submit(&BroadcastMessage{synced, client, context.Background()})
+				client.conversation.submit(&BroadcastMessage{cursor, client, context.Background()})
+				if round%2 == 0 {
+					client.conversation.submit(&BroadcastMessage{invalid, client, context.Background()})
+				}
+				b.unregister(client)
+
+				if !closed(messages, time.Second) {
+					t.Errorf("Expected client to be disconnected")
+					return
+				}
+			}
+		}(int64(i + 1))
+	}
+	workers.Wait()
+	close(done)
+	observers.Wait()
+
+	for conversation := range conversations {
+		select {
+		case <-conversation.stopped:
+		case <-time.After(time.Second):
+			t.Fatalf("Conversation %d did not stop", conversation.conversationID)
+		}
+	}
+	if active := b.ActiveConversations(); len(active) != 0 {
+		t.Fatalf("Expected every conversation to be deactivated, got %v", active)
+	}
+}
+
+// slowUpdateStore is a testDatastore that takes a while to update comments.
+type slowUpdateStore struct {
+	*testDatastore
+}
+
+func (db *slowUpdateStore) UpdateComment(comment *models.Comment) error {
+	time.Sleep(50 * time.Millisecond)
+	return db.testDatastore.UpdateComment(comment)
+}
+
+func TestShutdownSavesComments(t *testing.T) {
+	db := &slowUpdateStore{&testDatastore{
+		comments: []models.Comment{{ID: 1, ConvoID: 1, Version: 0, Start: 6, End: 11}},
+	}}
+	c := NewConversation(context.Background(), 1, "hello world", 0, db, &testPublisher{}, zap.NewNop())
+	go c.Run()
+
+	client := newTestClient(1, c)
+	receive(t, client)
+	c.submit(&BroadcastMessage{editMessage(t, "hello world", "abhello world", 1), client, context.Background()})
+
+	// Anchors that moved since they were saved are saved before the
+	// conversation stops
+	c.Stop()
+	<-c.stopped
+	comments, _ := db.GetComments(1)
+	if len(comments) != 1 || comments[0].Start != 8 || comments[0].End != 13 || comments[0].Version != 1 {
+		t.Fatalf("Expected the comment to be saved anchored to (8, 13) at version 1, got %+v", comments)
+	}
+}
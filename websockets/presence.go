@@ -0,0 +1,101 @@
+package websockets
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"patches/protocol"
+	"time"
+)
+
+// palette is the set of colors that users are shown in. Colors are picked from
+// a palette rather than generated so that they stay distinguishable.
+var palette = []string{
+	"#e6194b",
+	"#3cb44b",
+	"#4363d8",
+	"#f58231",
+	"#911eb4",
+	"#42d4f4",
+	"#f032e6",
+	"#469990",
+	"#9a6324",
+	"#800000",
+	"#808000",
+	"#000075",
+}
+
+var (
+	// presenceInterval is how often the presence of clients is checked.
+	presenceInterval = time.Second
+
+	// typingTimeout is how long a client is shown as typing after its last
+	// edit.
+	typingTimeout = 3 * time.Second
+
+	// idleAfter is how long a client has to be inactive to be shown as idle.
+	idleAfter = time.Duration(envInt("PATCHES_IDLE_AFTER_S", 60)) * time.Second
+
+	// awayAfter is how long a client has to be inactive to be shown as away.
+	awayAfter = time.Duration(envInt("PATCHES_AWAY_AFTER_S", 300)) * time.Second
+)
+
+// colorFor returns the color of a user in a conversation, which is the same
+// every time the user joins the conversation.
+func colorFor(conversationID, userID int64) string {
+	var key [16]byte
+	binary.BigEndian.PutUint64(key[:8], uint64(conversationID))
+	binary.BigEndian.PutUint64(key[8:], uint64(userID))
+
+	h := fnv.New64a()
+	h.Write(key[:])
+	return palette[h.Sum64()%uint64(len(palette))]
+}
+
+// presenceAt derives what a client is doing at a point in time from when it
+// last edited the document and last sent a message other than a Sync, which
+// clients send on their own.
+func presenceAt(client *Client, now time.Time) protocol.Presence {
+	if now.Sub(client.lastTyped) < typingTimeout {
+		return protocol.PresenceTyping
+	}
+
+	inactive := now.Sub(client.lastActive)
+	switch {
+	case inactive >= awayAfter:
+		return protocol.PresenceAway
+	case inactive >= idleAfter:
+		return protocol.PresenceIdle
+	default:
+		return protocol.PresenceActive
+	}
+}
+
+// user returns the display info of a client's user.
+func (client *Client) user() protocol.User {
+	return protocol.User{
+		Nickname: client.nickname,
+		Role:     string(client.role),
+		Color:    client.color,
+		Presence: client.presence,
+	}
+}
+
+// setPresence changes the presence of a client and broadcasts a Presence
+// message to all other users if the presence of its user changed.
+func (c *Conversation) setPresence(client *Client, presence protocol.Presence) error {
+	if client.presence == presence {
+		return nil
+	}
+	client.presence = presence
+	return c.updateUserPresence(client.userID)
+}
+
+// updatePresence updates the presence of every client in the conversation.
+func (c *Conversation) updatePresence(now time.Time) error {
+	for client := range c.clients {
+		if err := c.setPresence(client, presenceAt(client, now)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
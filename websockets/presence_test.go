@@ -0,0 +1,109 @@
+package websockets
+
+import (
+	"context"
+	"patches/protocol"
+	"testing"
+	"time"
+)
+
+func TestPresence(t *testing.T) {
+	defer func(interval, typing, idle, away time.Duration) {
+		presenceInterval, typingTimeout, idleAfter, awayAfter = interval, typing, idle, away
+	}(presenceInterval, typingTimeout, idleAfter, awayAfter)
+	presenceInterval = 5 * time.Millisecond
+	typingTimeout = 50 * time.Millisecond
+	idleAfter = 100 * time.Millisecond
+	awayAfter = 200 * time.Millisecond
+
+	c, stop := newTestConversation("")
+	defer stop()
+
+	sender := newTestClient(1, c)
+	receive(t, sender)
+	receiver := newTestClient(2, c)
+	messages := receive(t, receiver)
+
+	// The receiver learns about the users that were already present from its
+	// Init message
+	init := <-messages
+	for init.Type != protocol.TypeInit {
+		init = <-messages
+	}
+	if init.Data.Users == nil {
+		t.Fatal("Expected users in Init message")
+	}
+	expected := protocol.User{
+		Role:     "user",
+		Color:    colorFor(1, 1),
+		Presence: protocol.PresenceActive,
+	}
+	if user := (*init.Data.Users)[1]; user != expected {
+		t.Errorf("Expected user 1 to be %+v, got %+v", expected, user)
+	}
+
+	// Editing makes the sender type, after which it goes idle and then away
+	c.broadcast <- &BroadcastMessage{editMessage(t, "", "a", 1), sender, context.Background()}
+	timeout := time.After(5 * time.Second)
+	for _, presence := range []protocol.Presence{
+		protocol.PresenceTyping,
+		protocol.PresenceActive,
+		protocol.PresenceIdle,
+		protocol.PresenceAway,
+	} {
+		for {
+			var msg protocol.Message
+			select {
+			case msg = <-messages:
+			case <-timeout:
+				t.Fatalf("Timed out waiting for user 1 to be %s", presence)
+			}
+			if msg.Type != protocol.TypePresence {
+				continue
+			}
+			if *msg.Data.UserID != 1 || *msg.Data.Presence != presence {
+				t.Fatalf("Expected user 1 to be %s, got %+v", presence, msg.Data)
+			}
+			break
+		}
+	}
+}
+
+func TestActivity(t *testing.T) {
+	c, stop := newTestConversation("hello")
+	defer stop()
+
+	client := newTestClient(1, c)
+	receive(t, client)
+	lastActive := func() time.Time {
+		return inspectConversation(c).Clients[0].LastActive
+	}
+	joined := lastActive()
+
+	// Syncs are sent by clients on their own, so they aren't activity
+	time.Sleep(5 * time.Millisecond)
+	c.broadcast <- &BroadcastMessage{syncMessage(t, 0), client, context.Background()}
+	if active := lastActive(); !active.Equal(joined) {
+		t.Fatalf("Expected a Sync not to count as activity, got %v after %v", active, joined)
+	}
+
+	c.broadcast <- &BroadcastMessage{cursorMessage(t, 1, 1, 0), client, context.Background()}
+	if active := lastActive(); !active.After(joined) {
+		t.Fatalf("Expected a cursor update to count as activity, got %v after %v", active, joined)
+	}
+}
+
+func TestColorFor(t *testing.T) {
+	if colorFor(1, 2) != colorFor(1, 2) {
+		t.Error("Expected a user's color to be stable")
+	}
+
+	// Users in a conversation should get a spread of colors
+	colors := make(map[string]bool)
+	for userID := int64(0); userID < 100; userID++ {
+		colors[colorFor(1, userID)] = true
+	}
+	if len(colors) < len(palette)/2 {
+		t.Errorf("Expected users to get many colors, got %d", len(colors))
+	}
+}
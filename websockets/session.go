@@ -0,0 +1,115 @@
+package websockets
+
+import "patches/protocol"
+
+// presenceRanks orders presences from least to most active, so that the
+// presence of a user is that of its most active session.
+var presenceRanks = map[protocol.Presence]int{
+	protocol.PresenceAway:   0,
+	protocol.PresenceIdle:   1,
+	protocol.PresenceActive: 2,
+	protocol.PresenceTyping: 3,
+}
+
+// knowsSessions reports whether a client speaks a protocol version that tells
+// apart the sessions of a user. Other clients only know about users, and see
+// the primary session of each user as if it were the user.
+func (client *Client) knowsSessions() bool {
+	return client.protocolVersion >= protocol.ProtocolV5
+}
+
+// sessionsOf returns the clients of a user in the conversation.
+func (c *Conversation) sessionsOf(userID int64) []*Client {
+	sessions := []*Client{}
+	for client := range c.clients {
+		if client.userID == userID {
+			sessions = append(sessions, client)
+		}
+	}
+	return sessions
+}
+
+// primarySession returns the oldest client of a user in the conversation, or
+// nil if the user has no clients.
+func (c *Conversation) primarySession(userID int64) *Client {
+	var primary *Client
+	for _, client := range c.sessionsOf(userID) {
+		if primary == nil || client.sessionID < primary.sessionID {
+			primary = client
+		}
+	}
+	return primary
+}
+
+// userPresenceOf returns the presence of the most active client of a user.
+func (c *Conversation) userPresenceOf(userID int64) protocol.Presence {
+	presence := protocol.PresenceAway
+	for _, client := range c.sessionsOf(userID) {
+		if presenceRanks[client.presence] > presenceRanks[presence] {
+			presence = client.presence
+		}
+	}
+	return presence
+}
+
+// updateUserPresence broadcasts a Presence message if the presence of a user
+// changed since it was last broadcast.
+func (c *Conversation) updateUserPresence(userID int64) error {
+	if len(c.sessionsOf(userID)) == 0 {
+		delete(c.userPresence, userID)
+		return nil
+	}
+
+	presence := c.userPresenceOf(userID)
+	if c.userPresence[userID] == presence {
+		return nil
+	}
+	c.userPresence[userID] = presence
+
+	msg := protocol.Message{
+		Type: protocol.TypePresence,
+		Data: protocol.InnerData{
+			UserID:   &userID,
+			Presence: &presence,
+		},
+	}
+	return c.broadcastWhere(msg, func(client *Client) bool {
+		return client.userID != userID
+	})
+}
+
+// correctLegacySelection sends the selection of a user's primary session to
+// clients that don't know about sessions, if it differs from the selection they
+// believe the user has.
+func (c *Conversation) correctLegacySelection(userID int64, believed protocol.Selection) error {
+	primary := c.primarySession(userID)
+	if primary == nil {
+		return nil
+	}
+
+	selection := c.cursors[primary]
+	if selection.Equal(believed) {
+		return nil
+	}
+
+	updateType := protocol.UpdateTypeCursor
+	version := c.version
+	caretStart := selection.Primary().Start - believed.Primary().Start
+	caretEnd := selection.Primary().End - believed.Primary().End
+	msg := protocol.Message{
+		Type: protocol.TypeUpdate,
+		Data: protocol.InnerData{
+			Type:    &updateType,
+			Version: &version,
+			UserID:  &userID,
+			Delta: &protocol.Delta{
+				CaretStart: &caretStart,
+				CaretEnd:   &caretEnd,
+			},
+			Selection: &selection,
+		},
+	}
+	return c.broadcastWhere(msg, func(client *Client) bool {
+		return !client.knowsSessions() && client.userID != userID
+	})
+}
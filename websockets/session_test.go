@@ -0,0 +1,131 @@
+package websockets
+
+import (
+	"context"
+	"encoding/json"
+	"patches/protocol"
+	"testing"
+	"time"
+)
+
+// syncMessage encodes a Sync message for a version.
+func syncMessage(t *testing.T, version int) []byte {
+	data, err := json.Marshal(protocol.Message{
+		Type: protocol.TypeSync,
+		Data: protocol.InnerData{Version: &version},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode sync: %v", err)
+	}
+	return data
+}
+
+// next waits for the next message of a type that a test client receives,
+// returning false if none arrives before the timeout.
+func next(messages <-chan protocol.Message, msgType protocol.MessageType, timeout time.Duration) (protocol.Message, bool) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return protocol.Message{}, false
+			}
+			if msg.Type == msgType {
+				return msg, true
+			}
+		case <-deadline:
+			return protocol.Message{}, false
+		}
+	}
+}
+
+func TestMultipleSessions(t *testing.T) {
+	defer func(window time.Duration) { cursorWindow = window }(cursorWindow)
+	cursorWindow = 0
+
+	c, stop := newTestConversation("hello world")
+	defer stop()
+
+	// User 1 is connected twice, and is seen by user 2, who knows about
+	// sessions, and user 3, who doesn't
+	first := newTestClient(1, c)
+	receive(t, first)
+	second := newTestClient(1, c)
+	receive(t, second)
+	aware := newTestClient(2, c)
+	awareMessages := receive(t, aware)
+	legacy := newVersionedTestClient(3, protocol.ProtocolV4, c)
+	legacyMessages := receive(t, legacy)
+
+	init, ok := next(awareMessages, protocol.TypeInit, time.Second)
+	if !ok {
+		t.Fatal("Expected an Init message")
+	}
+	if len(*init.Data.Sessions) != 2 || len(*init.Data.ActiveUsers) != 1 {
+		t.Errorf("Expected 2 sessions of 1 user, got %+v", init.Data)
+	}
+	init, ok = next(legacyMessages, protocol.TypeInit, time.Second)
+	if !ok {
+		t.Fatal("Expected an Init message")
+	}
+	if init.Data.Sessions != nil || len(*init.Data.ActiveUsers) != 2 {
+		t.Errorf("Expected 2 users without sessions, got %+v", init.Data)
+	}
+	if join, ok := next(legacyMessages, protocol.TypeUserJoin, 50*time.Millisecond); ok {
+		t.Errorf("Expected no UserJoin message, got %+v", join.Data)
+	}
+
+	// Every session has to sync before the checkpoint is complete
+	c.broadcast <- &BroadcastMessage{editMessage(t, "hello world", "hello world!", 1), aware, context.Background()}
+	if edit, ok := next(legacyMessages, protocol.TypeUpdate, time.Second); !ok || !isEdit(edit) {
+		t.Fatalf("Expected an edit, got %+v", edit.Data)
+	}
+	c.broadcast <- &BroadcastMessage{syncMessage(t, 1), first, context.Background()}
+	c.broadcast <- &BroadcastMessage{syncMessage(t, 1), legacy, context.Background()}
+	if sync, ok := next(awareMessages, protocol.TypeSync, 50*time.Millisecond); ok {
+		t.Fatalf("Expected no Sync message before every session synced, got %+v", sync.Data)
+	}
+	c.broadcast <- &BroadcastMessage{syncMessage(t, 1), second, context.Background()}
+	if _, ok := next(awareMessages, protocol.TypeSync, time.Second); !ok {
+		t.Fatal("Expected a Sync message once every session synced")
+	}
+
+	// Only clients that know about sessions see the cursor of the second
+	// session
+	c.broadcast <- &BroadcastMessage{cursorMessage(t, 2, 2, 1), second, context.Background()}
+	update, ok := next(awareMessages, protocol.TypeUpdate, time.Second)
+	if !ok {
+		t.Fatal("Expected a cursor update")
+	}
+	if *update.Data.SessionID != second.sessionID || *update.Data.Delta.CaretStart != 2 {
+		t.Errorf("Expected session %d to move by 2, got %+v", second.sessionID, update.Data)
+	}
+	if update, ok := next(legacyMessages, protocol.TypeUpdate, 50*time.Millisecond); ok {
+		t.Errorf("Expected no cursor update, got %+v", update.Data)
+	}
+
+	// Closing the first session moves user 1 to the second session's caret
+	// for clients that don't know about sessions, which aren't told that user
+	// 1 left until its last session closes
+	c.unregister <- first
+	leave, ok := next(awareMessages, protocol.TypeUserLeave, time.Second)
+	if !ok || *leave.Data.SessionID != first.sessionID {
+		t.Errorf("Expected session %d to leave, got %+v", first.sessionID, leave.Data)
+	}
+	update, ok = next(legacyMessages, protocol.TypeUpdate, time.Second)
+	if !ok {
+		t.Fatal("Expected a cursor update")
+	}
+	if *update.Data.UserID != 1 || *update.Data.Delta.CaretStart != 2 || *update.Data.Delta.CaretEnd != 2 {
+		t.Errorf("Expected user 1 to move by 2, got %+v", update.Data)
+	}
+	if leave, ok := next(legacyMessages, protocol.TypeUserLeave, 50*time.Millisecond); ok {
+		t.Errorf("Expected no UserLeave message, got %+v", leave.Data)
+	}
+
+	c.unregister <- second
+	leave, ok = next(legacyMessages, protocol.TypeUserLeave, time.Second)
+	if !ok || *leave.Data.UserID != 1 {
+		t.Errorf("Expected user 1 to leave, got %+v", leave.Data)
+	}
+}
@@ -0,0 +1,155 @@
+package websockets
+
+import (
+	"context"
+	"patches/metrics"
+	"patches/models"
+	"patches/tracing"
+
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.uber.org/zap"
+)
+
+// startup is a conversation being started, which every client of the
+// conversation that connects in the meantime waits for. err is set before done
+// is closed.
+type startup struct {
+	done    chan struct{}
+	waiting int
+	err     error
+}
+
+// activate gets the active conversation that a member belongs to, starting it
+// if there isn't one. A conversation is only started once however many clients
+// need it at the same time, and its content is fetched without holding the
+// Broker's lock. Callers that give up stop waiting without affecting the
+// others. The conversation is held open until the caller finishes with it, or
+// adds a client to it.
+func (b *Broker) activate(ctx context.Context, member *models.UserConversationMapping) (*ConvoData, error) {
+	conversationID := member.ConversationID
+	for {
+		b.Lock()
+		if b.ctx.Err() != nil {
+			b.Unlock()
+			return nil, ErrShuttingDown
+		}
+		if cd, ok := b.active[conversationID]; ok {
+			b.hold(cd)
+			b.Unlock()
+			return cd, nil
+		}
+
+		s, ok := b.starting[conversationID]
+		if !ok {
+			s = &startup{done: make(chan struct{})}
+			b.starting[conversationID] = s
+			go b.start(trace.SpanFromContext(ctx).SpanContext(), member, s)
+		}
+		s.waiting++
+		b.Unlock()
+
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			// done is closed with the Broker locked, so a conversation that
+			// started just as the caller gave up is still held by it
+			b.Lock()
+			select {
+			case <-s.done:
+			default:
+				s.waiting--
+				b.Unlock()
+				return nil, ctx.Err()
+			}
+			b.Unlock()
+		}
+		if s.err != nil {
+			return nil, s.err
+		}
+
+		// The conversation has started, so it is held open like any other
+		// active conversation, or started again if it has already shut down
+	}
+}
+
+// start gets the content and latest version of a conversation and makes the
+// conversation active, reporting the outcome to every client waiting for it.
+// The content is fetched in the Broker's context, since it is shared by every
+// client waiting, and its span is linked to the client that started it. A
+// conversation that nobody is waiting for anymore is released right away.
+func (b *Broker) start(link trace.SpanContext, member *models.UserConversationMapping, s *startup) {
+	conversationID := member.ConversationID
+	ctx, span := tracer.Start(b.ctx, "conversation.start",
+		trace.LinkedTo(link),
+		trace.WithAttributes(kv.Int64("conversation_id", conversationID)),
+	)
+	content, version, err := b.load(ctx, member)
+	tracing.End(ctx, span, err)
+
+	b.Lock()
+	defer b.Unlock()
+	delete(b.starting, conversationID)
+	defer close(s.done)
+
+	if err == nil && b.ctx.Err() != nil {
+		err = ErrShuttingDown
+	}
+	if err != nil {
+		b.logger.Warn(
+			"Failed to start conversation",
+			zap.Int64("conversation_id", conversationID),
+			zap.Int("waiting", s.waiting),
+			zap.Error(err),
+		)
+		s.err = err
+		return
+	}
+
+	cd := &ConvoData{
+		conversation: NewConversation(b.ctx, conversationID, content, version, b.db, b.kafkaWriter, b.logger),
+		clients:      make(map[*Client]bool),
+	}
+	go cd.conversation.Run()
+	b.active[conversationID] = cd
+	metrics.ActiveConversations.Inc()
+	if s.waiting == 0 {
+		b.release(conversationID, cd)
+	}
+}
+
+// load gets the HTML content of a conversation and the latest version that was
+// persisted, which the conversation continues from so that versions are unique
+// across its whole history.
+func (b *Broker) load(ctx context.Context, member *models.UserConversationMapping) (string, int, error) {
+	content, err := b.getConversationContent(ctx, member.UserID, member.ConversationID)
+	if err != nil {
+		return "", 0, err
+	}
+
+	_, span := tracer.Start(ctx, "db.get_latest_version")
+	version, err := b.db.GetLatestVersion(member.ConversationID)
+	tracing.End(ctx, span, err)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return content, version, nil
+}
+
+// hold keeps an active conversation open for a caller until it finishes with
+// it. A conversation that is kept warm is used again. The Broker must be locked
+// by the caller.
+func (b *Broker) hold(cd *ConvoData) {
+	b.use(cd)
+	cd.holds++
+}
+
+// finish lets go of a conversation that was held open by activate.
+func (b *Broker) finish(conversationID int64, cd *ConvoData) {
+	b.Lock()
+	defer b.Unlock()
+
+	cd.holds--
+	b.release(conversationID, cd)
+}
@@ -0,0 +1,223 @@
+package websockets
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// slowEther is an Ether handler whose responses are held back until it is
+// released. It counts the requests for conversation content.
+type slowEther struct {
+	requests int32
+	arrived  chan struct{}
+	release  chan struct{}
+	status   int
+}
+
+func newSlowEther(status int) *slowEther {
+	return &slowEther{
+		arrived: make(chan struct{}, 100),
+		release: make(chan struct{}),
+		status:  status,
+	}
+}
+
+func (e *slowEther) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&e.requests, 1)
+	e.arrived <- struct{}{}
+	<-e.release
+	w.WriteHeader(e.status)
+	w.Write([]byte("hello"))
+}
+
+// registerAll registers clients of a conversation concurrently and returns the
+// outcome of each registration once they have all finished.
+func registerAll(b *Broker, numClients int, conversationID int64) ([]*Client, []error) {
+	clients := make([]*Client, numClients)
+	errs := make([]error, numClients)
+	var wg sync.WaitGroup
+	for i := 0; i < numClients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			member, hs := testMember(int64(i+1), conversationID)
+			clients[i], errs[i] = b.register(context.Background(), member, hs, nil, false, zap.NewNop())
+		}(i)
+	}
+	wg.Wait()
+	return clients, errs
+}
+
+func TestCoalescedStartup(t *testing.T) {
+	const numClients = 10
+
+	ether := newSlowEther(http.StatusOK)
+	b, stop := newEtherBroker(ether)
+	defer stop()
+	defer b.Shutdown(context.Background())
+
+	done := make(chan struct{})
+	var clients []*Client
+	var errs []error
+	go func() {
+		clients, errs = registerAll(b, numClients, 1)
+		close(done)
+	}()
+	<-ether.arrived
+
+	// The Broker isn't locked while the conversation is being started
+	unlocked := make(chan struct{})
+	go func() {
+		b.ActiveConversations()
+		close(unlocked)
+	}()
+	select {
+	case <-unlocked:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the Broker not to be locked while fetching content")
+	}
+
+	close(ether.release)
+	<-done
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Failed to register client: %v", err)
+		}
+		receive(t, clients[i])
+		if clients[i].conversation != clients[0].conversation {
+			t.Fatalf("Expected every client to join the same conversation")
+		}
+	}
+	if requests := atomic.LoadInt32(&ether.requests); requests != 1 {
+		t.Fatalf("Expected the content to be fetched once, got %d requests", requests)
+	}
+	if state := inspectConversation(clients[0].conversation); len(state.Clients) != numClients {
+		t.Fatalf("Expected %d clients, got %d", numClients, len(state.Clients))
+	}
+}
+
+func TestFailedStartup(t *testing.T) {
+	const numClients = 10
+
+	ether := newSlowEther(http.StatusInternalServerError)
+	b, stop := newEtherBroker(ether)
+	defer stop()
+
+	done := make(chan struct{})
+	var errs []error
+	go func() {
+		_, errs = registerAll(b, numClients, 1)
+		close(done)
+	}()
+	<-ether.arrived
+	close(ether.release)
+	<-done
+
+	// Every waiting client is told that the conversation failed to start, and
+	// the failure isn't remembered for clients that connect later
+	for _, err := range errs {
+		if err == nil {
+			t.Fatalf("Expected registering to fail when the content can't be fetched")
+		}
+	}
+	b.Lock()
+	starting, active := len(b.starting), len(b.active)
+	b.Unlock()
+	if starting != 0 || active != 0 {
+		t.Fatalf("Expected no conversations, got %d starting and %d active", starting, active)
+	}
+}
+
+func TestCanceledStartupWaiter(t *testing.T) {
+	ether := newSlowEther(http.StatusOK)
+	b, stop := newEtherBroker(ether)
+	defer stop()
+	defer b.Shutdown(context.Background())
+
+	// waiting reports how many clients wait for the conversation to start
+	waiting := func() int {
+		b.Lock()
+		defer b.Unlock()
+		return b.starting[1].waiting
+	}
+
+	// The client that started the conversation gives up while another waits
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	go func() {
+		member, hs := testMember(1, 1)
+		_, err := b.register(ctx, member, hs, nil, false, zap.NewNop())
+		canceled <- err
+	}()
+	<-ether.arrived
+	started := make(chan error, 1)
+	go func() {
+		member, hs := testMember(2, 1)
+		_, err := b.register(context.Background(), member, hs, nil, false, zap.NewNop())
+		started <- err
+	}()
+	for waiting() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A client that stops waiting is no longer counted, and the conversation
+	// is started either way for the others
+	cancel()
+	if err := <-canceled; err != context.Canceled {
+		t.Errorf("Expected registering to be canceled, got %v", err)
+	}
+	if n := waiting(); n != 1 {
+		t.Errorf("Expected one client waiting, got %d", n)
+	}
+
+	close(ether.release)
+	if err := <-started; err != nil {
+		t.Fatalf("Failed to register client: %v", err)
+	}
+}
+
+func TestAbandonedStartup(t *testing.T) {
+	defer func(grace time.Duration) { idleGracePeriod = grace }(idleGracePeriod)
+	idleGracePeriod = time.Minute
+
+	ether := newSlowEther(http.StatusOK)
+	b, stop := newEtherBroker(ether)
+	defer stop()
+	defer b.Shutdown(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	go func() {
+		member, hs := testMember(1, 1)
+		_, err := b.register(ctx, member, hs, nil, false, zap.NewNop())
+		canceled <- err
+	}()
+	<-ether.arrived
+	cancel()
+	if err := <-canceled; err != context.Canceled {
+		t.Fatalf("Expected registering to be canceled, got %v", err)
+	}
+
+	// A conversation that nobody waits for anymore is kept warm once started
+	close(ether.release)
+	for {
+		b.Lock()
+		_, starting := b.starting[1]
+		b.Unlock()
+		if !starting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	active := b.ActiveConversations()
+	if len(active) != 1 || active[0].IdleSince == nil {
+		t.Fatalf("Expected the conversation to be kept warm, got %v", active)
+	}
+}
@@ -0,0 +1,79 @@
+package websockets
+
+import (
+	"context"
+	"encoding/json"
+	"patches/document"
+	"patches/metrics"
+	"patches/protocol"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// hashedSyncMessage encodes a Sync message for a version that reports the hash
+// of the client's document.
+func hashedSyncMessage(t *testing.T, version int, hash string) []byte {
+	data, err := json.Marshal(protocol.Message{
+		Type: protocol.TypeSync,
+		Data: protocol.InnerData{Version: &version, Hash: &hash},
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode sync: %v", err)
+	}
+	return data
+}
+
+func TestDivergence(t *testing.T) {
+	c, stop := newTestConversation("hello")
+	defer stop()
+
+	sender := newTestClient(1, c)
+	senderMessages := receive(t, sender)
+	diverged := newTestClient(2, c)
+	divergedMessages := receive(t, diverged)
+	legacy := newVersionedTestClient(3, protocol.ProtocolV7, c)
+	legacyMessages := receive(t, legacy)
+
+	init, ok := next(divergedMessages, protocol.TypeInit, time.Second)
+	if !ok || init.Data.Hash == nil || *init.Data.Hash != document.Hash("hello") {
+		t.Fatalf("Expected Init message with the hash of the document, got %+v", init.Data)
+	}
+
+	c.broadcast <- &BroadcastMessage{editMessage(t, "hello", "hello!", 1), sender, context.Background()}
+	ack, ok := next(senderMessages, protocol.TypeAck, time.Second)
+	if !ok || ack.Data.Hash == nil || *ack.Data.Hash != document.Hash("hello!") {
+		t.Fatalf("Expected Ack message with the hash of the edited document, got %+v", ack.Data)
+	}
+
+	// A client whose document doesn't match is sent the whole document again,
+	// while a matching client just syncs
+	divergences := testutil.ToFloat64(metrics.Divergences)
+	c.broadcast <- &BroadcastMessage{hashedSyncMessage(t, 1, document.Hash("hello?")), diverged, context.Background()}
+	c.broadcast <- &BroadcastMessage{syncMessage(t, 1), legacy, context.Background()}
+
+	resync, ok := next(divergedMessages, protocol.TypeInit, time.Second)
+	if !ok || *resync.Data.Content != "hello!" || *resync.Data.Version != 1 || *resync.Data.Hash != document.Hash("hello!") {
+		t.Fatalf("Expected diverged client to be resynced, got %+v", resync.Data)
+	}
+	if sessions := *resync.Data.Sessions; len(sessions) != 2 || sessions[diverged.sessionID].UserID != 0 {
+		t.Errorf("Expected resync to list every other session, got %+v", sessions)
+	}
+	if diff := testutil.ToFloat64(metrics.Divergences) - divergences; diff != 1 {
+		t.Errorf("Expected 1 divergence, got %v", diff)
+	}
+
+	// The resynced client no longer holds up the checkpoint, so every client
+	// is told that the version is synced
+	sync, ok := next(senderMessages, protocol.TypeSync, time.Second)
+	if !ok || *sync.Data.Version != 1 || *sync.Data.Hash != document.Hash("hello!") {
+		t.Fatalf("Expected Sync message with the hash of the document, got %+v", sync.Data)
+	}
+	if sync, ok := next(legacyMessages, protocol.TypeSync, time.Second); !ok || sync.Data.Hash != nil {
+		t.Fatalf("Expected Sync message without a hash for the legacy client, got %+v", sync.Data)
+	}
+	if _, ok := next(senderMessages, protocol.TypeInit, 50*time.Millisecond); ok {
+		t.Error("Expected only the diverged client to be resynced")
+	}
+}